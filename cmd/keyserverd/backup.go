@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/keydb"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func newBackupCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Write a timestamped snapshot of the database",
+		Long: `
+Writes a consistent snapshot of the database into --dir, named after the time it
+was taken, e.g. keyserver-20190601T030000Z.db.  Snapshots are bolt databases
+whatever the driver, and can be served directly with --driver bolt or moved
+onto another backend with "keyserverd copy".
+
+To back up a running keyserverd without downtime, start it with --adminbind and
+point --admin at that address:
+
+    keyserverd backup --admin http://127.0.0.1:8081 --keep 7
+
+Without --admin the database is opened directly, so keyserverd must not be
+running against it.  --keep prunes all but the newest snapshots in --dir.`,
+		Args: cobra.NoArgs,
+		RunE: ExecBackup,
+	}
+	cmd.Flags().String("dir", "", "Directory to write snapshots into.  Defaults to a backups directory beside --dbpath.")
+	cmd.Flags().String("admin", "", "Admin URL of a running keyserverd to back up, e.g. http://127.0.0.1:8081.")
+	cmd.Flags().Int("keep", 0, "Number of snapshots to keep in --dir.  Zero keeps them all.")
+	return cmd
+}
+
+// ExecBackup writes a snapshot of the configured database, or of a running keyserverd
+func ExecBackup(cmd *cobra.Command, args []string) error {
+	dir, err := cmd.Flags().GetString("dir")
+	if err != nil {
+		return err
+	}
+	admin, err := cmd.Flags().GetString("admin")
+	if err != nil {
+		return err
+	}
+	keep, err := cmd.Flags().GetInt("keep")
+	if err != nil {
+		return err
+	}
+	if keep < 0 {
+		return errors.New("--keep must not be negative")
+	}
+	cfg, err := keyDBConfig()
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(cfg.DBPath), "backups")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// Snapshots are written to a temporary file first, so that a failed backup is never
+	// mistaken for a complete one
+	tmp, err := ioutil.TempFile(dir, ".keyserver-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	var n int64
+	if admin != "" {
+		n, err = fetchBackup(tmp, admin)
+	} else {
+		n, err = localBackup(tmp, cfg)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "backup failed")
+	}
+
+	path := filepath.Join(dir, keydb.BackupName(time.Now()))
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	log.Info().Str("path", path).Int64("bytes", n).Msg("Backup complete.")
+
+	if keep > 0 {
+		return pruneBackups(dir, keep)
+	}
+	return nil
+}
+
+// fetchBackup streams a snapshot from the admin server of a running keyserverd
+func fetchBackup(w io.Writer, admin string) (int64, error) {
+	resp, err := http.Get(strings.TrimSuffix(admin, "/") + "/backup")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("admin server returned %s", resp.Status)
+	}
+	return io.Copy(w, resp.Body)
+}
+
+// localBackup writes a snapshot of the database described by cfg
+func localBackup(w io.Writer, cfg *keydb.Config) (int64, error) {
+	db, err := openKeyDB(cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	return db.Backup(w)
+}
+
+// pruneBackups removes all but the newest keep snapshots in dir
+func pruneBackups(dir string, keep int) error {
+	// Snapshot names sort in the order they were taken
+	paths, err := filepath.Glob(filepath.Join(dir, "keyserver-*.db"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for len(paths) > keep {
+		if err := os.Remove(paths[0]); err != nil {
+			return err
+		}
+		log.Info().Str("path", paths[0]).Msg("Pruned backup.")
+		paths = paths[1:]
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/cashweb/keyserver/pkg/keydb"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func newCopyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "copy",
+		Short: "Copy an existing database into the configured storage backend",
+		Long: `
+Copies every record from an existing database into the database selected by
+--driver and --dbpath, e.g. to move a bolt database onto badger:
+
+    keyserverd copy --from-dbpath ~/.keyserver/database.db \
+        --driver badger --dbpath ~/.keyserver/badger
+
+The database is copied as it is, whatever its schema version.  The destination
+must be empty.  keyserverd must not be running against either database during
+the copy.`,
+		Args: cobra.NoArgs,
+		RunE: ExecCopy,
+	}
+	cmd.Flags().String("from-driver", keydb.DriverBolt, "Storage backend of the database to copy from.")
+	cmd.Flags().String("from-dbpath", "", "Location of the database to copy from.")
+	cmd.MarkFlagRequired("from-dbpath")
+	return cmd
+}
+
+// ExecCopy copies the database named by the --from flags into the configured database
+func ExecCopy(cmd *cobra.Command, args []string) error {
+	fromDriver, err := cmd.Flags().GetString("from-driver")
+	if err != nil {
+		return err
+	}
+	fromPath, err := cmd.Flags().GetString("from-dbpath")
+	if err != nil {
+		return err
+	}
+	cfg, err := keyDBConfig()
+	if err != nil {
+		return err
+	}
+	if filepath.Clean(fromPath) == filepath.Clean(cfg.DBPath) {
+		return errors.New("cannot copy a database onto itself")
+	}
+
+	src, err := keydb.OpenStore(&keydb.Config{Driver: fromDriver, DBPath: fromPath})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := keydb.OpenStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	log.Info().
+		Str("from", fromPath).
+		Str("to", cfg.DBPath).
+		Msg("Copying database.")
+	err = keydb.CopyStore(dst, src)
+	if err == keydb.ErrStoreNotEmpty {
+		return errors.Wrapf(err, "refusing to copy into %s", cfg.DBPath)
+	}
+	if err != nil {
+		return err
+	}
+	log.Info().Msg("Copy complete.")
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/cashweb/keyserver/pkg/keydb"
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/cashweb/keyserver/pkg/recordio"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func newExportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write every record in the database to a portable stream",
+		Long: `
+Writes the metadata of every address, and every revocation, to --out as a stream
+of records in --format.  The formats are described in docs/export.md.  Streams
+can be read by "keyserverd import" on any node, backend or version, e.g.
+
+    keyserverd export --out records.bin
+    keyserverd import --in records.bin --driver badger --dbpath ~/.keyserver/badger
+
+keyserverd must not be running against the database during the export.  To
+export from a running node, take a backup and export that instead.`,
+		Args: cobra.NoArgs,
+		RunE: ExecExport,
+	}
+	cmd.Flags().String("out", "-", "File to write records to, or - for stdout.")
+	cmd.Flags().String("format", recordio.FormatProto, "Format of the stream: proto or jsonl.")
+	return cmd
+}
+
+func newImportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Store the records from a stream written by export",
+		Long: `
+Reads records in --format from --in and stores them in the configured database.
+Every record is verified exactly as if it had been submitted to the server, so
+the stream needn't be trusted.  Records which fail verification are logged and
+skipped, as are those older than what is already stored.
+
+keyserverd must not be running against the database during the import.`,
+		Args: cobra.NoArgs,
+		RunE: ExecImport,
+	}
+	cmd.Flags().String("in", "-", "File to read records from, or - for stdin.")
+	cmd.Flags().String("format", recordio.FormatProto, "Format of the stream: proto or jsonl.")
+	cmd.Flags().String("source", "", "Where the stream came from, such as the URL of the keyserver which exported it, as recorded in each imported record's receipt.  Defaults to --in.")
+	return cmd
+}
+
+// ExecExport writes every record in the configured database to a stream
+func ExecExport(cmd *cobra.Command, args []string) error {
+	out, err := cmd.Flags().GetString("out")
+	if err != nil {
+		return err
+	}
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+	cfg, err := keyDBConfig()
+	if err != nil {
+		return err
+	}
+
+	// Open the database first, so that a bad path doesn't leave an empty export behind
+	db, err := openKeyDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var f io.Writer = os.Stdout
+	if out != "-" {
+		file, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		f = file
+	}
+	w, err := recordio.NewWriter(f, format)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	err = db.Export(func(record *recordio.Record) error {
+		count++
+		return w.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	log.Info().Int("records", count).Msg("Export complete.")
+	return nil
+}
+
+// ExecImport stores the records from a stream in the configured database
+func ExecImport(cmd *cobra.Command, args []string) error {
+	in, err := cmd.Flags().GetString("in")
+	if err != nil {
+		return err
+	}
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+	source, err := cmd.Flags().GetString("source")
+	if err != nil {
+		return err
+	}
+	if source == "" {
+		source = in
+	}
+	cfg, err := keyDBConfig()
+	if err != nil {
+		return err
+	}
+
+	var f io.Reader = os.Stdin
+	if in != "-" {
+		file, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		f = file
+	}
+	r, err := recordio.NewReader(f, format)
+	if err != nil {
+		return err
+	}
+
+	db, err := openKeyDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats, err := db.Import(r.Read, &models.Receipt{Peer: source}, func(record *recordio.Record, err error) {
+		log.Warn().
+			Str("address", record.Address).
+			Str("error", keydb.Kind(err).String()).
+			Msgf("Rejected record: %s", err)
+	})
+	log.Info().
+		Int("imported", stats.Imported).
+		Int("outdated", stats.Outdated).
+		Int("expired", stats.Expired).
+		Int("revoked", stats.Revoked).
+		Int("rejected", stats.Rejected).
+		Msg("Import finished.")
+	return err
+}
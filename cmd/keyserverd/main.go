@@ -9,8 +9,11 @@ import (
 
 	"github.com/cashweb/keyserver/pkg/keydb"
 	"github.com/cashweb/keyserver/pkg/keytp"
+	"github.com/cashweb/keyserver/pkg/netparams"
 	"github.com/cashweb/keyserver/pkg/payforput"
 
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -42,16 +45,55 @@ The source is available here: https://github.com/cashweb/keyserver`,
 		os.Exit(1)
 	}
 
-	rootCmd.Flags().StringP("config", "c", "", "Configuration file")
+	rootCmd.PersistentFlags().StringP("config", "c", "", "Configuration file")
+	rootCmd.PersistentFlags().String("network", chaincfg.MainNetParams.Name, "Network to accept addresses and payments on: mainnet, testnet3, testnet4 or regtest.")
+	rootCmd.PersistentFlags().String("driver", keydb.DriverBolt, "Storage backend to use: bolt, badger or memory.")
+	rootCmd.PersistentFlags().StringP("dbpath", "d", filepath.Join(usr.HomeDir, "/.keyserver/database.db"), "Location that boltdb files, or the badger directory, should be expected.")
+	rootCmd.PersistentFlags().Duration("bucketwidth", time.Hour, "Span of expiry times grouped together for garbage collection.")
+	rootCmd.PersistentFlags().Int("history", 10, "Number of accepted versions kept for each key.")
+	rootCmd.PersistentFlags().Duration("maxclockskew", 10*time.Minute, "How far ahead of the server's clock payloads may be timestamped.")
+	rootCmd.PersistentFlags().Int("maxentries", 32, "Most entries allowed in a payload.  Zero is unlimited.")
+	rootCmd.PersistentFlags().Int("maxheaders", 16, "Most headers allowed in each entry.  Zero is unlimited.")
+	rootCmd.PersistentFlags().Int("maxentrydata", 16*1024, "Most bytes of data allowed in each entry.  Zero is unlimited.")
+	rootCmd.PersistentFlags().Duration("minttl", 0, "Shortest TTL allowed for a payload.  Zero is unlimited.")
+	rootCmd.PersistentFlags().Duration("maxttl", 365*24*time.Hour, "Longest TTL allowed for a payload.  Zero is unlimited.")
+	rootCmd.PersistentFlags().Int("feedsize", 1000000, "Number of changes kept in the change feed.  Zero keeps every change.")
 	rootCmd.Flags().StringP("bind", "b", "0.0.0.0:8080", "Bind Address for keyserverd")
-	rootCmd.Flags().StringArrayP("peer", "p", []string{}, "URL to a keyserver peer")
+	rootCmd.Flags().StringSliceP("peer", "p", []string{}, "URL to a keyserver peer.  Uploads it relays are credited to it in their receipts.")
 	rootCmd.Flags().StringP("secret", "s", payforput.RandString(64), "Secret string for HMAC tokens")
-	rootCmd.Flags().StringP("dbpath", "d", filepath.Join(usr.HomeDir, "/.keyserver/database.db"), "Location that boltdb files should be expected.")
+	rootCmd.Flags().Duration("gcinterval", 10*time.Minute, "How often expired records are garbage collected.  Zero disables collection.")
+	rootCmd.Flags().Int64("maxbodybytes", 64*1024, "Largest request body accepted when setting a key or paying for one.")
+	rootCmd.Flags().String("adminbind", "", "Bind address for the admin server, which serves backups and stats.  Empty disables it.")
+	rootCmd.Flags().Int("cachesize", 10000, "Number of records kept in the read cache.  Zero disables it.")
+	rootCmd.Flags().Bool("enumeration", false, "Allow every record to be listed through GET /keys.  Off by default, which keeps the keyspace private.")
 
+	viper.BindPFlag("network", rootCmd.PersistentFlags().Lookup("network"))
+	viper.BindPFlag("driver", rootCmd.PersistentFlags().Lookup("driver"))
+	viper.BindPFlag("dbpath", rootCmd.PersistentFlags().Lookup("dbpath"))
+	viper.BindPFlag("bucketwidth", rootCmd.PersistentFlags().Lookup("bucketwidth"))
+	viper.BindPFlag("history", rootCmd.PersistentFlags().Lookup("history"))
+	viper.BindPFlag("maxclockskew", rootCmd.PersistentFlags().Lookup("maxclockskew"))
+	viper.BindPFlag("maxentries", rootCmd.PersistentFlags().Lookup("maxentries"))
+	viper.BindPFlag("maxheaders", rootCmd.PersistentFlags().Lookup("maxheaders"))
+	viper.BindPFlag("maxentrydata", rootCmd.PersistentFlags().Lookup("maxentrydata"))
+	viper.BindPFlag("minttl", rootCmd.PersistentFlags().Lookup("minttl"))
+	viper.BindPFlag("maxttl", rootCmd.PersistentFlags().Lookup("maxttl"))
+	viper.BindPFlag("feedsize", rootCmd.PersistentFlags().Lookup("feedsize"))
 	viper.BindPFlag("bind", rootCmd.Flags().Lookup("bind"))
 	viper.BindPFlag("peers", rootCmd.Flags().Lookup("peer"))
 	viper.BindPFlag("secret", rootCmd.Flags().Lookup("secret"))
-	viper.BindPFlag("dbpath", rootCmd.Flags().Lookup("dbpath"))
+	viper.BindPFlag("gcinterval", rootCmd.Flags().Lookup("gcinterval"))
+	viper.BindPFlag("maxbodybytes", rootCmd.Flags().Lookup("maxbodybytes"))
+	viper.BindPFlag("adminbind", rootCmd.Flags().Lookup("adminbind"))
+	viper.BindPFlag("cachesize", rootCmd.Flags().Lookup("cachesize"))
+	viper.BindPFlag("enumeration", rootCmd.Flags().Lookup("enumeration"))
+
+	rootCmd.AddCommand(newCopyCmd())
+	rootCmd.AddCommand(newRepairCmd())
+	rootCmd.AddCommand(newUpgradeCmd())
+	rootCmd.AddCommand(newBackupCmd())
+	rootCmd.AddCommand(newExportCmd())
+	rootCmd.AddCommand(newImportCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Error().Msg(err.Error())
@@ -86,15 +128,64 @@ func SetupConfiguration(ccmd *cobra.Command, args []string) error {
 // ExecServer runs the root functionality of the keyserver
 func ExecServer(cmd *cobra.Command, args []string) error {
 	log.Info().Msg("Starting keyserver daemon.")
-	dbpath := viper.GetString("dbpath")
-	err := os.MkdirAll(filepath.Dir(dbpath), 0700)
-	cfg := &keydb.Config{
-		DBPath: dbpath,
+	cfg, err := keyDBConfig()
+	if err != nil {
+		return err
 	}
+	cfg.GCInterval = viper.GetDuration("gcinterval")
+	cfg.CacheSize = viper.GetInt("cachesize")
 	db, err := keydb.New(cfg)
 	if err != nil {
 		return err
 	}
-	keyserver := keytp.New(db)
-	return keyserver.ListenAndServe()
+	keyserver := keytp.New(db, cfg.ChainParams)
+
+	errs := make(chan error, 2)
+	go func() { errs <- keyserver.ListenAndServe() }()
+	if adminBind := viper.GetString("adminbind"); adminBind != "" {
+		log.Info().Str("bind", adminBind).Msg("Starting admin server.")
+		admin := keytp.NewAdmin(db)
+		go func() { errs <- admin.ListenAndServe() }()
+	}
+	return <-errs
+}
+
+// keyDBConfig returns the configuration for the key database, and ensures the directory
+// it lives in exists.
+func keyDBConfig() (*keydb.Config, error) {
+	params, err := netparams.Lookup(viper.GetString("network"))
+	if err != nil {
+		return nil, err
+	}
+	dbpath := viper.GetString("dbpath")
+	err = os.MkdirAll(filepath.Dir(dbpath), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &keydb.Config{
+		ChainParams:  params,
+		Driver:       viper.GetString("driver"),
+		DBPath:       dbpath,
+		BucketWidth:  viper.GetDuration("bucketwidth"),
+		HistorySize:  viper.GetInt("history"),
+		MaxClockSkew: viper.GetDuration("maxclockskew"),
+		FeedSize:     viper.GetInt("feedsize"),
+		Limits: keydb.Limits{
+			MaxEntries:   viper.GetInt("maxentries"),
+			MaxHeaders:   viper.GetInt("maxheaders"),
+			MaxEntryData: viper.GetInt("maxentrydata"),
+			MinTTL:       viper.GetDuration("minttl"),
+			MaxTTL:       viper.GetDuration("maxttl"),
+		},
+	}, nil
+}
+
+// openKeyDB opens the database described by cfg for a command which mustn't change its
+// layout.  Databases with migrations pending are refused rather than upgraded.
+func openKeyDB(cfg *keydb.Config) (*keydb.KeyDB, error) {
+	db, err := keydb.Open(cfg)
+	if errors.Cause(err) == keydb.ErrSchemaOutdated {
+		return nil, errors.Wrap(err, `run "keyserverd upgrade" first`)
+	}
+	return db, err
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func newRepairCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "repair",
+		Short: "Flag records timestamped further in the future than the allowed clock skew",
+		Long: `
+Finds records whose payload timestamp is beyond --maxclockskew from now.  Such
+records were accepted before the skew was enforced, and would otherwise block
+every later update to their key until the clock caught up with them.
+
+Each one found is flagged: it is still served, but any update signed from now
+on replaces it.  Use --dry-run to list the records without flagging them.
+
+keyserverd must not be running against the database during the repair.`,
+		Args: cobra.NoArgs,
+		RunE: ExecRepair,
+	}
+	cmd.Flags().Bool("dry-run", false, "List far-future records without flagging them.")
+	return cmd
+}
+
+// ExecRepair flags the far-future records in the configured database
+func ExecRepair(cmd *cobra.Command, args []string) error {
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	cfg, err := keyDBConfig()
+	if err != nil {
+		return err
+	}
+	db, err := openKeyDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	found, err := db.Repair(time.Now(), dryRun)
+	if err != nil {
+		return err
+	}
+	for _, record := range found {
+		log.Info().
+			Str("key", record.Key).
+			Time("timestamp", time.Unix(record.Timestamp, 0)).
+			Bool("flagged", !dryRun).
+			Msg("Found far-future record.")
+	}
+	log.Info().Int("records", len(found)).Msg("Repair complete.")
+	return nil
+}
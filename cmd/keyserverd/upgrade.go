@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/cashweb/keyserver/pkg/keydb"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func newUpgradeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "upgrade",
+		Short: "Apply pending schema migrations to the database",
+		Long: `
+Upgrades the layout of the configured database to the schema version this
+keyserverd understands.  The server applies pending migrations itself when it
+starts, but backup, export, import and repair refuse to run against a database
+with migrations pending, so upgrade it first.  Use --dry-run to list the pending
+migrations, checking that they succeed, without changing the database.  A dry
+run makes every migration in one transaction, which a large badger database
+may not fit in even though the upgrade itself would succeed.
+
+keyserverd must not be running against the database during the upgrade.`,
+		Args: cobra.NoArgs,
+		RunE: ExecUpgrade,
+	}
+	cmd.Flags().Bool("dry-run", false, "List pending migrations without applying them.")
+	return cmd
+}
+
+// ExecUpgrade applies the pending migrations to the configured database
+func ExecUpgrade(cmd *cobra.Command, args []string) error {
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	cfg, err := keyDBConfig()
+	if err != nil {
+		return err
+	}
+
+	applied, err := keydb.Migrate(cfg, dryRun)
+	if err != nil {
+		return err
+	}
+	// Applied migrations are logged as they're made, so only a dry run lists them here
+	if dryRun {
+		for _, m := range applied {
+			log.Info().Int("version", m.Version).Msgf("Pending migration: %s", m.Name)
+		}
+		log.Info().Int("migrations", len(applied)).Msg("Dry run complete.")
+		return nil
+	}
+	log.Info().
+		Int("migrations", len(applied)).
+		Int("version", keydb.SchemaVersion()).
+		Msg("Upgrade complete.")
+	return nil
+}
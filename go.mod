@@ -8,8 +8,10 @@ require (
 	github.com/apex/log v1.1.1
 	github.com/boltdb/bolt v1.3.1
 	github.com/dchest/siphash v1.2.1 // indirect
+	github.com/dgraph-io/badger v1.6.2
 	github.com/etcd-io/bbolt v1.3.3
 	github.com/gcash/bchd v0.14.6
+	github.com/gcash/bchlog v0.0.0-20180913005452-b4f036f92fa6 // indirect
 	github.com/gcash/bchutil v0.0.0-20190625002603-800e62fe9aff
 	github.com/go-chi/chi v4.0.2+incompatible
 	github.com/golang/mock v1.3.1
@@ -20,7 +22,7 @@ require (
 	github.com/satori/go.uuid v1.2.0 // indirect
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/viper v1.4.0
-	github.com/stretchr/testify v1.3.0
+	github.com/stretchr/testify v1.4.0
 	go.etcd.io/bbolt v1.3.3
 	golang.org/x/tools v0.0.0-20190628222527-fb37f6ba8261 // indirect
 )
@@ -0,0 +1,73 @@
+package keydb
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+)
+
+// backupTimeFormat is the layout of the timestamp within backup file names
+const backupTimeFormat = "20060102T150405Z"
+
+// Snapshotter is implemented by stores which can write a consistent copy of themselves as
+// a bbolt database file without blocking writers.
+type Snapshotter interface {
+	// Snapshot writes the copy to w, returning the number of bytes written
+	Snapshot(w io.Writer) (int64, error)
+}
+
+// Snapshot writes the database file as of a single read transaction
+func (s *boltStore) Snapshot(w io.Writer) (n int64, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// Backup writes a consistent snapshot of the database to w while it continues to serve
+// reads and writes, returning the number of bytes written.  Backups are bbolt database
+// files whatever the driver, so they can be opened with the bolt driver, or copied onto
+// another backend.
+func (db *KeyDB) Backup(w io.Writer) (int64, error) {
+	if s, ok := db.db.(Snapshotter); ok {
+		return s.Snapshot(w)
+	}
+
+	// Other backends are copied into a temporary bolt file within a single read
+	// transaction, which is then streamed to w.
+	dir, err := ioutil.TempDir("", "keyserver-backup")
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to create backup directory")
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "backup.db")
+	dst, err := NewBoltStore(path)
+	if err != nil {
+		return 0, err
+	}
+	err = CopyStore(dst, db.db)
+	dst.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to open backup")
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// BackupName returns the file name of a backup taken at t.  Names sort in the order the
+// backups were taken.
+func BackupName(t time.Time) string {
+	return "keyserver-" + t.UTC().Format(backupTimeFormat) + ".db"
+}
@@ -0,0 +1,338 @@
+package keydb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Nested buckets are flattened onto badger's single keyspace.  Every name is escaped so
+// that it sorts the same way as the raw name, and is followed by a kind byte.  A value
+// named k inside a bucket with prefix P is stored at P+escape(k)+kindValue, and a nested
+// bucket named k is marked by P+escape(k)+kindBucket, which is also the prefix for
+// everything inside of it.
+const (
+	kindValue  = 0x01
+	kindBucket = 0x02
+	// kindEnd sorts after every key belonging to a name, whatever its kind
+	kindEnd = 0x03
+)
+
+// badgerRoot is the prefix of the top-level buckets
+var badgerRoot = []byte{kindBucket}
+
+// badgerGCInterval is how often badger's value log is compacted
+const badgerGCInterval = 10 * time.Minute
+
+// badgerMaxRetries is the number of times a conflicting transaction is retried before the
+// conflict is returned
+const badgerMaxRetries = 10
+
+// badgerStore is a Store backed by a badger LSM tree.  Unlike bbolt, badger allows
+// concurrent writers; conflicting transactions are retried a limited number of times.
+type badgerStore struct {
+	db *badger.DB
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewBadgerStore opens, or creates, the badger database in the directory at path
+func NewBadgerStore(path string) (Store, error) {
+	db, err := badger.Open(badger.DefaultOptions(path).WithLogger(nil))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open db")
+	}
+	s := &badgerStore{
+		db:   db,
+		quit: make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.valueLogGCLoop()
+	return s, nil
+}
+
+func (s *badgerStore) View(fn func(Tx) error) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		return fn(&badgerBucket{txn: txn, prefix: badgerRoot})
+	})
+}
+
+func (s *badgerStore) Update(fn func(Tx) error) error {
+	for retries := 0; ; retries++ {
+		err := s.db.Update(func(txn *badger.Txn) error {
+			return fn(&badgerBucket{txn: txn, prefix: badgerRoot, writable: true})
+		})
+		if err != badger.ErrConflict {
+			return err
+		}
+		if retries == badgerMaxRetries {
+			return errors.Wrapf(err, "gave up after %d retries", retries)
+		}
+	}
+}
+
+func (s *badgerStore) Close() error {
+	close(s.quit)
+	s.wg.Wait()
+	return s.db.Close()
+}
+
+// valueLogGCLoop reclaims space from badger's value log until the store is closed
+func (s *badgerStore) valueLogGCLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(badgerGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+			// Each successful run rewrites one file, so keep going until there's nothing left
+			var err error
+			for err == nil {
+				err = s.db.RunValueLogGC(0.5)
+			}
+			if err != badger.ErrNoRewrite {
+				log.Error().Msgf("badger value log gc failed: %s", err)
+			}
+		}
+	}
+}
+
+// badgerBucket is a bucket as seen from within a transaction.  The root bucket doubles as
+// the transaction itself.
+type badgerBucket struct {
+	txn      *badger.Txn
+	prefix   []byte
+	writable bool
+}
+
+func (b *badgerBucket) key(name []byte, kind byte) []byte {
+	key := escapeName(append([]byte{}, b.prefix...), name)
+	return append(key, kind)
+}
+
+func (b *badgerBucket) exists(key []byte) bool {
+	_, err := b.txn.Get(key)
+	return err == nil
+}
+
+func (b *badgerBucket) Get(key []byte) []byte {
+	item, err := b.txn.Get(b.key(key, kindValue))
+	if err != nil {
+		return nil
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+func (b *badgerBucket) Put(key, value []byte) error {
+	if !b.writable {
+		return ErrTxNotWritable
+	}
+	if b.exists(b.key(key, kindBucket)) {
+		return ErrIncompatibleValue
+	}
+	return b.txn.Set(b.key(key, kindValue), append([]byte{}, value...))
+}
+
+func (b *badgerBucket) Delete(key []byte) error {
+	if !b.writable {
+		return ErrTxNotWritable
+	}
+	if b.exists(b.key(key, kindBucket)) {
+		return ErrIncompatibleValue
+	}
+	return b.txn.Delete(b.key(key, kindValue))
+}
+
+func (b *badgerBucket) Bucket(name []byte) Bucket {
+	prefix := b.key(name, kindBucket)
+	if !b.exists(prefix) {
+		return nil
+	}
+	return &badgerBucket{txn: b.txn, prefix: prefix, writable: b.writable}
+}
+
+func (b *badgerBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if nested := b.Bucket(name); nested != nil {
+		return nested, nil
+	}
+	if !b.writable {
+		return nil, ErrTxNotWritable
+	}
+	if b.exists(b.key(name, kindValue)) {
+		return nil, ErrIncompatibleValue
+	}
+	prefix := b.key(name, kindBucket)
+	if err := b.txn.Set(prefix, []byte{}); err != nil {
+		return nil, err
+	}
+	return &badgerBucket{txn: b.txn, prefix: prefix, writable: true}, nil
+}
+
+func (b *badgerBucket) DeleteBucket(name []byte) error {
+	if !b.writable {
+		return ErrTxNotWritable
+	}
+	prefix := b.key(name, kindBucket)
+	if !b.exists(prefix) {
+		if b.exists(b.key(name, kindValue)) {
+			return ErrIncompatibleValue
+		}
+		return ErrBucketNotFound
+	}
+
+	// Read-write transactions only allow one iterator at a time, so gather the keys
+	// before deleting them.
+	var keys [][]byte
+	it := b.txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+
+	for _, key := range keys {
+		if err := b.txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *badgerBucket) Cursor() Cursor {
+	return &badgerCursor{b: b}
+}
+
+// badgerCursor remembers the name it is positioned at, and opens a short-lived iterator
+// for each move.  Read-write transactions only allow one open iterator, and a cursor is
+// never closed, so it can't hold on to one.
+type badgerCursor struct {
+	b    *badgerBucket
+	name []byte
+}
+
+func (c *badgerCursor) First() ([]byte, []byte) {
+	return c.forward(c.b.prefix)
+}
+
+func (c *badgerCursor) Last() ([]byte, []byte) {
+	// Bucket prefixes always end with kindBucket, so bumping the last byte gives a key
+	// after everything in the bucket.
+	end := append([]byte{}, c.b.prefix...)
+	end[len(end)-1] = kindEnd
+	return c.backward(end)
+}
+
+func (c *badgerCursor) Next() ([]byte, []byte) {
+	if c.name == nil {
+		return nil, nil
+	}
+	return c.forward(c.b.key(c.name, kindEnd))
+}
+
+func (c *badgerCursor) Prev() ([]byte, []byte) {
+	if c.name == nil {
+		return nil, nil
+	}
+	return c.backward(escapeName(append([]byte{}, c.b.prefix...), c.name))
+}
+
+func (c *badgerCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.forward(escapeName(append([]byte{}, c.b.prefix...), seek))
+}
+
+// forward moves to the first name in the bucket whose keys are at or after from
+func (c *badgerCursor) forward(from []byte) ([]byte, []byte) {
+	prefix := c.b.prefix
+	it := c.b.txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+	defer it.Close()
+	for it.Seek(from); it.ValidForPrefix(prefix); {
+		// The bucket's own marker isn't part of its contents
+		if len(it.Item().Key()) == len(prefix) {
+			it.Next()
+			continue
+		}
+		name, kind, rest := unescapeName(it.Item().Key()[len(prefix):])
+		// Skip over the contents of nested buckets, which sort after their marker
+		if kind == kindBucket && len(rest) > 0 {
+			it.Seek(c.b.key(name, kindEnd))
+			continue
+		}
+		return c.at(name, kind, it.Item())
+	}
+	c.name = nil
+	return nil, nil
+}
+
+// backward moves to the last name in the bucket whose keys are before to
+func (c *badgerCursor) backward(to []byte) ([]byte, []byte) {
+	prefix := c.b.prefix
+	it := c.b.txn.NewIterator(badger.IteratorOptions{Prefix: prefix, Reverse: true})
+	defer it.Close()
+	it.Seek(to)
+	if !it.ValidForPrefix(prefix) || len(it.Item().Key()) == len(prefix) {
+		c.name = nil
+		return nil, nil
+	}
+	// Iterating backwards may land inside a nested bucket, in which case the bucket itself
+	// is the entry we want.
+	name, kind, _ := unescapeName(it.Item().Key()[len(prefix):])
+	return c.at(name, kind, it.Item())
+}
+
+func (c *badgerCursor) at(name []byte, kind byte, item *badger.Item) ([]byte, []byte) {
+	c.name = name
+	if kind == kindBucket {
+		return name, nil
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		c.name = nil
+		return nil, nil
+	}
+	return name, value
+}
+
+// escapeName appends name to dst in an order preserving encoding.  Zero bytes are
+// escaped as 0x00 0xFF, and the name is terminated with 0x00 0x01.
+func escapeName(dst, name []byte) []byte {
+	for _, c := range name {
+		if c == 0x00 {
+			dst = append(dst, 0x00, 0xFF)
+			continue
+		}
+		dst = append(dst, c)
+	}
+	return append(dst, 0x00, 0x01)
+}
+
+// unescapeName decodes the name at the start of key, and returns it along with the kind
+// byte following it and anything after that.
+func unescapeName(key []byte) ([]byte, byte, []byte) {
+	name := []byte{}
+	for i := 0; i < len(key); i++ {
+		if key[i] != 0x00 {
+			name = append(name, key[i])
+			continue
+		}
+		i++
+		if i < len(key) && key[i] == 0xFF {
+			name = append(name, 0x00)
+			continue
+		}
+		// Reached the terminator
+		if i+1 < len(key) {
+			return name, key[i+1], key[i+2:]
+		}
+		break
+	}
+	return name, 0, nil
+}
@@ -0,0 +1,114 @@
+package keydb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscapeName(t *testing.T) {
+	assert := assert.New(t)
+
+	names := [][]byte{
+		{},
+		{0x00},
+		{0x00, 0x00},
+		{0x00, 0x01},
+		{0x00, 0xFF},
+		{0x01},
+		[]byte("a"),
+		[]byte("a\x00b"),
+		[]byte("ab"),
+		{0xFF, 0x00},
+	}
+	var escaped [][]byte
+	for _, name := range names {
+		key := append(escapeName(nil, name), kindValue)
+		decoded, kind, rest := unescapeName(key)
+		assert.Equal(name, decoded)
+		assert.Equal(byte(kindValue), kind)
+		assert.Empty(rest)
+		escaped = append(escaped, key)
+	}
+
+	// Escaped names sort in the same order as the names themselves
+	assert.True(sort.SliceIsSorted(names, func(i, j int) bool { return bytes.Compare(names[i], names[j]) < 0 }))
+	assert.True(sort.SliceIsSorted(escaped, func(i, j int) bool { return bytes.Compare(escaped[i], escaped[j]) < 0 }))
+}
+
+func TestBadgerConflicts(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "example")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	store, err := NewBadgerStore(dir)
+	assert.Nil(err)
+	defer store.Close()
+	assert.Nil(store.Update(func(tx Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("bucket"))
+		return err
+	}))
+
+	// A transaction which always conflicts is retried, but not forever
+	attempts := 0
+	err = store.Update(func(tx Tx) error {
+		attempts++
+		b := tx.Bucket([]byte("bucket"))
+		b.Get([]byte("key"))
+		err := store.Update(func(tx Tx) error {
+			return tx.Bucket([]byte("bucket")).Put([]byte("key"), []byte("theirs"))
+		})
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("key"), []byte("ours"))
+	})
+	assert.Equal(badger.ErrConflict, errors.Cause(err))
+	assert.Equal(badgerMaxRetries+1, attempts)
+}
+
+func TestBadgerMigrateLegacy(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "example")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// A legacy database spanning many batches, copied into badger and then opened
+	boltPath := filepath.Join(dir, "legacy.db")
+	src, err := NewBoltStore(boltPath)
+	assert.Nil(err)
+	addresses := putLegacyRecords(assert, src, 5000)
+	badgerPath := filepath.Join(dir, "badger")
+	dst, err := NewBadgerStore(badgerPath)
+	assert.Nil(err)
+	assert.Nil(CopyStore(dst, src))
+	assert.Nil(src.Close())
+	assert.Nil(dst.Close())
+
+	badgerDb, err := New(&Config{Driver: DriverBadger, DBPath: badgerPath})
+	assert.Nil(err)
+	defer badgerDb.Close()
+	for _, address := range addresses {
+		_, err := badgerDb.GetRaw(address)
+		assert.Nil(err)
+	}
+
+	// It ends up the same as the original migrated in place
+	boltDb, err := New(&Config{DBPath: boltPath})
+	assert.Nil(err)
+	defer boltDb.Close()
+	boltRoot, err := boltDb.MerkleRoot()
+	assert.Nil(err)
+	badgerRoot, err := badgerDb.MerkleRoot()
+	assert.Nil(err)
+	assert.Equal(boltRoot, badgerRoot)
+}
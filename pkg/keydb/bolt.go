@@ -0,0 +1,119 @@
+package keydb
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+)
+
+// boltStore is a Store backed by a bbolt database file
+type boltStore struct {
+	db *bbolt.DB
+}
+
+// NewBoltStore opens, or creates, the bbolt database at path
+func NewBoltStore(path string) (Store, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open db")
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) View(fn func(Tx) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		return fn(boltTx{tx: tx})
+	})
+}
+
+func (s *boltStore) Update(fn func(Tx) error) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return fn(boltTx{tx: tx})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+type boltTx struct {
+	tx *bbolt.Tx
+}
+
+func (t boltTx) Bucket(name []byte) Bucket {
+	b := t.tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b: b}
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, boltError(err)
+	}
+	return boltBucket{b: b}, nil
+}
+
+func (t boltTx) DeleteBucket(name []byte) error {
+	return boltError(t.tx.DeleteBucket(name))
+}
+
+func (t boltTx) Cursor() Cursor {
+	return t.tx.Cursor()
+}
+
+type boltBucket struct {
+	b *bbolt.Bucket
+}
+
+func (b boltBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b boltBucket) Put(key, value []byte) error {
+	return boltError(b.b.Put(key, value))
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	return boltError(b.b.Delete(key))
+}
+
+func (b boltBucket) Bucket(name []byte) Bucket {
+	nested := b.b.Bucket(name)
+	if nested == nil {
+		return nil
+	}
+	return boltBucket{b: nested}
+}
+
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	nested, err := b.b.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, boltError(err)
+	}
+	return boltBucket{b: nested}, nil
+}
+
+func (b boltBucket) DeleteBucket(name []byte) error {
+	return boltError(b.b.DeleteBucket(name))
+}
+
+func (b boltBucket) Cursor() Cursor {
+	return b.b.Cursor()
+}
+
+// boltError translates bbolt errors into their Store equivalents
+func boltError(err error) error {
+	switch err {
+	case bbolt.ErrBucketNotFound:
+		return ErrBucketNotFound
+	case bbolt.ErrIncompatibleValue:
+		return ErrIncompatibleValue
+	case bbolt.ErrTxNotWritable:
+		return ErrTxNotWritable
+	}
+	return err
+}
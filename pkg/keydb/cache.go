@@ -0,0 +1,122 @@
+package keydb
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/cashweb/keyserver/pkg/keyid"
+)
+
+// CacheStats reports how effective the read cache is, so that it can be sized
+type CacheStats struct {
+	// Hits is the number of reads served from the cache
+	Hits uint64 `json:"hits"`
+	// Misses is the number of reads which had to go to the store
+	Misses uint64 `json:"misses"`
+	// Entries is the number of records currently cached
+	Entries int `json:"entries"`
+	// Capacity is the most records the cache holds
+	Capacity int `json:"capacity"`
+}
+
+// recordCache is a size-bounded LRU cache of the current record of each key.  Cached
+// records must be treated as immutable.
+type recordCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[keyid.Key]*list.Element
+	// generation is bumped whenever an entry is invalidated, so that a read which raced
+	// with a write doesn't cache the value the write replaced
+	generation uint64
+	hits       uint64
+	misses     uint64
+}
+
+type cacheEntry struct {
+	key    keyid.Key
+	record *RawRecord
+}
+
+// newRecordCache returns a cache of capacity records, or nil if capacity isn't positive.
+// A nil cache is valid, and caches nothing.
+func newRecordCache(capacity int) *recordCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &recordCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  map[keyid.Key]*list.Element{},
+	}
+}
+
+// get returns the cached record for key, along with the generation to pass to add if it
+// wasn't cached
+func (c *recordCache) get(key keyid.Key) (*RawRecord, uint64) {
+	if c == nil {
+		return nil, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.hits++
+		c.order.MoveToFront(elem)
+		return elem.Value.(*cacheEntry).record, c.generation
+	}
+	c.misses++
+	return nil, c.generation
+}
+
+// add caches record for key, unless an entry has been invalidated since generation was
+// returned by get
+func (c *recordCache) add(key keyid.Key, record *RawRecord, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).record = record
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, record: record})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// invalidate drops any cached record for key
+func (c *recordCache) invalidate(key keyid.Key) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// stats returns the cache's counters
+func (c *recordCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:     c.hits,
+		Misses:   c.misses,
+		Entries:  c.order.Len(),
+		Capacity: c.capacity,
+	}
+}
@@ -0,0 +1,124 @@
+package keydb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/keyid"
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/gcash/bchd/bchec"
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordCache(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := newRecordCache(2)
+	keys := []keyid.Key{{0, 1}, {0, 2}, {0, 3}}
+	record := &RawRecord{Metadata: []byte("metadata")}
+
+	// The least recently used record is evicted
+	for _, key := range keys[:2] {
+		_, generation := cache.get(key)
+		cache.add(key, record, generation)
+	}
+	cached, _ := cache.get(keys[0])
+	assert.Equal(record, cached)
+	_, generation := cache.get(keys[2])
+	cache.add(keys[2], record, generation)
+	cached, _ = cache.get(keys[1])
+	assert.Nil(cached)
+	cached, _ = cache.get(keys[0])
+	assert.NotNil(cached)
+	assert.Equal(CacheStats{Hits: 2, Misses: 4, Entries: 2, Capacity: 2}, cache.stats())
+
+	// A read which raced with a write doesn't cache what it read
+	_, generation = cache.get(keys[1])
+	cache.invalidate(keys[1])
+	cache.add(keys[1], record, generation)
+	cached, _ = cache.get(keys[1])
+	assert.Nil(cached)
+
+	// A nil cache caches nothing
+	var disabled *recordCache
+	disabled.add(keys[0], record, 0)
+	cached, _ = disabled.get(keys[0])
+	assert.Nil(cached)
+	assert.Equal(CacheStats{}, disabled.stats())
+}
+
+func TestGetCached(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory, CacheSize: 10})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now().Unix()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	addr, first := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: now},
+	})
+	address := addr.EncodeAddress()
+	assert.Nil(keyDb.Set(address, first))
+
+	for i := 0; i < 3; i++ {
+		fetched, err := keyDb.Get(address)
+		assert.Nil(err)
+		assert.True(proto.Equal(first, fetched), "Fetch value did not match expected value")
+		// Modifying what was returned doesn't modify the cache
+		fetched.Payload.Timestamp = 0
+	}
+	assert.Equal(CacheStats{Hits: 2, Misses: 1, Entries: 1, Capacity: 10}, keyDb.CacheStats())
+
+	// Writes are seen by the next read
+	_, second := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: now + 1},
+	})
+	assert.Nil(keyDb.Set(address, second))
+	fetched, err := keyDb.Get(address)
+	assert.Nil(err)
+	assert.True(proto.Equal(second, fetched), "Fetch value did not match expected value")
+
+	assert.Nil(keyDb.Delete(address, SignDeletion(assert, privKey, addr, now+2)))
+	_, err = keyDb.Get(address)
+	assert.Equal(ErrNotFound, errors.Cause(err))
+
+	// Cached records still expire
+	key, err := keyid.Parse(address, &chaincfg.MainNetParams)
+	assert.Nil(err)
+	_, generation := keyDb.cache.get(key)
+	keyDb.cache.add(key, &RawRecord{Timestamp: now - 120, Expiry: now - 60}, generation)
+	_, err = keyDb.Get(address)
+	assert.Equal(ErrExpiredTTL, err)
+}
+
+func TestCollectCached(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory, CacheSize: 10, BucketWidth: time.Minute})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now().Unix()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	addr, metadata := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: now, Ttl: 1},
+	})
+	address := addr.EncodeAddress()
+	assert.Nil(keyDb.Set(address, metadata))
+	_, err = keyDb.Get(address)
+	assert.Nil(err)
+
+	// A collected record isn't served from the cache
+	stats, err := keyDb.Collect(time.Unix(now+3600, 0))
+	assert.Nil(err)
+	assert.Equal(1, stats.Records)
+	_, err = keyDb.Get(address)
+	assert.Equal(ErrNotFound, errors.Cause(err))
+}
@@ -0,0 +1,49 @@
+package keydb
+
+import (
+	"github.com/cashweb/keyserver/pkg/models"
+
+	"github.com/pkg/errors"
+)
+
+// ErrPreconditionFailed indicates the version stored for a key didn't satisfy the
+// Condition given to SetIf
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Condition restricts SetIf to the versions stored for a key.  The version of a record is
+// its payload timestamp.  Expired records count as not being stored at all.
+type Condition struct {
+	// Match, when not nil, requires the stored version to be one of those listed.  An
+	// empty, non-nil list matches nothing.
+	Match []int64
+	// MatchAny requires that a record is stored
+	MatchAny bool
+	// NoneMatch forbids the stored version from being any of those listed
+	NoneMatch []int64
+	// NoneMatchAny requires that no record is stored
+	NoneMatchAny bool
+}
+
+// check reports whether current, which is nil if nothing is stored, satisfies the condition
+func (c Condition) check(current *models.AddressMetadata) bool {
+	if current == nil {
+		return c.Match == nil && !c.MatchAny
+	}
+	if c.NoneMatchAny {
+		return false
+	}
+	version := current.GetPayload().GetTimestamp()
+	if c.Match != nil && !containsVersion(c.Match, version) {
+		return false
+	}
+	return !containsVersion(c.NoneMatch, version)
+}
+
+func containsVersion(versions []int64, version int64) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
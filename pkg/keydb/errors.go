@@ -0,0 +1,100 @@
+package keydb
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrorKind classifies the errors returned by KeyDB, so that callers can tell why a key
+// was rejected without matching on every error.
+type ErrorKind int
+
+const (
+	// KindInternal is any error which isn't the caller's fault
+	KindInternal ErrorKind = iota
+	// KindBadAddress means the key isn't an address KeyDB can store metadata for
+	KindBadAddress
+	// KindPubkeyMismatch means the pubkey or redeem script doesn't belong to the address
+	KindPubkeyMismatch
+	// KindBadSignature means the payload isn't properly signed
+	KindBadSignature
+	// KindOutdated means a newer value has already been accepted for the key
+	KindOutdated
+	// KindExpired means the value's TTL has passed
+	KindExpired
+	// KindUnknownScheme means the signature scheme isn't supported
+	KindUnknownScheme
+	// KindNotFound means there is nothing stored for the key
+	KindNotFound
+	// KindFutureTimestamp means the payload is timestamped too far in the future
+	KindFutureTimestamp
+	// KindLimitExceeded means the metadata is larger than the limits allow
+	KindLimitExceeded
+	// KindPreconditionFailed means the stored version didn't satisfy a conditional write
+	KindPreconditionFailed
+	// KindRevoked means the address's key has been revoked
+	KindRevoked
+	// KindMalformedMetadata means serialized metadata couldn't be decoded
+	KindMalformedMetadata
+)
+
+// kinds maps each of KeyDB's errors onto its kind
+var kinds = map[error]ErrorKind{
+	ErrInvalidAddress:     KindBadAddress,
+	ErrWrongNetwork:       KindBadAddress,
+	ErrPubkeyDoesNotMatch: KindPubkeyMismatch,
+	ErrMalformedPubKey:    KindPubkeyMismatch,
+	ErrScriptDoesNotMatch: KindPubkeyMismatch,
+	ErrUnsupportedScript:  KindPubkeyMismatch,
+	ErrSignatureMismatch:  KindBadSignature,
+	ErrMalformedSignature: KindBadSignature,
+	ErrTooManySignatures:  KindBadSignature,
+	ErrOutdatedValue:      KindOutdated,
+	ErrReplayedValue:      KindOutdated,
+	ErrExpiredTTL:         KindExpired,
+	ErrUnknownScheme:      KindUnknownScheme,
+	ErrNotFound:           KindNotFound,
+	ErrFutureTimestamp:    KindFutureTimestamp,
+	ErrLimitExceeded:      KindLimitExceeded,
+	ErrPreconditionFailed: KindPreconditionFailed,
+	ErrRevoked:            KindRevoked,
+	ErrMalformedMetadata:  KindMalformedMetadata,
+}
+
+// Kind returns the kind of an error returned by KeyDB
+func Kind(err error) ErrorKind {
+	if kind, ok := kinds[errors.Cause(err)]; ok {
+		return kind
+	}
+	return KindInternal
+}
+
+// String returns a stable, machine-readable name for the kind
+func (k ErrorKind) String() string {
+	switch k {
+	case KindBadAddress:
+		return "bad_address"
+	case KindPubkeyMismatch:
+		return "pubkey_mismatch"
+	case KindBadSignature:
+		return "bad_signature"
+	case KindOutdated:
+		return "outdated"
+	case KindExpired:
+		return "expired"
+	case KindUnknownScheme:
+		return "unknown_scheme"
+	case KindNotFound:
+		return "not_found"
+	case KindFutureTimestamp:
+		return "future_timestamp"
+	case KindLimitExceeded:
+		return "limit_exceeded"
+	case KindPreconditionFailed:
+		return "precondition_failed"
+	case KindRevoked:
+		return "revoked"
+	case KindMalformedMetadata:
+		return "malformed_metadata"
+	}
+	return "internal"
+}
@@ -0,0 +1,199 @@
+package keydb
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/keyid"
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/cashweb/keyserver/pkg/recordio"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ImportStats reports the outcome of an Import
+type ImportStats struct {
+	// Imported is the number of records stored
+	Imported int
+	// Outdated is the number of records older than, or the same as, what was stored
+	Outdated int
+	// Expired is the number of records whose TTL had passed
+	Expired int
+	// Revoked is the number of metadata records for keys which have been revoked
+	Revoked int
+	// Rejected is the number of records which failed verification
+	Rejected int
+}
+
+// Export calls fn with a record for every unexpired address's metadata, followed by one
+// for every revoked key.  Metadata is passed on exactly as it's stored, and so as it was
+// signed.  Records are read within a single transaction, so they are consistent with each
+// other.
+func (db *KeyDB) Export(fn func(*recordio.Record) error) error {
+	now := time.Now()
+	return db.db.View(func(tx Tx) error {
+		err := forEach(tx.Bucket(expiryIndexBucket), func(k, _ []byte) error {
+			address, ok := db.address(k)
+			if !ok {
+				return nil
+			}
+			record, err := db.getRaw(tx, k)
+			if errors.Cause(err) == ErrNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if record.expired(now) {
+				return nil
+			}
+			return fn(&recordio.Record{
+				Address:  address,
+				Metadata: record.Metadata,
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		return forEach(tx.Bucket(revocationsBucket), func(k, v []byte) error {
+			address, ok := db.address(k)
+			if !ok {
+				return nil
+			}
+			revocation := &models.Revocation{}
+			if err := proto.Unmarshal(v, revocation); err != nil {
+				return err
+			}
+			return fn(&recordio.Record{
+				Address:    address,
+				Revocation: revocation,
+			})
+		})
+	})
+}
+
+// List returns up to limit records in key order, as Export writes them, with metadata as
+// it's stored.  If after is set, listing starts after that address, so that passing the
+// address of the last record of one page returns the next.
+func (db *KeyDB) List(after string, limit int) ([]*recordio.Record, error) {
+	if limit <= 0 {
+		return nil, errors.New("limit must be positive")
+	}
+	var start []byte
+	if after != "" {
+		key, err := db.parseKey(after)
+		if err != nil {
+			return nil, err
+		}
+		start = key.Bytes()
+	}
+
+	now := time.Now()
+	var records []*recordio.Record
+	err := db.db.View(func(tx Tx) error {
+		// Revoked keys have no metadata, so the two buckets are merged without duplicates
+		live := tx.Bucket(expiryIndexBucket).Cursor()
+		revoked := tx.Bucket(revocationsBucket).Cursor()
+		lk, _ := seekAfter(live, start)
+		rk, rv := seekAfter(revoked, start)
+		for len(records) < limit && (lk != nil || rk != nil) {
+			if rk == nil || (lk != nil && bytes.Compare(lk, rk) < 0) {
+				record, err := db.getRaw(tx, lk)
+				if err != nil && errors.Cause(err) != ErrNotFound {
+					return err
+				}
+				if address, ok := db.address(lk); ok && err == nil && !record.expired(now) {
+					records = append(records, &recordio.Record{Address: address, Metadata: record.Metadata})
+				}
+				lk, _ = live.Next()
+				continue
+			}
+			revocation := &models.Revocation{}
+			if err := proto.Unmarshal(rv, revocation); err != nil {
+				return err
+			}
+			if address, ok := db.address(rk); ok {
+				records = append(records, &recordio.Record{Address: address, Revocation: revocation})
+			}
+			rk, rv = revoked.Next()
+		}
+		return nil
+	})
+	return records, err
+}
+
+// seekAfter moves c to the first key after start, or to the first key if start is nil
+func seekAfter(c Cursor, start []byte) ([]byte, []byte) {
+	if start == nil {
+		return c.First()
+	}
+	k, v := c.Seek(start)
+	if bytes.Equal(k, start) {
+		return c.Next()
+	}
+	return k, v
+}
+
+// Import stores every record returned by next until it returns io.EOF.  Metadata is
+// stored through SetRaw and revocations through Revoke, so each record is verified exactly
+// as if it had been submitted to the server, and the source needn't be trusted.  Records
+// which are rejected are counted, and passed to reject if it isn't nil, rather than
+// stopping the import.  Any other error stops it.  If receipt isn't nil, it's stored with
+// each record imported, as by SetRawIf.
+func (db *KeyDB) Import(next func() (*recordio.Record, error), receipt *models.Receipt, reject func(*recordio.Record, error)) (ImportStats, error) {
+	var stats ImportStats
+	for {
+		record, err := next()
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+
+		if record.Revocation != nil {
+			err = db.Revoke(record.Address, record.Revocation)
+		} else {
+			err = db.SetRawIf(record.Address, record.Metadata, Condition{}, receipt)
+		}
+
+		switch Kind(err) {
+		case KindInternal:
+			if err != nil {
+				return stats, err
+			}
+			stats.Imported++
+		case KindOutdated:
+			stats.Outdated++
+		case KindExpired:
+			stats.Expired++
+		case KindRevoked:
+			// A revocation which is already stored is simply outdated
+			if record.Revocation != nil {
+				stats.Outdated++
+			} else {
+				stats.Revoked++
+			}
+		default:
+			stats.Rejected++
+			if reject != nil {
+				reject(record, err)
+			}
+		}
+	}
+}
+
+// address returns the address of a stored key.  Keys which can't be decoded are skipped
+// with a warning.
+func (db *KeyDB) address(k []byte) (string, bool) {
+	key, ok := keyid.FromBytes(k)
+	if !ok {
+		log.Warn().Msgf("skipping undecodable key %x", k)
+		return "", false
+	}
+	return key.Encode(db.params), true
+}
@@ -0,0 +1,178 @@
+package keydb
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/cashweb/keyserver/pkg/recordio"
+	"github.com/gcash/bchd/bchec"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordStream returns a function which returns each of records in turn, then io.EOF
+func recordStream(records []*recordio.Record) func() (*recordio.Record, error) {
+	return func() (*recordio.Record, error) {
+		if len(records) == 0 {
+			return nil, io.EOF
+		}
+		record := records[0]
+		records = records[1:]
+		return record, nil
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	assert := assert.New(t)
+
+	src, err := New(&Config{Driver: DriverMemory, HistorySize: 10})
+	assert.Nil(err)
+	defer src.Close()
+
+	now := time.Now().Unix()
+	var revoked string
+	for i := 0; i < 3; i++ {
+		privKey, err := bchec.NewPrivateKey(bchec.S256())
+		assert.Nil(err)
+		addr, metadata := SignPayload(assert, privKey, &models.AddressMetadata{
+			Payload: &models.Payload{Timestamp: now},
+		})
+		rawMetadata, err := proto.Marshal(metadata)
+		assert.Nil(err)
+		// The scheme, encoded as a non-minimal zero, which re-encoding would drop
+		rawMetadata = append(rawMetadata, 0x18, 0x80, 0x00)
+		assert.Nil(src.SetRaw(addr.EncodeAddress(), rawMetadata))
+
+		// The last key is revoked
+		if i == 2 {
+			revoked = addr.EncodeAddress()
+			assert.Nil(src.Revoke(addr.EncodeAddress(), SignRevocation(assert, privKey, addr, now, "stolen")))
+		}
+	}
+
+	var records []*recordio.Record
+	assert.Nil(src.Export(func(record *recordio.Record) error {
+		records = append(records, record)
+		return nil
+	}))
+	assert.Equal(3, len(records))
+	assert.NotNil(records[2].Revocation)
+
+	// Metadata is exported exactly as it was stored
+	for _, record := range records[:2] {
+		stored, err := src.GetRaw(record.Address)
+		assert.Nil(err)
+		assert.Equal(stored.Metadata, record.Metadata)
+	}
+
+	dst, err := New(&Config{Driver: DriverMemory, HistorySize: 10})
+	assert.Nil(err)
+	defer dst.Close()
+
+	// Records are verified on import, so tampered ones are rejected
+	metadata, err := unmarshalMetadata(records[0].Metadata)
+	assert.Nil(err)
+	metadata.Payload.Ttl = 60
+	rawTampered, err := proto.Marshal(metadata)
+	assert.Nil(err)
+	tampered := &recordio.Record{Address: records[0].Address, Metadata: rawTampered}
+	var rejected []*recordio.Record
+	stats, err := dst.Import(recordStream([]*recordio.Record{tampered}), nil, func(record *recordio.Record, err error) {
+		assert.Equal(KindBadSignature, Kind(err))
+		rejected = append(rejected, record)
+	})
+	assert.Nil(err)
+	assert.Equal(ImportStats{Rejected: 1}, stats)
+	assert.Equal([]*recordio.Record{tampered}, rejected)
+
+	// And the rest are stored exactly as they were exported, with a receipt naming where
+	// they came from
+	receipt := &models.Receipt{Peer: "backup.pb"}
+	stats, err = dst.Import(recordStream(records), receipt, nil)
+	assert.Nil(err)
+	assert.Equal(ImportStats{Imported: 3}, stats)
+	for _, record := range records[:2] {
+		fetched, err := dst.GetRaw(record.Address)
+		assert.Nil(err)
+		assert.Equal(record.Metadata, fetched.Metadata, "Imported value did not match exported value")
+		stored, err := dst.GetReceipt(record.Address)
+		assert.Nil(err)
+		assert.Equal("backup.pb", stored.GetPeer())
+		assert.NotZero(stored.GetReceivedAt())
+	}
+	revocation, err := dst.GetRevocation(revoked)
+	assert.Nil(err)
+	assert.True(proto.Equal(records[2].Revocation, revocation), "Imported revocation did not match exported one")
+
+	// Importing the same records again changes nothing
+	stats, err = dst.Import(recordStream(records), nil, nil)
+	assert.Nil(err)
+	assert.Equal(ImportStats{Outdated: 3}, stats)
+}
+
+func TestList(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory, HistorySize: 10})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now().Unix()
+	for i := 0; i < 4; i++ {
+		privKey, err := bchec.NewPrivateKey(bchec.S256())
+		assert.Nil(err)
+		addr, metadata := SignPayload(assert, privKey, &models.AddressMetadata{
+			Payload: &models.Payload{Timestamp: now},
+		})
+		assert.Nil(keyDb.Set(addr.EncodeAddress(), metadata))
+		if i%2 == 0 {
+			assert.Nil(keyDb.Revoke(addr.EncodeAddress(), SignRevocation(assert, privKey, addr, now, "stolen")))
+		}
+	}
+
+	// Live and revoked records are listed together, in key order, with metadata as stored
+	all, err := keyDb.List("", 10)
+	assert.Nil(err)
+	assert.Equal(4, len(all))
+	var revocations int
+	for i, record := range all {
+		if record.Revocation != nil {
+			revocations++
+		} else {
+			stored, err := keyDb.GetRaw(record.Address)
+			assert.Nil(err)
+			assert.Equal(stored.Metadata, record.Metadata)
+		}
+		if i > 0 {
+			prev, err := keyDb.parseKey(all[i-1].Address)
+			assert.Nil(err)
+			key, err := keyDb.parseKey(record.Address)
+			assert.Nil(err)
+			assert.True(bytes.Compare(prev.Bytes(), key.Bytes()) < 0, "Records are not in key order")
+		}
+	}
+	assert.Equal(2, revocations)
+
+	// Paging through them one at a time returns the same records
+	var paged []*recordio.Record
+	after := ""
+	for {
+		page, err := keyDb.List(after, 1)
+		assert.Nil(err)
+		if len(page) == 0 {
+			break
+		}
+		paged = append(paged, page...)
+		after = page[0].Address
+	}
+	assert.Equal(all, paged)
+
+	_, err = keyDb.List("", 0)
+	assert.NotNil(err)
+	_, err = keyDb.List("notanaddress", 1)
+	assert.Equal(ErrInvalidAddress, errors.Cause(err))
+}
@@ -0,0 +1,190 @@
+package keydb
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+
+	"github.com/cashweb/keyserver/pkg/models"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+var (
+	// feedBucket maps the big-endian sequence number of each change to the marshalled
+	// Change
+	feedBucket = []byte("feed")
+	// feedSequenceKey maps to the big-endian sequence number of the latest change.  It's
+	// kept in the meta bucket, so that numbers aren't reused once the feed is trimmed.
+	feedSequenceKey = []byte("feedSequence")
+)
+
+// ErrFeedTruncated is returned when reading the change feed from a sequence number whose
+// successors have already been trimmed from it.  The reader has missed changes, and must
+// resynchronize, for example by listing every record, before following the feed again.
+var ErrFeedTruncated = errors.New("changes have been trimmed from the feed")
+
+// feedPageSize is the number of changes Follow reads at a time
+const feedPageSize = 100
+
+// feedNotifier wakes followers of the feed when changes are committed.  The zero value is
+// ready to use.
+type feedNotifier struct {
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+// wait returns a channel which is closed once notify is next called
+func (n *feedNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.changed == nil {
+		n.changed = make(chan struct{})
+	}
+	return n.changed
+}
+
+// notify wakes everything waiting on the feed
+func (n *feedNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.changed != nil {
+		close(n.changed)
+		n.changed = nil
+	}
+}
+
+// Sequence returns the sequence number of the latest change, or zero if there have been
+// none
+func (db *KeyDB) Sequence() (uint64, error) {
+	var sequence uint64
+	err := db.db.View(func(tx Tx) error {
+		sequence = feedSequence(tx)
+		return nil
+	})
+	return sequence, err
+}
+
+// Changes returns up to limit changes with sequence numbers after after, in order.  It
+// returns ErrFeedTruncated if any of them have been trimmed from the feed.
+func (db *KeyDB) Changes(after uint64, limit int) ([]*models.Change, error) {
+	if limit <= 0 {
+		return nil, errors.New("limit must be positive")
+	}
+	var changes []*models.Change
+	err := db.db.View(func(tx Tx) error {
+		changes = nil
+		c := tx.Bucket(feedBucket).Cursor()
+		if k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) > after+1 {
+			return errors.Wrapf(ErrFeedTruncated, "oldest change is %d", binary.BigEndian.Uint64(k))
+		}
+		start := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, after+1)
+		for k, v := c.Seek(start); k != nil && len(changes) < limit; k, v = c.Next() {
+			change := &models.Change{}
+			if err := proto.Unmarshal(v, change); err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// Follow calls fn with each change after the sequence number after, in order, waiting for
+// new changes as they're committed.  It returns once ctx is done, or fn or reading the
+// feed fails.  A follower which records the sequence number of each change it has handled
+// can resume from it after a restart without missing any.
+func (db *KeyDB) Follow(ctx context.Context, after uint64, fn func(*models.Change) error) error {
+	for {
+		// Wait on changes committed from here on, so that none are missed between
+		// reading the feed and waiting
+		changed := db.feed.wait()
+		changes, err := db.Changes(after, feedPageSize)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if err := fn(change); err != nil {
+				return err
+			}
+			after = change.GetSequence()
+		}
+		if len(changes) == feedPageSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// appendChange adds a change to key to the feed, numbering it after the latest change
+func (db *KeyDB) appendChange(tx Tx, key []byte, changeType models.Change_Type, timestamp int64) error {
+	address, ok := db.address(key)
+	if !ok {
+		return nil
+	}
+	sequence := feedSequence(tx) + 1
+	rawSequence := make([]byte, 8)
+	binary.BigEndian.PutUint64(rawSequence, sequence)
+
+	rawChange, err := proto.Marshal(&models.Change{
+		Sequence:  sequence,
+		Type:      changeType,
+		Address:   address,
+		Timestamp: timestamp,
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(feedBucket).Put(rawSequence, rawChange); err != nil {
+		return err
+	}
+	return tx.Bucket(metaBucket).Put(feedSequenceKey, rawSequence)
+}
+
+// trimFeed drops up to limit of the changes before the latest size, and reports whether
+// all of them have been dropped
+func trimFeed(tx Tx, size, limit int) (bool, error) {
+	latest := feedSequence(tx)
+	if size <= 0 || latest <= uint64(size) {
+		return true, nil
+	}
+	oldest := latest - uint64(size) + 1
+
+	var trimmed [][]byte
+	c := tx.Bucket(feedBucket).Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < oldest; k, _ = c.Next() {
+		if len(trimmed) == limit {
+			break
+		}
+		trimmed = append(trimmed, append([]byte{}, k...))
+	}
+	for _, k := range trimmed {
+		if err := tx.Bucket(feedBucket).Delete(k); err != nil {
+			return false, err
+		}
+	}
+	return len(trimmed) < limit, nil
+}
+
+// feedSequence returns the sequence number of the latest change
+func feedSequence(tx Tx) uint64 {
+	rawSequence := tx.Bucket(metaBucket).Get(feedSequenceKey)
+	if rawSequence == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(rawSequence)
+}
+
+// createFeed creates the change feed.  Changes made before it existed aren't published.
+func createFeed(db *KeyDB, tx Tx) error {
+	_, err := tx.CreateBucketIfNotExists(feedBucket)
+	return errors.Wrapf(err, "failed to create bucket")
+}
@@ -0,0 +1,181 @@
+package keydb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/keyid"
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/gcash/bchd/bchec"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChanges(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "example")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	config := &Config{DBPath: filepath.Join(dir, "feed.db"), HistorySize: 10}
+	keyDb, err := New(config)
+	assert.Nil(err)
+
+	now := time.Now().Unix()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	addr, first := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: now, Ttl: 60},
+	})
+	address := addr.EncodeAddress()
+	assert.Nil(keyDb.Set(address, first))
+	_, second := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: now + 1, Ttl: 60},
+	})
+	assert.Nil(keyDb.Set(address, second))
+	// Rejected updates aren't published
+	assert.Equal(ErrReplayedValue, errors.Cause(keyDb.Set(address, first)))
+	assert.Nil(keyDb.Delete(address, SignDeletion(assert, privKey, addr, now+2)))
+
+	revokedKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	revokedAddr, revokedMetadata := SignPayload(assert, revokedKey, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: now},
+	})
+	assert.Nil(keyDb.Set(revokedAddr.EncodeAddress(), revokedMetadata))
+	assert.Nil(keyDb.Revoke(revokedAddr.EncodeAddress(), SignRevocation(assert, revokedKey, revokedAddr, now, "stolen")))
+
+	expiringAddr, expiring := GeneratePayload(assert, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: now, Ttl: 60},
+	})
+	assert.Nil(keyDb.Set(expiringAddr.EncodeAddress(), expiring))
+	_, err = keyDb.Collect(time.Unix(now+7200, 0))
+	assert.Nil(err)
+
+	changes, err := keyDb.Changes(0, 100)
+	assert.Nil(err)
+	expected := []struct {
+		changeType models.Change_Type
+		timestamp  int64
+	}{
+		{models.Change_SET, now},
+		{models.Change_SET, now + 1},
+		{models.Change_DELETE, now + 2},
+		{models.Change_SET, now},
+		{models.Change_REVOKE, now},
+		{models.Change_SET, now},
+		{models.Change_EXPIRE, now},
+	}
+	assert.Equal(len(expected), len(changes))
+	for i, change := range changes {
+		assert.Equal(uint64(i+1), change.GetSequence())
+		assert.Equal(expected[i].changeType, change.GetType())
+		assert.Equal(expected[i].timestamp, change.GetTimestamp())
+	}
+	page, err := keyDb.Changes(5, 1)
+	assert.Nil(err)
+	assert.Equal(1, len(page))
+	assert.Equal(uint64(6), page[0].GetSequence())
+
+	// Sequence numbers carry on from where they left off once reopened, even after the
+	// feed has been trimmed
+	keyDb.Close()
+	config.FeedSize = 2
+	keyDb, err = New(config)
+	assert.Nil(err)
+	defer keyDb.Close()
+	sequence, err := keyDb.Sequence()
+	assert.Nil(err)
+	assert.Equal(uint64(7), sequence)
+	_, err = keyDb.Collect(time.Unix(now, 0))
+	assert.Nil(err)
+	_, err = keyDb.Changes(4, 100)
+	assert.Equal(ErrFeedTruncated, errors.Cause(err))
+	changes, err = keyDb.Changes(5, 100)
+	assert.Nil(err)
+	assert.Equal(2, len(changes))
+
+	_, third := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: now + 3},
+	})
+	assert.Nil(keyDb.Set(address, third))
+	sequence, err = keyDb.Sequence()
+	assert.Nil(err)
+	assert.Equal(uint64(8), sequence)
+}
+
+func TestTrimFeedBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory, FeedSize: 1})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	// More changes than are trimmed in one transaction
+	now := time.Now().Unix()
+	changes := keyDb.batchSize + 2
+	assert.Nil(keyDb.db.Update(func(tx Tx) error {
+		for i := 0; i < changes; i++ {
+			key := keyid.Key{0, byte(i >> 8), byte(i)}.Bytes()
+			if err := keyDb.appendChange(tx, key, models.Change_SET, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	_, err = keyDb.Collect(time.Unix(now, 0))
+	assert.Nil(err)
+	_, err = keyDb.Changes(uint64(changes-2), 100)
+	assert.Equal(ErrFeedTruncated, errors.Cause(err))
+	page, err := keyDb.Changes(uint64(changes-1), 100)
+	assert.Nil(err)
+	assert.Equal(1, len(page))
+}
+
+func TestFollow(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now().Unix()
+	addr, addrMetadata := GeneratePayload(assert, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: now},
+	})
+	assert.Nil(keyDb.Set(addr.EncodeAddress(), addrMetadata))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	followed := make(chan *models.Change)
+	done := make(chan error)
+	go func() {
+		done <- keyDb.Follow(ctx, 0, func(change *models.Change) error {
+			followed <- change
+			return nil
+		})
+	}()
+
+	// Changes committed before and after following started are both seen, in order
+	assert.Equal(uint64(1), (<-followed).GetSequence())
+	addr, addrMetadata = GeneratePayload(assert, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: now},
+	})
+	assert.Nil(keyDb.Set(addr.EncodeAddress(), addrMetadata))
+	change := <-followed
+	assert.Equal(uint64(2), change.GetSequence())
+	assert.Equal(models.Change_SET, change.GetType())
+
+	cancel()
+	assert.Equal(context.Canceled, <-done)
+
+	// Errors from the callback stop following
+	stop := errors.New("stop")
+	assert.Equal(stop, keyDb.Follow(context.Background(), 1, func(*models.Change) error {
+		return stop
+	}))
+}
@@ -3,178 +3,1164 @@ package keydb
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/cashweb/keyserver/pkg/keyid"
 	"github.com/cashweb/keyserver/pkg/models"
-	"go.etcd.io/bbolt"
+	"github.com/cashweb/keyserver/pkg/sigverify"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 
-	"github.com/gcash/bchd/bchec"
 	"github.com/gcash/bchd/chaincfg"
+	"github.com/gcash/bchd/txscript"
 	"github.com/gcash/bchutil"
 )
 
 // Bucket namespace.  This is UTF-8 for "addressMetadata"
+// NOTE: This is only used for upgrading databases created before records were bucketed by
+// expiry time.
 var addressMetadataBucket = []byte{0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61}
 
+var (
+	// Every bucket below is keyed by the canonical keyid.Key of an address, so that each
+	// encoding of an address finds the same record.
+
+	// recordsBucket holds one nested bucket per expiry window.  Nested buckets are named
+	// by the big-endian unix time at which every record inside them has expired.
+	recordsBucket = []byte("records")
+	// expiryIndexBucket maps an address to the name of the nested records bucket holding it.
+	expiryIndexBucket = []byte("expiryIndex")
+	// highWaterBucket maps an address to the newest payload timestamp ever accepted for it.
+	// These marks are never garbage collected, so they outlive the records themselves.
+	highWaterBucket = []byte("highWater")
+	// historyBucket holds one nested bucket per address, mapping the big-endian payload
+	// timestamp of each accepted version to its raw metadata.
+	historyBucket = []byte("history")
+	// flaggedBucket maps an address whose record was found to be timestamped in the future
+	// to that record's timestamp.  Flagged records don't block newer updates.
+	flaggedBucket = []byte("flagged")
+	// revocationsBucket maps an address whose key has been revoked to its raw revocation.
+	// Revocations are kept forever.
+	revocationsBucket = []byte("revocations")
+)
+
+const (
+	// defaultTTL is used when a payload doesn't specify a TTL.  One month.
+	defaultTTL = 2592000
+	// defaultBucketWidth is the default span of expiry times which share a bucket
+	defaultBucketWidth = 1 * time.Hour
+	// defaultMaxClockSkew is how far ahead of our clock payloads may be timestamped by default
+	defaultMaxClockSkew = 10 * time.Minute
+)
+
 var (
 	// ErrExpiredTTL indicates the key has expired
 	ErrExpiredTTL = errors.New("Key has expired")
 	// ErrOutdatedValue indicates the timestamp is less than the currently known timestamp
 	ErrOutdatedValue = errors.New("outdated value attempting to be used as an update")
+	// ErrReplayedValue indicates the timestamp is at or below the newest timestamp ever
+	// accepted for the address, even if that record has since been garbage collected
+	ErrReplayedValue = errors.New("timestamp is not newer than a previously accepted value")
 	// ErrPubkeyDoesNotMatch specified pubkey does not match provided addreess
 	ErrPubkeyDoesNotMatch = errors.New("pubKey does not match address")
 	// ErrSignatureMismatch indicates an invalid signature specified for the payload
 	ErrSignatureMismatch = errors.New("Signature does match")
+	// ErrScriptDoesNotMatch indicates the redeem script does not match the P2SH address
+	ErrScriptDoesNotMatch = errors.New("redeem script does not match address")
+	// ErrUnsupportedScript indicates the redeem script is not a standard multisig script
+	ErrUnsupportedScript = errors.New("redeem script is not a standard multisig script")
+	// ErrTooManySignatures indicates more signatures than the redeem script has pubkeys
+	ErrTooManySignatures = errors.New("more signatures than pubkeys in redeem script")
+	// ErrWrongNetwork indicates the address is for a different network than the KeyDB
+	ErrWrongNetwork = keyid.ErrWrongNetwork
+	// ErrInvalidAddress indicates the key isn't an address KeyDB can store metadata for
+	ErrInvalidAddress = errors.New("invalid address")
+	// ErrMalformedPubKey indicates the pubkey matches the address but can't be parsed
+	ErrMalformedPubKey = sigverify.ErrMalformedPubKey
+	// ErrMalformedSignature indicates a signature which can't be parsed under its scheme
+	ErrMalformedSignature = sigverify.ErrMalformedSignature
+	// ErrUnknownScheme indicates a signature scheme KeyDB doesn't support
+	ErrUnknownScheme = sigverify.ErrUnknownScheme
+	// ErrNotFound indicates there is no metadata stored for the key
+	ErrNotFound = errors.New("key not found")
+	// ErrFutureTimestamp indicates the payload is timestamped further in the future than
+	// the allowed clock skew
+	ErrFutureTimestamp = errors.New("timestamp is too far in the future")
 )
 
 // Config is the configuration for creating a new keyDb instance
 type Config struct {
+	// Driver selects the storage backend.  Defaults to DriverBolt.
+	Driver string
+	// DBPath is the location of the database file for file-backed drivers
 	DBPath string
+	// ChainParams is the network whose addresses are accepted as keys.  Defaults to
+	// mainnet.
+	ChainParams *chaincfg.Params
+	// GCInterval is how often expired buckets are dropped from the database.  A zero
+	// interval disables the background collector.
+	GCInterval time.Duration
+	// BucketWidth is the span of expiry times grouped into a single bucket.  Records are
+	// only reclaimed once their entire bucket has expired.  Defaults to one hour.
+	BucketWidth time.Duration
+	// HistorySize is the number of accepted versions kept per address, including the
+	// current one.  Zero disables history.
+	HistorySize int
+	// Schemes are the signature schemes accepted for metadata.  Defaults to
+	// sigverify.Default.
+	Schemes *sigverify.Registry
+	// MaxClockSkew is how far ahead of the server's clock a payload may be timestamped.
+	// Defaults to ten minutes.
+	MaxClockSkew time.Duration
+	// CacheSize is the number of records kept in the read cache in front of Get.  Zero
+	// disables the cache.
+	CacheSize int
+	// Limits bounds the metadata accepted by Set.  By default there are no limits.
+	Limits Limits
+	// FeedSize is the number of changes kept in the change feed.  Older changes are
+	// trimmed whenever garbage is collected.  Zero keeps every change.
+	FeedSize int
 }
 
-// KeyDB is an implementation of a kv store which is permissioned using pubkey based authentication
+// GCStats reports what a single garbage collection pass reclaimed
+type GCStats struct {
+	// Buckets is the number of expiry buckets dropped
+	Buckets int
+	// Records is the number of records dropped
+	Records int
+	// Bytes is the number of key and value bytes dropped
+	Bytes int
+}
+
+// FutureRecord describes a stored record timestamped beyond the allowed clock skew
+type FutureRecord struct {
+	// Key is the canonical address of the record
+	Key string
+	// Timestamp is the payload timestamp of the record
+	Timestamp int64
+}
+
+// KeyDB is an implementation of a kv store which is permissioned using pubkey based authentication.
+// Reads run concurrently, but writes are made one at a time: every accepted write appends
+// to the change feed and updates the Merkle root, so any two writes would conflict anyway.
 type KeyDB struct {
-	db *bbolt.DB
+	db           Store
+	writeMu      sync.Mutex
+	params       *chaincfg.Params
+	bucketWidth  int64
+	historySize  int
+	schemes      *sigverify.Registry
+	maxClockSkew int64
+	limits       Limits
+	cache        *recordCache
+	feedSize     int
+	feed         feedNotifier
+	// batchSize is the number of records handled in each transaction by work which
+	// touches every record
+	batchSize int
+
+	quit chan struct{}
+	wg   sync.WaitGroup
 }
 
-// New returns a new KeyDB that can be used by the keytp server.
+// New returns a new KeyDB that can be used by the keytp server.  Any pending migrations
+// are applied to the database first.
 func New(config *Config) (*KeyDB, error) {
-	if config.DBPath == "" {
-		return nil, errors.New("no DBPath provided in config")
+	keyDB, err := open(config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := keyDB.migrate(false); err != nil {
+		keyDB.db.Close()
+		return nil, err
 	}
 
-	db, err := bbolt.Open(config.DBPath, 0600, &bbolt.Options{Timeout: 1 * time.Second})
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to open db")
+	if config.GCInterval > 0 {
+		keyDB.wg.Add(1)
+		go keyDB.collectLoop(config.GCInterval)
 	}
+	return keyDB, nil
+}
 
-	// Ensure our bucket exists
-	// TODO: We should probably use cascading buckets that can be deleted
-	// routinely for garbage collection.  Wallets can readvertise occasionally
-	// if they want to keep their metadata up to date and online.
-	err = db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(addressMetadataBucket)
-		if err != nil {
-			return errors.Wrapf(err, "failed to create bucket")
-		}
-		return nil
-	})
+// open opens the store described by config, without migrating it
+func open(config *Config) (*KeyDB, error) {
+	bucketWidth := config.BucketWidth
+	if bucketWidth == 0 {
+		bucketWidth = defaultBucketWidth
+	}
+	if bucketWidth < time.Second {
+		return nil, errors.New("BucketWidth must be at least one second")
+	}
+	if config.HistorySize < 0 {
+		return nil, errors.New("HistorySize must not be negative")
+	}
+	if config.FeedSize < 0 {
+		return nil, errors.New("FeedSize must not be negative")
+	}
+	maxClockSkew := config.MaxClockSkew
+	if maxClockSkew == 0 {
+		maxClockSkew = defaultMaxClockSkew
+	}
+	if maxClockSkew < 0 {
+		return nil, errors.New("MaxClockSkew must not be negative")
+	}
 
+	params := config.ChainParams
+	if params == nil {
+		params = &chaincfg.MainNetParams
+	}
+	schemes := config.Schemes
+	if schemes == nil {
+		schemes = sigverify.Default
+	}
+
+	db, err := OpenStore(config)
 	if err != nil {
 		return nil, err
 	}
-	return &KeyDB{db: db}, nil
+
+	keyDB := &KeyDB{
+		db:           db,
+		params:       params,
+		bucketWidth:  int64(bucketWidth / time.Second),
+		historySize:  config.HistorySize,
+		schemes:      schemes,
+		maxClockSkew: int64(maxClockSkew / time.Second),
+		limits:       config.Limits,
+		cache:        newRecordCache(config.CacheSize),
+		feedSize:     config.FeedSize,
+		batchSize:    defaultBatchSize,
+		quit:         make(chan struct{}),
+	}
+	if config.Driver == DriverBadger {
+		keyDB.batchSize = badgerBatchSize
+	}
+	return keyDB, nil
 }
 
 // Set expects to take a cryptocurrency address and update a key in the DB backend if the
 // payload is valid under the key provided.
 func (db *KeyDB) Set(keyAddress string, metadata *models.AddressMetadata) error {
+	return db.SetIf(keyAddress, metadata, Condition{})
+}
+
+// SetIf is Set, but only writes if the version currently stored for the key satisfies
+// cond.  Otherwise ErrPreconditionFailed is returned.  The condition, and the checks
+// against the stored value, are made atomically with the write.
+func (db *KeyDB) SetIf(keyAddress string, metadata *models.AddressMetadata, cond Condition) error {
+	return db.setIf(keyAddress, metadata, nil, cond, nil)
+}
+
+// setIf implements SetIf.  If rawMetadata is nil, metadata is serialized to be stored.  Any
+// receipt is stored with the record, replacing the previous record's.
+func (db *KeyDB) setIf(keyAddress string, metadata *models.AddressMetadata, rawMetadata []byte, cond Condition, receipt *models.Receipt) error {
 	// Treat the key as a payment address for BCH
-	addr, err := bchutil.DecodeAddress(keyAddress, &chaincfg.MainNetParams)
+	key, err := db.parseKey(keyAddress)
 	if err != nil {
 		return err
 	}
 
-	// Get the hash160 of the pubkey.  This should be RIPEMD(SHA256(PubKey)), although this
-	// will change depending on the type of address.
-	keyHash := addr.ScriptAddress()
-	rawPubKey := metadata.GetPubKey()
-	computedHash := bchutil.Hash160(rawPubKey)
-	if !bytes.Equal(computedHash, keyHash) {
-		return ErrPubkeyDoesNotMatch
+	if err := db.limits.Check(metadata); err != nil {
+		return err
 	}
 
-	// Check to make sure this is actually an update and not someone resubmitting an old
-	// value
-	oldValue, err := db.Get(keyAddress)
-	if err == nil && oldValue.GetPayload().GetTimestamp() > metadata.Payload.GetTimestamp() {
-		return ErrOutdatedValue
+	// A timestamp from the future would outlive its TTL, and block every later update
+	now := time.Now()
+	if metadata.GetPayload().GetTimestamp() > now.Unix()+db.maxClockSkew {
+		return ErrFutureTimestamp
 	}
 
-	if checkTTL(metadata, time.Now()) {
+	if checkTTL(metadata, now) {
 		return ErrExpiredTTL
 	}
 
-	// TODO: Ensure we're not re-adding keys that are older than the GC interval.
-
-	pubKey, err := bchec.ParsePubKey(rawPubKey, bchec.S256())
+	rawPayload, err := proto.Marshal(metadata.GetPayload())
 	if err != nil {
 		return err
 	}
+	msgHash := sha256.Sum256(rawPayload)
 
-	rawPayload, err := proto.Marshal(metadata.GetPayload())
-	if err != nil {
+	if err := db.verify(key, metadata, msgHash[:]); err != nil {
 		return err
 	}
-	msgHash := sha256.Sum256(rawPayload)
-	var sig *bchec.Signature
-	switch metadata.GetScheme() {
-	case models.AddressMetadata_SCHNORR:
-		sig, err = bchec.ParseSchnorrSignature(metadata.GetSignature())
-	case models.AddressMetadata_ECDSA:
-		sig, err = bchec.ParseDERSignature(metadata.GetSignature(), bchec.S256())
+
+	if rawMetadata == nil {
+		if rawMetadata, err = proto.Marshal(metadata); err != nil {
+			return err
+		}
+	}
+	if receipt != nil && receipt.GetReceivedAt() == 0 {
+		receipt = proto.Clone(receipt).(*models.Receipt)
+		receipt.ReceivedAt = now.Unix()
 	}
+	return db.updateKey(key, func(tx Tx) error {
+		if revoked(tx, key.Bytes()) {
+			return ErrRevoked
+		}
+		current, err := db.current(tx, key.Bytes(), now)
+		if err != nil {
+			return err
+		}
+		if !cond.check(current) {
+			return ErrPreconditionFailed
+		}
+
+		// Ensure we're not re-adding values that were previously accepted, including
+		// those which have since been garbage collected.
+		if mark, ok := highWater(tx, key.Bytes()); ok && metadata.GetPayload().GetTimestamp() <= mark {
+			return ErrReplayedValue
+		}
+
+		// Check to make sure this is actually an update and not someone resubmitting an old
+		// value.  Flagged records are ignored, as their timestamps can't be trusted.
+		flagged := tx.Bucket(flaggedBucket).Get(key.Bytes()) != nil
+		if current != nil && !flagged && current.GetPayload().GetTimestamp() > metadata.GetPayload().GetTimestamp() {
+			return ErrOutdatedValue
+		}
+		timestamp := metadata.GetPayload().GetTimestamp()
+		if err := db.put(tx, key.Bytes(), rawMetadata, timestamp, expiryOf(metadata)); err != nil {
+			return err
+		}
+		if err := putReceipt(tx, key.Bytes(), receipt); err != nil {
+			return err
+		}
+		return db.appendChange(tx, key.Bytes(), models.Change_SET, timestamp)
+	})
+}
+
+// Delete removes the metadata and history stored for an address, if deletion is signed
+// by the address's key and newer than the stored metadata, whether or not it has expired.  The address's high water mark
+// is raised to the deletion's timestamp, which leaves a tombstone that stops older
+// metadata, or the deletion itself, from being replayed.
+func (db *KeyDB) Delete(keyAddress string, deletion *models.Deletion) error {
+	key, err := db.parseKey(keyAddress)
 	if err != nil {
 		return err
 	}
-	// Verify the signature against the SHA256 of the message
-	if !sig.Verify(msgHash[:], pubKey) {
-		return ErrSignatureMismatch
+
+	now := time.Now()
+	if deletion.GetTimestamp() > now.Unix()+db.maxClockSkew {
+		return ErrFutureTimestamp
 	}
 
-	return db.db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket(addressMetadataBucket)
-		metadata, err := proto.Marshal(metadata)
+	msgHash := DeletionHash(key, deletion.GetTimestamp())
+	if err := db.verify(key, deletion, msgHash[:]); err != nil {
+		return err
+	}
+
+	return db.updateKey(key, func(tx Tx) error {
+		if revoked(tx, key.Bytes()) {
+			return ErrRevoked
+		}
+		// Expired records are deleted too, as they're kept until they're collected
+		record, err := db.getRaw(tx, key.Bytes())
 		if err != nil {
 			return err
 		}
-		err = b.Put([]byte(keyAddress), metadata)
-		return err
+		flagged := tx.Bucket(flaggedBucket).Get(key.Bytes()) != nil
+		if !flagged && record.Timestamp >= deletion.GetTimestamp() {
+			return ErrOutdatedValue
+		}
+		if mark, ok := highWater(tx, key.Bytes()); ok && deletion.GetTimestamp() <= mark {
+			return ErrReplayedValue
+		}
+
+		if err := deleteRecord(tx, key.Bytes()); err != nil {
+			return err
+		}
+		if err := unflag(tx, key.Bytes()); err != nil {
+			return err
+		}
+		err = tx.Bucket(historyBucket).DeleteBucket(key.Bytes())
+		if err != nil && err != ErrBucketNotFound {
+			return err
+		}
+		if err := raiseHighWater(tx, key.Bytes(), deletion.GetTimestamp()); err != nil {
+			return err
+		}
+		return db.appendChange(tx, key.Bytes(), models.Change_DELETE, deletion.GetTimestamp())
 	})
 }
 
+// deletionDomain separates the messages signed for deletions from those signed for
+// metadata, so that one can't be passed off as the other
+const deletionDomain = "keyserver-deletion\x00"
+
+// DeletionHash returns the hash signed by a deletion of key at timestamp
+func DeletionHash(key keyid.Key, timestamp int64) [sha256.Size]byte {
+	msg := append([]byte(deletionDomain), key.Bytes()...)
+	rawTimestamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(rawTimestamp, uint64(timestamp))
+	return sha256.Sum256(append(msg, rawTimestamp...))
+}
+
+// signed is the proof of ownership carried by metadata and deletions
+type signed interface {
+	GetPubKey() []byte
+	GetSignature() []byte
+	GetScheme() models.AddressMetadata_SignatureScheme
+	GetRedeemScript() []byte
+	GetSignatures() [][]byte
+}
+
+// verify checks that proof shows msgHash was signed by the owner of key
+func (db *KeyDB) verify(key keyid.Key, proof signed, msgHash []byte) error {
+	if key.Type() == keyid.TypeScriptHash {
+		return db.verifyMultiSig(key.Hash(), proof, msgHash)
+	}
+	return db.verifyPubKey(key.Hash(), proof, msgHash)
+}
+
+// verifyPubKey checks that proof carries the pubkey whose hash160 is keyHash, and a
+// signature of msgHash by it.
+func (db *KeyDB) verifyPubKey(keyHash []byte, proof signed, msgHash []byte) error {
+	// Get the hash160 of the pubkey.  This should be RIPEMD(SHA256(PubKey)).
+	rawPubKey := proof.GetPubKey()
+	computedHash := bchutil.Hash160(rawPubKey)
+	if !bytes.Equal(computedHash, keyHash) {
+		return ErrPubkeyDoesNotMatch
+	}
+
+	ok, err := db.schemes.Verify(proof.GetScheme(), proof.GetSignature(), msgHash, rawPubKey)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+// verifyMultiSig checks that proof carries the redeem script whose hash160 is scriptHash,
+// and that msgHash is signed by at least as many of the script's pubkeys as the script
+// requires.  Signatures may be given in any order, but each pubkey only counts once.
+func (db *KeyDB) verifyMultiSig(scriptHash []byte, proof signed, msgHash []byte) error {
+	script := proof.GetRedeemScript()
+	if !bytes.Equal(bchutil.Hash160(script), scriptHash) {
+		return ErrScriptDoesNotMatch
+	}
+
+	class, addrs, required, err := txscript.ExtractPkScriptAddrs(script, db.params)
+	if err != nil || class != txscript.MultiSigTy {
+		return ErrUnsupportedScript
+	}
+	// A script requiring no signatures would let anyone who knows it write to its address
+	if required < 1 || required > len(addrs) {
+		return ErrUnsupportedScript
+	}
+	signatures := proof.GetSignatures()
+	if len(signatures) > len(addrs) {
+		return ErrTooManySignatures
+	}
+
+	used := make([]bool, len(addrs))
+	valid := 0
+	for _, rawSig := range signatures {
+		for i, addr := range addrs {
+			if used[i] {
+				continue
+			}
+			pubKey := addr.(*bchutil.AddressPubKey).PubKey()
+			ok, err := db.schemes.VerifyPubKey(proof.GetScheme(), rawSig, msgHash, pubKey)
+			if err != nil {
+				return err
+			}
+			if ok {
+				used[i] = true
+				valid++
+				break
+			}
+		}
+	}
+	if valid < required {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
 // Get pulls a key from the database, and returns it to the called.  It does not validate
 // the output data and expects that the integrety of values was ensured during SetKey()
 func (db *KeyDB) Get(keyAddress string) (*models.AddressMetadata, error) {
-	metadata := &models.AddressMetadata{}
-	err := db.db.View(func(tx *bbolt.Tx) error {
-		bk := tx.Bucket(addressMetadataBucket)
-		if bk == nil {
-			return errors.Wrap(bbolt.ErrBucketNotFound, "failed to get 'addressMetadata' bucket")
+	record, err := db.GetRaw(keyAddress)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalMetadata(record.Metadata)
+}
+
+// CacheStats returns the read cache's counters
+func (db *KeyDB) CacheStats() CacheStats {
+	return db.cache.stats()
+}
+
+// GetHistory returns the versions of a key accepted by Set, newest first.  At most
+// Config.HistorySize versions are kept.  Like Get, it returns ErrExpiredTTL once the
+// current version has expired.
+func (db *KeyDB) GetHistory(keyAddress string) ([]*models.AddressMetadata, error) {
+	key, err := db.parseKey(keyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var versions []*models.AddressMetadata
+	err = db.db.View(func(tx Tx) error {
+		if revoked(tx, key.Bytes()) {
+			return ErrRevoked
+		}
+		if record, err := db.getRaw(tx, key.Bytes()); err == nil && record.expired(now) {
+			return ErrExpiredTTL
+		}
+		b := tx.Bucket(historyBucket).Bucket(key.Bytes())
+		if b == nil {
+			return errors.Wrap(ErrNotFound, "failed to find address history")
 		}
 
-		rawMetadata := bk.Get([]byte(keyAddress))
-		if rawMetadata == nil {
-			return errors.Wrap(bbolt.ErrBucketNotFound, "failed to find address metadata")
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			metadata := &models.AddressMetadata{}
+			if err := proto.Unmarshal(v, metadata); err != nil {
+				return err
+			}
+			versions = append(versions, metadata)
 		}
+		return nil
+	})
+	return versions, err
+}
 
-		err := proto.Unmarshal(rawMetadata, metadata)
+// Collect drops every bucket whose records have all expired as of now, and reports how
+// much was reclaimed.  Records are dropped in batches, as described at defaultBatchSize.
+func (db *KeyDB) Collect(now time.Time) (GCStats, error) {
+	defer db.feed.notify()
+
+	var stats GCStats
+	for {
+		var batch GCStats
+		var dropped [][]byte
+		var done bool
+		err := db.update(func(tx Tx) (err error) {
+			batch = GCStats{}
+			dropped, done, err = db.collectBatch(tx, now, &batch)
+			return err
+		})
 		if err != nil {
+			return stats, err
+		}
+		for _, k := range dropped {
+			if key, ok := keyid.FromBytes(k); ok {
+				db.cache.invalidate(key)
+			}
+		}
+		stats.Buckets += batch.Buckets
+		stats.Records += batch.Records
+		stats.Bytes += batch.Bytes
+		if done {
+			break
+		}
+	}
+
+	for {
+		var done bool
+		err := db.update(func(tx Tx) (err error) {
+			done, err = trimFeed(tx, db.feedSize, db.batchSize)
 			return err
+		})
+		if err != nil || done {
+			return stats, err
 		}
+	}
+}
 
-		if checkTTL(metadata, time.Now()) {
-			return ErrExpiredTTL
+// collectBatch drops up to a batch of expired records, along with the buckets they
+// empty.  It returns the keys of the records dropped, and reports whether any are left.
+func (db *KeyDB) collectBatch(tx Tx, now time.Time, stats *GCStats) ([][]byte, bool, error) {
+	records := tx.Bucket(recordsBucket)
+
+	// Buckets are named by the time they expire, so they are visited oldest first.
+	var expired [][]byte
+	c := records.Cursor()
+	for name, v := c.First(); name != nil; name, v = c.Next() {
+		if v != nil {
+			continue
+		}
+		if int64(binary.BigEndian.Uint64(name)) > now.Unix() {
+			break
 		}
+		expired = append(expired, name)
+	}
+
+	var dropped [][]byte
+	remaining := db.batchSize
+	for _, name := range expired {
+		// Gather the keys first, as they're deleted from the bucket as they're dropped
+		b := records.Bucket(name)
+		var keys, values [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && len(keys) < remaining; k, v = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+			values = append(values, append([]byte{}, v...))
+		}
+
+		for i, k := range keys {
+			stats.Records++
+			stats.Bytes += len(k) + len(values[i])
+			if err := db.collectRecord(tx, name, k, values[i]); err != nil {
+				return nil, false, err
+			}
+			if err := b.Delete(k); err != nil {
+				return nil, false, err
+			}
+		}
+		dropped = append(dropped, keys...)
+		remaining -= len(keys)
+		if remaining == 0 {
+			if k, _ := b.Cursor().First(); k != nil {
+				return dropped, false, nil
+			}
+		}
+
+		if err := records.DeleteBucket(name); err != nil {
+			return nil, false, errors.Wrapf(err, "failed to drop expired bucket")
+		}
+		stats.Buckets++
+		if remaining == 0 {
+			return dropped, false, nil
+		}
+	}
+	return dropped, true, nil
+}
 
+// collectRecord drops everything kept alongside the record for key in the expired bucket
+// name.  The index entry and history are only dropped if the record is really gone,
+// rather than moved to a newer bucket.
+func (db *KeyDB) collectRecord(tx Tx, name, k, v []byte) error {
+	index := tx.Bucket(expiryIndexBucket)
+	rawEntry := index.Get(k)
+	if rawEntry == nil {
+		return nil
+	}
+	entry, _ := decodeIndexEntry(rawEntry)
+	if !bytes.Equal(entry.bucket, name) {
+		return nil
+	}
+	if err := index.Delete(k); err != nil {
+		return err
+	}
+	if err := db.appendChange(tx, k, models.Change_EXPIRE, entry.timestamp); err != nil {
+		return err
+	}
+	if err := unindexKinds(tx, k, v); err != nil {
+		return err
+	}
+	if err := updateMerkle(tx, k, nil); err != nil {
+		return err
+	}
+	if err := deleteReceipt(tx, k); err != nil {
+		return err
+	}
+	err := tx.Bucket(historyBucket).DeleteBucket(k)
+	if err != nil && err != ErrBucketNotFound {
+		return err
+	}
+	return tx.Bucket(flaggedBucket).Delete(k)
+}
+
+// Repair finds the records timestamped further past now than the allowed clock skew.
+// Unless dryRun is set, each one is flagged so that it no longer blocks updates, and its
+// key's high water mark is lowered to now, so that any value signed from now on is
+// accepted.  The flagged record is served until it is replaced.
+func (db *KeyDB) Repair(now time.Time, dryRun bool) ([]FutureRecord, error) {
+	var found []FutureRecord
+	update := db.update
+	if dryRun {
+		update = db.db.View
+	}
+	err := update(func(tx Tx) error {
+		found = nil
+		var keys [][]byte
+		var timestamps []int64
+		index := tx.Bucket(expiryIndexBucket)
+		err := forEach(index, func(k, v []byte) error {
+			rawMetadata, err := db.get(tx, k)
+			if err != nil {
+				return nil
+			}
+			metadata, err := unmarshalMetadata(rawMetadata)
+			if err != nil {
+				return err
+			}
+			timestamp := metadata.GetPayload().GetTimestamp()
+			if timestamp <= now.Unix()+db.maxClockSkew {
+				return nil
+			}
+			keys = append(keys, append([]byte{}, k...))
+			timestamps = append(timestamps, timestamp)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, k := range keys {
+			record := FutureRecord{Key: string(k), Timestamp: timestamps[i]}
+			if key, ok := keyid.FromBytes(k); ok {
+				record.Key = key.Encode(db.params)
+			}
+			found = append(found, record)
+			if dryRun {
+				continue
+			}
+			if err := db.flag(tx, k, timestamps[i], now.Unix()); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
-	return metadata, err
+	return found, err
 }
 
 // Close closed down the db, and releases the lock on the db file
 func (db *KeyDB) Close() {
+	close(db.quit)
+	db.wg.Wait()
 	db.db.Close()
 }
 
-func checkTTL(metadata *models.AddressMetadata, now time.Time) bool {
+// collectLoop runs Collect every interval until the db is closed
+func (db *KeyDB) collectLoop(interval time.Duration) {
+	defer db.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.quit:
+			return
+		case now := <-ticker.C:
+			stats, err := db.Collect(now)
+			if err != nil {
+				log.Error().Msgf("garbage collection failed: %s", err)
+				continue
+			}
+			log.Info().
+				Int("buckets", stats.Buckets).
+				Int("records", stats.Records).
+				Int("bytes", stats.Bytes).
+				Msg("garbage collection complete")
+		}
+	}
+}
+
+// put stores rawMetadata in the bucket for its expiry time, removing any previous value
+// stored under the key, and raises the key's high water mark to timestamp.
+func (db *KeyDB) put(tx Tx, key, rawMetadata []byte, timestamp, expiry int64) error {
+	if err := db.putRecord(tx, key, rawMetadata, timestamp, expiry); err != nil {
+		return err
+	}
+	if err := unflag(tx, key); err != nil {
+		return err
+	}
+	if err := db.putHistory(tx, key, rawMetadata, timestamp); err != nil {
+		return err
+	}
+	return raiseHighWater(tx, key, timestamp)
+}
+
+// putRecord stores rawMetadata in the bucket for its expiry time, removing any previous
+// value stored under the key, indexes its expiry, timestamp and entry kinds, and adds it
+// to the Merkle tree.
+func (db *KeyDB) putRecord(tx Tx, key, rawMetadata []byte, timestamp, expiry int64) error {
+	records := tx.Bucket(recordsBucket)
+	index := tx.Bucket(expiryIndexBucket)
+
+	if rawEntry := index.Get(key); rawEntry != nil {
+		oldEntry, _ := decodeIndexEntry(rawEntry)
+		if old := records.Bucket(oldEntry.bucket); old != nil {
+			if oldMetadata := old.Get(key); oldMetadata != nil {
+				if err := unindexKinds(tx, key, oldMetadata); err != nil {
+					return err
+				}
+			}
+			if err := old.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	name := db.bucketName(expiry)
+	b, err := records.CreateBucketIfNotExists(name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create expiry bucket")
+	}
+	if err := b.Put(key, rawMetadata); err != nil {
+		return err
+	}
+	if err := indexKinds(tx, key, rawMetadata, expiry); err != nil {
+		return err
+	}
+	if err := updateMerkle(tx, key, rawMetadata); err != nil {
+		return err
+	}
+	entry := indexEntry{bucket: name, expiry: expiry, timestamp: timestamp}
+	return index.Put(key, entry.encode())
+}
+
+// deleteRecord removes the record stored under key, along with its index entries, its
+// leaf in the Merkle tree and its receipt
+func deleteRecord(tx Tx, key []byte) error {
+	index := tx.Bucket(expiryIndexBucket)
+	if rawEntry := index.Get(key); rawEntry != nil {
+		entry, _ := decodeIndexEntry(rawEntry)
+		if b := tx.Bucket(recordsBucket).Bucket(entry.bucket); b != nil {
+			if rawMetadata := b.Get(key); rawMetadata != nil {
+				if err := unindexKinds(tx, key, rawMetadata); err != nil {
+					return err
+				}
+			}
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+		}
+		if err := updateMerkle(tx, key, nil); err != nil {
+			return err
+		}
+		if err := deleteReceipt(tx, key); err != nil {
+			return err
+		}
+	}
+	return index.Delete(key)
+}
+
+// putHistory records rawMetadata as the newest version of key, and drops the oldest
+// versions beyond the configured history size.
+func (db *KeyDB) putHistory(tx Tx, key, rawMetadata []byte, timestamp int64) error {
+	if db.historySize == 0 {
+		return nil
+	}
+
+	b, err := tx.Bucket(historyBucket).CreateBucketIfNotExists(key)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create history bucket")
+	}
+	version := make([]byte, 8)
+	binary.BigEndian.PutUint64(version, uint64(timestamp))
+	if err := b.Put(version, rawMetadata); err != nil {
+		return err
+	}
+	return db.trimHistory(b)
+}
+
+// trimHistory drops the oldest versions in the history bucket b beyond the configured
+// history size.
+func (db *KeyDB) trimHistory(b Bucket) error {
+	// Versions are ordered by timestamp, so everything past the newest historySize can go
+	var stale [][]byte
+	c := b.Cursor()
+	kept := 0
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		if kept < db.historySize {
+			kept++
+			continue
+		}
+		stale = append(stale, k)
+	}
+	for _, k := range stale {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// highWater returns the newest timestamp ever accepted for key, if any
+func highWater(tx Tx, key []byte) (int64, bool) {
+	rawMark := tx.Bucket(highWaterBucket).Get(key)
+	if rawMark == nil {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(rawMark)), true
+}
+
+// flag marks the record for key, timestamped at timestamp, as coming from the future, and
+// lowers the key's high water mark to now.
+func (db *KeyDB) flag(tx Tx, key []byte, timestamp, now int64) error {
+	rawTimestamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(rawTimestamp, uint64(timestamp))
+	if err := tx.Bucket(flaggedBucket).Put(key, rawTimestamp); err != nil {
+		return err
+	}
+	rawMark := make([]byte, 8)
+	binary.BigEndian.PutUint64(rawMark, uint64(now))
+	return tx.Bucket(highWaterBucket).Put(key, rawMark)
+}
+
+// unflag clears the flag on key, if there is one, and drops the flagged version from
+// the key's history.
+func unflag(tx Tx, key []byte) error {
+	flagged := tx.Bucket(flaggedBucket)
+	rawTimestamp := flagged.Get(key)
+	if rawTimestamp == nil {
+		return nil
+	}
+	if versions := tx.Bucket(historyBucket).Bucket(key); versions != nil {
+		if err := versions.Delete(rawTimestamp); err != nil {
+			return err
+		}
+	}
+	return flagged.Delete(key)
+}
+
+// raiseHighWater raises the high water mark of key to timestamp, if it's below it
+func raiseHighWater(tx Tx, key []byte, timestamp int64) error {
+	if mark, ok := highWater(tx, key); ok && mark >= timestamp {
+		return nil
+	}
+	rawMark := make([]byte, 8)
+	binary.BigEndian.PutUint64(rawMark, uint64(timestamp))
+	return tx.Bucket(highWaterBucket).Put(key, rawMark)
+}
+
+// updateKey runs fn within a read-write transaction which modifies key.  Once it ends,
+// any cached metadata for key is dropped, and then followers of the feed are woken.
+func (db *KeyDB) updateKey(key keyid.Key, fn func(Tx) error) error {
+	defer db.feed.notify()
+	defer db.cache.invalidate(key)
+	return db.update(fn)
+}
+
+// update runs fn within a read-write transaction, once any other write has finished.
+// Writes all update the feed's sequence number and the Merkle root, so stores which allow
+// concurrent writers would only have them conflict and retry.
+func (db *KeyDB) update(fn func(Tx) error) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	return db.db.Update(fn)
+}
+
+// parseKey returns the canonical key for keyAddress.  Anything that isn't an address on
+// the KeyDB's network is reported as ErrInvalidAddress, apart from addresses for other
+// networks which are reported as ErrWrongNetwork.
+func (db *KeyDB) parseKey(keyAddress string) (keyid.Key, error) {
+	key, err := keyid.Parse(keyAddress, db.params)
+	if err == nil || err == ErrWrongNetwork {
+		return key, err
+	}
+	return key, errors.Wrap(ErrInvalidAddress, err.Error())
+}
+
+// current returns the unexpired metadata stored under key, or nil if there is none
+func (db *KeyDB) current(tx Tx, key []byte, now time.Time) (*models.AddressMetadata, error) {
+	rawMetadata, err := db.get(tx, key)
+	if errors.Cause(err) == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := unmarshalMetadata(rawMetadata)
+	if err != nil {
+		return nil, err
+	}
+	if checkTTL(metadata, now) {
+		return nil, nil
+	}
+	return metadata, nil
+}
+
+// get finds the raw metadata stored under key
+func (db *KeyDB) get(tx Tx, key []byte) ([]byte, error) {
+	rawEntry := tx.Bucket(expiryIndexBucket).Get(key)
+	if rawEntry == nil {
+		return nil, errors.Wrap(ErrNotFound, "failed to find address metadata")
+	}
+
+	entry, _ := decodeIndexEntry(rawEntry)
+	b := tx.Bucket(recordsBucket).Bucket(entry.bucket)
+	if b == nil {
+		return nil, errors.Wrap(ErrNotFound, "failed to get expiry bucket")
+	}
+
+	rawMetadata := b.Get(key)
+	if rawMetadata == nil {
+		return nil, errors.Wrap(ErrNotFound, "failed to find address metadata")
+	}
+	return rawMetadata, nil
+}
+
+// bucketName returns the name of the bucket that records expiring at expiry belong in.
+// This is the end of the bucket's window, at which point all of its records have expired.
+func (db *KeyDB) bucketName(expiry int64) []byte {
+	end := expiry - expiry%db.bucketWidth + db.bucketWidth
+	name := make([]byte, 8)
+	binary.BigEndian.PutUint64(name, uint64(end))
+	return name
+}
+
+// upgradeLegacyBucket moves a batch of records from the flat addressMetadata bucket used
+// by older databases into expiry buckets, and drops the bucket once it's empty.  Moved
+// records are deleted from it, so each batch starts from the beginning.
+func (db *KeyDB) upgradeLegacyBucket(tx Tx, after []byte) ([]byte, error) {
+	legacy := tx.Bucket(addressMetadataBucket)
+	if legacy == nil {
+		return nil, nil
+	}
+
+	// Gather the records first, as they're deleted as they're moved
+	var keys, values [][]byte
+	c := legacy.Cursor()
+	for k, v := c.First(); k != nil && len(keys) < db.batchSize; k, v = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+		values = append(values, append([]byte{}, v...))
+	}
+	for i, k := range keys {
+		metadata := &models.AddressMetadata{}
+		if err := proto.Unmarshal(values[i], metadata); err != nil {
+			return nil, errors.Wrapf(err, "failed to upgrade record %s", k)
+		}
+		if err := db.put(tx, k, values[i], metadata.GetPayload().GetTimestamp(), expiryOf(metadata)); err != nil {
+			return nil, err
+		}
+		if err := legacy.Delete(k); err != nil {
+			return nil, err
+		}
+	}
+	if len(keys) < db.batchSize {
+		return nil, tx.DeleteBucket(addressMetadataBucket)
+	}
+	return keys[len(keys)-1], nil
+}
+
+// legacyKeysStart sorts before the address strings used as keys by older databases, and
+// after every canonical key, which starts with its type
+var legacyKeysStart = []byte{keyid.TypeScriptHash + 1}
+
+// canonicalizeKeys merges a batch of the entries stored under the address strings used as
+// keys by older databases into the entries for their canonical keys.  Where one address
+// was stored in several encodings, the newest record wins, histories are combined, and
+// the highest high water mark is kept.  Keys which can't be decoded on this network are
+// left alone.
+func (db *KeyDB) canonicalizeKeys(tx Tx, after []byte) ([]byte, error) {
+	// Gather the keys first, as the buckets are modified while merging.  The first batch
+	// of keys from each bucket includes the first batch of them all.
+	var legacy [][]byte
+	for _, name := range [][]byte{expiryIndexBucket, highWaterBucket, historyBucket} {
+		c := tx.Bucket(name).Cursor()
+		k, _ := c.Seek(legacyKeysStart)
+		if after != nil {
+			k, _ = seekAfter(c, after)
+		}
+		for found := 0; k != nil && found < db.batchSize; k, _ = c.Next() {
+			if _, ok := keyid.FromBytes(k); !ok {
+				legacy = append(legacy, append([]byte{}, k...))
+				found++
+			}
+		}
+	}
+	sort.Slice(legacy, func(i, j int) bool { return bytes.Compare(legacy[i], legacy[j]) < 0 })
+	var batch [][]byte
+	for _, k := range legacy {
+		if len(batch) == db.batchSize {
+			break
+		}
+		if len(batch) == 0 || !bytes.Equal(batch[len(batch)-1], k) {
+			batch = append(batch, k)
+		}
+	}
+
+	for _, address := range batch {
+		key, err := keyid.Parse(string(address), db.params)
+		if err != nil {
+			log.Warn().Msgf("unable to canonicalize key %q: %s", address, err)
+			continue
+		}
+		if err := db.mergeKey(tx, address, key.Bytes()); err != nil {
+			return nil, errors.Wrapf(err, "failed to canonicalize key %q", address)
+		}
+	}
+	if len(batch) < db.batchSize {
+		return nil, nil
+	}
+	return batch[len(batch)-1], nil
+}
+
+// mergeKey moves the record, history and high water mark stored under old onto key
+func (db *KeyDB) mergeKey(tx Tx, old, key []byte) error {
+	if rawMetadata, err := db.get(tx, old); err == nil {
+		metadata, err := unmarshalMetadata(rawMetadata)
+		if err != nil {
+			return err
+		}
+		newer := true
+		if rawCurrent, err := db.get(tx, key); err == nil {
+			current, err := unmarshalMetadata(rawCurrent)
+			if err != nil {
+				return err
+			}
+			newer = metadata.GetPayload().GetTimestamp() > current.GetPayload().GetTimestamp()
+		}
+		if newer {
+			if err := db.putRecord(tx, key, rawMetadata, metadata.GetPayload().GetTimestamp(), expiryOf(metadata)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := deleteRecord(tx, old); err != nil {
+		return err
+	}
+
+	history := tx.Bucket(historyBucket)
+	if oldVersions := history.Bucket(old); oldVersions != nil {
+		versions, err := history.CreateBucketIfNotExists(key)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create history bucket")
+		}
+		err = forEach(oldVersions, func(k, v []byte) error {
+			return versions.Put(k, v)
+		})
+		if err != nil {
+			return err
+		}
+		if err := db.trimHistory(versions); err != nil {
+			return err
+		}
+		if err := history.DeleteBucket(old); err != nil {
+			return err
+		}
+	}
+
+	if mark, ok := highWater(tx, old); ok {
+		if err := raiseHighWater(tx, key, mark); err != nil {
+			return err
+		}
+		return tx.Bucket(highWaterBucket).Delete(old)
+	}
+	return nil
+}
+
+// unmarshalMetadata decodes raw metadata as stored in the database
+func unmarshalMetadata(rawMetadata []byte) (*models.AddressMetadata, error) {
+	metadata := &models.AddressMetadata{}
+	if err := proto.Unmarshal(rawMetadata, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// expiryOf returns the unix time after which metadata is considered expired
+func expiryOf(metadata *models.AddressMetadata) int64 {
 	ttl := metadata.GetPayload().GetTtl()
 	// One month default
 	if ttl == 0 {
-		ttl = 2592000
+		ttl = defaultTTL
 	}
-	return metadata.GetPayload().GetTimestamp()+ttl < now.Unix()
+	return metadata.GetPayload().GetTimestamp() + ttl
+}
+
+func checkTTL(metadata *models.AddressMetadata, now time.Time) bool {
+	return expiryOf(metadata) < now.Unix()
 }
@@ -6,15 +6,20 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/cashweb/keyserver/pkg/keyid"
 	"github.com/cashweb/keyserver/pkg/models"
 	"github.com/gcash/bchd/bchec"
 	"github.com/gcash/bchd/chaincfg"
+	"github.com/gcash/bchd/txscript"
 	"github.com/gcash/bchutil"
 	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
 )
 
 func TestAddressSignVerify(t *testing.T) {
@@ -89,6 +94,10 @@ func GeneratePayload(assert *assert.Assertions, addrMetadata *models.AddressMeta
 	// Generate a privkey
 	privKey, err := bchec.NewPrivateKey(bchec.S256())
 	assert.Nil(err)
+	return SignPayload(assert, privKey, addrMetadata)
+}
+
+func SignPayload(assert *assert.Assertions, privKey *bchec.PrivateKey, addrMetadata *models.AddressMetadata) (*bchutil.AddressPubKeyHash, *models.AddressMetadata) {
 	pubkey := privKey.PubKey()
 	// Find the address (Note: legacy atm)
 	addr, err := bchutil.NewAddressPubKeyHash(bchutil.Hash160(pubkey.SerializeUncompressed()), &chaincfg.MainNetParams)
@@ -106,3 +115,903 @@ func GeneratePayload(assert *assert.Assertions, addrMetadata *models.AddressMeta
 
 	return addr, addrMetadata
 }
+
+func TestCollect(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // clean up
+	cfg := &Config{
+		DBPath:      filepath.Join(dir, "testcollect.db"),
+		BucketWidth: time.Minute,
+	}
+	keyDb, err := New(cfg)
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now()
+	shortAddr, shortMetadata := GeneratePayload(assert, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now.Unix(),
+			Ttl:       60,
+		},
+	})
+	assert.Nil(keyDb.Set(shortAddr.EncodeAddress(), shortMetadata))
+	longAddr, longMetadata := GeneratePayload(assert, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now.Unix(),
+			Ttl:       3600,
+		},
+	})
+	assert.Nil(keyDb.Set(longAddr.EncodeAddress(), longMetadata))
+
+	// Nothing has expired yet
+	stats, err := keyDb.Collect(now)
+	assert.Nil(err)
+	assert.Equal(GCStats{}, stats)
+
+	// Only the short lived record's bucket has expired
+	stats, err = keyDb.Collect(now.Add(5 * time.Minute))
+	assert.Nil(err)
+	assert.Equal(1, stats.Buckets)
+	assert.Equal(1, stats.Records)
+	assert.True(stats.Bytes > 0)
+
+	_, err = keyDb.Get(shortAddr.EncodeAddress())
+	assert.NotNil(err)
+	assert.NotEqual(ErrExpiredTTL, err)
+	fetchedMetadata, err := keyDb.Get(longAddr.EncodeAddress())
+	assert.Nil(err)
+	assert.True(proto.Equal(longMetadata, fetchedMetadata), "Fetch value did not match expected value")
+}
+
+func TestCollectBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory, BucketWidth: time.Minute})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	// More records than are dropped in one transaction, all in the same bucket
+	now := time.Now().Unix()
+	rawMetadata, err := proto.Marshal(&models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: now, Ttl: 1},
+	})
+	assert.Nil(err)
+	records := keyDb.batchSize + 1
+	assert.Nil(keyDb.db.Update(func(tx Tx) error {
+		for i := 0; i < records; i++ {
+			key := keyid.Key{0, byte(i >> 8), byte(i)}.Bytes()
+			if err := keyDb.put(tx, key, rawMetadata, now, now+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	stats, err := keyDb.Collect(time.Unix(now+3600, 0))
+	assert.Nil(err)
+	assert.Equal(GCStats{Buckets: 1, Records: records, Bytes: stats.Bytes}, stats)
+	assert.Nil(keyDb.db.View(func(tx Tx) error {
+		k, _ := tx.Bucket(recordsBucket).Cursor().First()
+		assert.Nil(k)
+		k, _ = tx.Bucket(expiryIndexBucket).Cursor().First()
+		assert.Nil(k)
+		return nil
+	}))
+	sequence, err := keyDb.Sequence()
+	assert.Nil(err)
+	assert.Equal(uint64(records), sequence)
+}
+
+func TestUpgradeLegacyBucket(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // clean up
+	dbPath := filepath.Join(dir, "testlegacy.db")
+
+	addr, addrMetadata := GeneratePayload(assert, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: time.Now().Unix(),
+		},
+	})
+	rawMetadata, err := proto.Marshal(addrMetadata)
+	assert.Nil(err)
+
+	// Write a record the way older versions did
+	db, err := bbolt.Open(dbPath, 0600, nil)
+	assert.Nil(err)
+	err = db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(addressMetadataBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(addr.EncodeAddress()), rawMetadata)
+	})
+	assert.Nil(err)
+	assert.Nil(db.Close())
+
+	keyDb, err := New(&Config{DBPath: dbPath})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	fetchedMetadata, err := keyDb.Get(addr.EncodeAddress())
+	assert.Nil(err)
+	assert.True(proto.Equal(addrMetadata, fetchedMetadata), "Fetch value did not match expected value")
+}
+
+// putLegacyRecords writes n records to store the way older versions did, and returns
+// their addresses
+func putLegacyRecords(assert *assert.Assertions, store Store, n int) []string {
+	rawMetadata, err := proto.Marshal(&models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: time.Now().Unix(),
+			Entries:   []*models.Entry{{Kind: "relay"}},
+		},
+	})
+	assert.Nil(err)
+
+	var addresses []string
+	assert.Nil(store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(addressMetadataBucket)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			hash := sha256.Sum256([]byte{byte(i >> 16), byte(i >> 8), byte(i)})
+			addr, err := bchutil.NewAddressPubKeyHash(hash[:20], &chaincfg.MainNetParams)
+			if err != nil {
+				return err
+			}
+			addresses = append(addresses, addr.EncodeAddress())
+			if err := b.Put([]byte(addr.EncodeAddress()), rawMetadata); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	return addresses
+}
+
+func TestUpgradeLegacyBucketBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := open(&Config{Driver: DriverMemory})
+	assert.Nil(err)
+	defer db.Close()
+
+	// More records than are moved in one transaction
+	addresses := putLegacyRecords(assert, db.db, db.batchSize+1)
+	_, err = db.migrate(false)
+	assert.Nil(err)
+
+	for _, address := range addresses {
+		_, err := db.GetRaw(address)
+		assert.Nil(err)
+	}
+	assert.Nil(db.db.View(func(tx Tx) error {
+		assert.Nil(tx.Bucket(addressMetadataBucket))
+		return nil
+	}))
+}
+
+func TestReplayAfterCollect(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // clean up
+	cfg := &Config{
+		DBPath:      filepath.Join(dir, "testreplay.db"),
+		BucketWidth: time.Minute,
+	}
+	keyDb, err := New(cfg)
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	addr, oldMetadata := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now.Unix(),
+			Ttl:       60,
+		},
+	})
+	assert.Nil(keyDb.Set(addr.EncodeAddress(), oldMetadata))
+
+	// Resubmitting the same value is a replay
+	assert.Equal(ErrReplayedValue, keyDb.Set(addr.EncodeAddress(), oldMetadata))
+
+	// Once collected, the old value still can't be brought back
+	stats, err := keyDb.Collect(now.Add(5 * time.Minute))
+	assert.Nil(err)
+	assert.Equal(1, stats.Records)
+	assert.Equal(ErrReplayedValue, keyDb.Set(addr.EncodeAddress(), oldMetadata))
+
+	// But newer values are accepted
+	_, newMetadata := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now.Unix() + 1,
+			Ttl:       60,
+		},
+	})
+	assert.Nil(keyDb.Set(addr.EncodeAddress(), newMetadata))
+}
+
+func TestHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // clean up
+	cfg := &Config{
+		DBPath:      filepath.Join(dir, "testhistory.db"),
+		BucketWidth: time.Minute,
+		HistorySize: 2,
+	}
+	keyDb, err := New(cfg)
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	var addr *bchutil.AddressPubKeyHash
+	var versions []*models.AddressMetadata
+	for i := int64(0); i < 3; i++ {
+		var metadata *models.AddressMetadata
+		addr, metadata = SignPayload(assert, privKey, &models.AddressMetadata{
+			Payload: &models.Payload{
+				Timestamp: now.Unix() + i,
+				Ttl:       60,
+			},
+		})
+		assert.Nil(keyDb.Set(addr.EncodeAddress(), metadata))
+		versions = append(versions, metadata)
+	}
+
+	// Only the newest two versions are kept, newest first
+	history, err := keyDb.GetHistory(addr.EncodeAddress())
+	assert.Nil(err)
+	assert.Equal(2, len(history))
+	assert.True(proto.Equal(versions[2], history[0]), "Newest version should be first")
+	assert.True(proto.Equal(versions[1], history[1]), "Older version should be last")
+
+	// History is dropped along with the record
+	_, err = keyDb.Collect(now.Add(5 * time.Minute))
+	assert.Nil(err)
+	_, err = keyDb.GetHistory(addr.EncodeAddress())
+	assert.NotNil(err)
+}
+
+func TestNetworks(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{
+		Driver:      DriverMemory,
+		ChainParams: &chaincfg.RegressionNetParams,
+	})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	mainAddr, addrMetadata := GeneratePayload(assert, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: time.Now().Unix(),
+		},
+	})
+	legacyAddr, err := bchutil.NewLegacyAddressPubKeyHash(mainAddr.ScriptAddress(), &chaincfg.MainNetParams)
+	assert.Nil(err)
+	regAddr, err := bchutil.NewAddressPubKeyHash(mainAddr.ScriptAddress(), &chaincfg.RegressionNetParams)
+	assert.Nil(err)
+
+	// Mainnet addresses aren't accepted on regtest, in either encoding
+	assert.Equal(ErrWrongNetwork, keyDb.Set(legacyAddr.EncodeAddress(), addrMetadata))
+	assert.NotNil(keyDb.Set("bitcoincash:"+mainAddr.String(), addrMetadata))
+
+	assert.Nil(keyDb.Set("bchreg:"+regAddr.String(), addrMetadata))
+	fetchedMetadata, err := keyDb.Get("bchreg:" + regAddr.String())
+	assert.Nil(err)
+	assert.True(proto.Equal(addrMetadata, fetchedMetadata), "Fetch value did not match expected value")
+}
+
+// signMultiSig returns the P2SH address of a required-of-n multisig script over the keys,
+// and signs addrMetadata with each of signers.
+func signMultiSig(assert *assert.Assertions, keys []*bchec.PrivateKey, required int, signers []*bchec.PrivateKey, addrMetadata *models.AddressMetadata) (*bchutil.AddressScriptHash, *models.AddressMetadata) {
+	var pubKeys []*bchutil.AddressPubKey
+	for _, key := range keys {
+		pubKey, err := bchutil.NewAddressPubKey(key.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+		assert.Nil(err)
+		pubKeys = append(pubKeys, pubKey)
+	}
+	script, err := txscript.MultiSigScript(pubKeys, required)
+	assert.Nil(err)
+	addr, err := bchutil.NewAddressScriptHash(script, &chaincfg.MainNetParams)
+	assert.Nil(err)
+	addrMetadata.RedeemScript = script
+
+	rawMetadata, err := proto.Marshal(addrMetadata.GetPayload())
+	assert.Nil(err)
+	msgHash := sha256.Sum256(rawMetadata)
+	addrMetadata.Signatures = nil
+	for _, signer := range signers {
+		sig, err := signer.SignSchnorr(msgHash[:])
+		assert.Nil(err)
+		addrMetadata.Signatures = append(addrMetadata.Signatures, sig.Serialize())
+	}
+	return addr, addrMetadata
+}
+
+func TestMultiSig(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	var keys []*bchec.PrivateKey
+	for i := 0; i < 3; i++ {
+		key, err := bchec.NewPrivateKey(bchec.S256())
+		assert.Nil(err)
+		keys = append(keys, key)
+	}
+	payload := func() *models.AddressMetadata {
+		return &models.AddressMetadata{
+			Payload: &models.Payload{
+				Timestamp: time.Now().Unix(),
+			},
+		}
+	}
+
+	// Two of three signatures, in any order, are enough
+	addr, addrMetadata := signMultiSig(assert, keys, 2, []*bchec.PrivateKey{keys[2], keys[0]}, payload())
+	assert.Nil(keyDb.Set("bitcoincash:"+addr.String(), addrMetadata))
+	fetchedMetadata, err := keyDb.Get("bitcoincash:" + addr.String())
+	assert.Nil(err)
+	assert.True(proto.Equal(addrMetadata, fetchedMetadata), "Fetch value did not match expected value")
+
+	// One signature isn't
+	addr, addrMetadata = signMultiSig(assert, keys, 2, keys[1:2], payload())
+	assert.Equal(ErrSignatureMismatch, keyDb.Set("bitcoincash:"+addr.String(), addrMetadata))
+
+	// Nor is the same signature twice
+	addr, addrMetadata = signMultiSig(assert, keys, 2, []*bchec.PrivateKey{keys[1], keys[1]}, payload())
+	assert.Equal(ErrSignatureMismatch, keyDb.Set("bitcoincash:"+addr.String(), addrMetadata))
+
+	// Nor a signature by a key outside the script
+	outsider, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	addr, addrMetadata = signMultiSig(assert, keys, 2, []*bchec.PrivateKey{keys[0], outsider}, payload())
+	assert.Equal(ErrSignatureMismatch, keyDb.Set("bitcoincash:"+addr.String(), addrMetadata))
+
+	// More signatures than keys are rejected outright
+	addr, addrMetadata = signMultiSig(assert, keys, 2, append(keys, keys[0]), payload())
+	assert.Equal(ErrTooManySignatures, keyDb.Set("bitcoincash:"+addr.String(), addrMetadata))
+
+	// The script must hash to the address
+	_, addrMetadata = signMultiSig(assert, keys, 2, keys[:2], payload())
+	otherAddr, _ := signMultiSig(assert, keys, 3, keys[:2], payload())
+	assert.Equal(ErrScriptDoesNotMatch, keyDb.Set("bitcoincash:"+otherAddr.String(), addrMetadata))
+
+	// And be a multisig script
+	script := []byte{txscript.OP_TRUE}
+	scriptAddr, err := bchutil.NewAddressScriptHash(script, &chaincfg.MainNetParams)
+	assert.Nil(err)
+	addrMetadata.RedeemScript = script
+	assert.Equal(ErrUnsupportedScript, keyDb.Set("bitcoincash:"+scriptAddr.String(), addrMetadata))
+
+	// Which requires at least one signature
+	addr, addrMetadata = signMultiSig(assert, keys, 0, nil, payload())
+	assert.Equal(ErrUnsupportedScript, keyDb.Set("bitcoincash:"+addr.String(), addrMetadata))
+}
+
+func TestCanonicalKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory, HistorySize: 10})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now().Unix()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	addr, addrMetadata := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now,
+		},
+	})
+	legacyAddr, err := bchutil.NewLegacyAddressPubKeyHash(addr.ScriptAddress(), &chaincfg.MainNetParams)
+	assert.Nil(err)
+	forms := []string{
+		"bitcoincash:" + addr.String(),
+		addr.String(),
+		strings.ToUpper(addr.String()),
+		legacyAddr.EncodeAddress(),
+	}
+
+	// Every encoding of the address finds the same record
+	assert.Nil(keyDb.Set(legacyAddr.EncodeAddress(), addrMetadata))
+	for _, form := range forms {
+		fetchedMetadata, err := keyDb.Get(form)
+		assert.Nil(err, form)
+		assert.True(proto.Equal(addrMetadata, fetchedMetadata), "Fetch value did not match expected value")
+	}
+
+	// So resubmitting it in another encoding is a replay
+	assert.Equal(ErrReplayedValue, keyDb.Set(addr.String(), addrMetadata))
+}
+
+func TestMergeDuplicateKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory, HistorySize: 10})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now().Unix()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	var addr *bchutil.AddressPubKeyHash
+	var versions []*models.AddressMetadata
+	for i := int64(0); i < 3; i++ {
+		var metadata *models.AddressMetadata
+		addr, metadata = SignPayload(assert, privKey, &models.AddressMetadata{
+			Payload: &models.Payload{
+				Timestamp: now + i,
+			},
+		})
+		versions = append(versions, metadata)
+	}
+	legacyAddr, err := bchutil.NewLegacyAddressPubKeyHash(addr.ScriptAddress(), &chaincfg.MainNetParams)
+	assert.Nil(err)
+
+	// Store the versions under the raw address strings, as older versions did, with the
+	// newest under an upper case cashaddr
+	keys := []string{legacyAddr.EncodeAddress(), "bitcoincash:" + addr.String(), strings.ToUpper(addr.String())}
+	err = keyDb.db.Update(func(tx Tx) error {
+		for i, key := range keys {
+			rawMetadata, err := proto.Marshal(versions[i])
+			if err != nil {
+				return err
+			}
+			err = keyDb.put(tx, []byte(key), rawMetadata, versions[i].GetPayload().GetTimestamp(), expiryOf(versions[i]))
+			if err != nil {
+				return err
+			}
+		}
+		// Keys for other networks are left alone
+		return keyDb.put(tx, []byte("bchtest:foo"), []byte{}, now, now)
+	})
+	assert.Nil(err)
+
+	err = keyDb.db.Update(func(tx Tx) error {
+		_, err := keyDb.canonicalizeKeys(tx, nil)
+		return err
+	})
+	assert.Nil(err)
+
+	fetchedMetadata, err := keyDb.Get(legacyAddr.EncodeAddress())
+	assert.Nil(err)
+	assert.True(proto.Equal(versions[2], fetchedMetadata), "Newest record should win")
+	history, err := keyDb.GetHistory(addr.String())
+	assert.Nil(err)
+	assert.Equal(3, len(history))
+	assert.Equal(ErrReplayedValue, keyDb.Set(addr.String(), versions[2]))
+
+	err = keyDb.db.View(func(tx Tx) error {
+		for _, key := range keys {
+			assert.Nil(tx.Bucket(expiryIndexBucket).Get([]byte(key)))
+			assert.Nil(tx.Bucket(highWaterBucket).Get([]byte(key)))
+			assert.Nil(tx.Bucket(historyBucket).Bucket([]byte(key)))
+		}
+		assert.NotNil(tx.Bucket(expiryIndexBucket).Get([]byte("bchtest:foo")))
+		return nil
+	})
+	assert.Nil(err)
+}
+
+func TestCanonicalizeKeysBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	// More legacy keys than are merged in one transaction, every other one with only a
+	// high water mark, and one which isn't an address on this network
+	now := time.Now().Unix()
+	rawMetadata, err := proto.Marshal(&models.AddressMetadata{Payload: &models.Payload{Timestamp: now}})
+	assert.Nil(err)
+	var addresses []string
+	assert.Nil(keyDb.db.Update(func(tx Tx) error {
+		for i := 0; i <= keyDb.batchSize; i++ {
+			hash := sha256.Sum256([]byte{byte(i >> 8), byte(i)})
+			addr, err := bchutil.NewAddressPubKeyHash(hash[:20], &chaincfg.MainNetParams)
+			if err != nil {
+				return err
+			}
+			addresses = append(addresses, addr.EncodeAddress())
+			if i%2 == 0 {
+				err = raiseHighWater(tx, []byte(addr.EncodeAddress()), now)
+			} else {
+				err = keyDb.put(tx, []byte(addr.EncodeAddress()), rawMetadata, now, now+3600)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return keyDb.put(tx, []byte("bchtest:foo"), rawMetadata, now, now+3600)
+	}))
+
+	batches := 0
+	var after []byte
+	for {
+		assert.Nil(keyDb.db.Update(func(tx Tx) (err error) {
+			after, err = keyDb.canonicalizeKeys(tx, after)
+			return err
+		}))
+		batches++
+		if after == nil {
+			break
+		}
+	}
+	assert.Equal(2, batches)
+
+	assert.Nil(keyDb.db.View(func(tx Tx) error {
+		for i, address := range addresses {
+			key, err := keyid.Parse(address, &chaincfg.MainNetParams)
+			assert.Nil(err)
+			mark, ok := highWater(tx, key.Bytes())
+			assert.True(ok)
+			assert.Equal(now, mark)
+			assert.Nil(tx.Bucket(highWaterBucket).Get([]byte(address)))
+			_, err = keyDb.get(tx, key.Bytes())
+			assert.Equal(i%2 == 1, err == nil)
+		}
+		_, err := keyDb.get(tx, []byte("bchtest:foo"))
+		assert.Nil(err)
+		return nil
+	}))
+}
+
+func TestErrorKinds(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	addr, addrMetadata := GeneratePayload(assert, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: time.Now().Unix(),
+		},
+	})
+	key := "bitcoincash:" + addr.String()
+
+	_, err = keyDb.Get(key)
+	assert.Equal(KindNotFound, Kind(err))
+	assert.Equal(KindBadAddress, Kind(keyDb.Set("foo", addrMetadata)))
+
+	// Unknown schemes are rejected rather than verified
+	addrMetadata.Scheme = 7
+	assert.Equal(ErrUnknownScheme, errors.Cause(keyDb.Set(key, addrMetadata)))
+	addrMetadata.Scheme = models.AddressMetadata_ECDSA
+	assert.Equal(KindBadSignature, Kind(keyDb.Set(key, addrMetadata)))
+	addrMetadata.Scheme = models.AddressMetadata_SCHNORR
+
+	assert.Nil(keyDb.Set(key, addrMetadata))
+	assert.Equal(KindOutdated, Kind(keyDb.Set(key, addrMetadata)))
+	assert.Equal(KindInternal, Kind(errors.New("disk on fire")))
+}
+
+func TestFutureTimestamp(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory, MaxClockSkew: time.Minute})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now().Unix()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	addr, addrMetadata := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now + 3600,
+		},
+	})
+	err = keyDb.Set(addr.EncodeAddress(), addrMetadata)
+	assert.Equal(ErrFutureTimestamp, err)
+	assert.Equal(KindFutureTimestamp, Kind(err))
+
+	// Clocks a little ahead of ours are fine
+	addr, addrMetadata = SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now + 30,
+		},
+	})
+	assert.Nil(keyDb.Set(addr.EncodeAddress(), addrMetadata))
+}
+
+func TestRepair(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory, HistorySize: 10})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	addr, future := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now.Unix() + 86400,
+		},
+	})
+	key, err := keyid.Parse(addr.EncodeAddress(), &chaincfg.MainNetParams)
+	assert.Nil(err)
+
+	// Store a far-future record, as accepted before the clock skew was enforced
+	err = keyDb.db.Update(func(tx Tx) error {
+		rawMetadata, err := proto.Marshal(future)
+		if err != nil {
+			return err
+		}
+		return keyDb.put(tx, key.Bytes(), rawMetadata, future.GetPayload().GetTimestamp(), expiryOf(future))
+	})
+	assert.Nil(err)
+
+	// It blocks legitimate updates
+	_, update := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now.Unix() + 1,
+		},
+	})
+	assert.Equal(ErrReplayedValue, keyDb.Set(addr.EncodeAddress(), update))
+
+	// A dry run only reports it
+	found, err := keyDb.Repair(now, true)
+	assert.Nil(err)
+	assert.Equal([]FutureRecord{{Key: key.Encode(&chaincfg.MainNetParams), Timestamp: future.GetPayload().GetTimestamp()}}, found)
+	assert.Equal(ErrReplayedValue, keyDb.Set(addr.EncodeAddress(), update))
+
+	// Once flagged, the record is still served, but newer values replace it
+	found, err = keyDb.Repair(now, false)
+	assert.Nil(err)
+	assert.Equal(1, len(found))
+	fetchedMetadata, err := keyDb.Get(addr.EncodeAddress())
+	assert.Nil(err)
+	assert.True(proto.Equal(future, fetchedMetadata), "Flagged record should still be served")
+
+	assert.Nil(keyDb.Set(addr.EncodeAddress(), update))
+	fetchedMetadata, err = keyDb.Get(addr.EncodeAddress())
+	assert.Nil(err)
+	assert.True(proto.Equal(update, fetchedMetadata), "Fetch value did not match expected value")
+	history, err := keyDb.GetHistory(addr.EncodeAddress())
+	assert.Nil(err)
+	assert.Equal(1, len(history), "Flagged version should be dropped from history")
+
+	found, err = keyDb.Repair(now, false)
+	assert.Nil(err)
+	assert.Empty(found)
+}
+
+func TestLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	limits := Limits{
+		MaxEntries:   2,
+		MaxHeaders:   1,
+		MaxEntryData: 4,
+		MinTTL:       time.Hour,
+		MaxTTL:       24 * time.Hour,
+	}
+	entry := func(headers, data int) *models.Entry {
+		return &models.Entry{
+			Headers:   make([]*models.Header, headers),
+			EntryData: make([]byte, data),
+		}
+	}
+	for _, test := range []struct {
+		payload *models.Payload
+		ok      bool
+	}{
+		{&models.Payload{Ttl: 3600, Entries: []*models.Entry{entry(1, 4), entry(0, 0)}}, true},
+		{&models.Payload{Ttl: 3600, Entries: []*models.Entry{entry(0, 0), entry(0, 0), entry(0, 0)}}, false},
+		{&models.Payload{Ttl: 3600, Entries: []*models.Entry{entry(2, 0)}}, false},
+		{&models.Payload{Ttl: 3600, Entries: []*models.Entry{entry(0, 5)}}, false},
+		{&models.Payload{Ttl: 60}, false},
+		{&models.Payload{Ttl: 1 << 62}, false},
+		// The default TTL of a month is too long
+		{&models.Payload{}, false},
+	} {
+		err := limits.Check(&models.AddressMetadata{Payload: test.payload})
+		if test.ok {
+			assert.Nil(err)
+			continue
+		}
+		assert.Equal(ErrLimitExceeded, errors.Cause(err))
+		assert.Equal(KindLimitExceeded, Kind(err))
+	}
+	assert.Nil(Limits{}.Check(&models.AddressMetadata{Payload: &models.Payload{Ttl: 1 << 62}}))
+
+	keyDb, err := New(&Config{Driver: DriverMemory, Limits: limits})
+	assert.Nil(err)
+	defer keyDb.Close()
+	addr, addrMetadata := GeneratePayload(assert, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: time.Now().Unix(),
+		},
+	})
+	assert.Equal(KindLimitExceeded, Kind(keyDb.Set(addr.EncodeAddress(), addrMetadata)))
+}
+
+func TestSetIf(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now().Unix()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	var addr *bchutil.AddressPubKeyHash
+	var versions []*models.AddressMetadata
+	for i := int64(0); i < 3; i++ {
+		var metadata *models.AddressMetadata
+		addr, metadata = SignPayload(assert, privKey, &models.AddressMetadata{
+			Payload: &models.Payload{
+				Timestamp: now + i,
+			},
+		})
+		versions = append(versions, metadata)
+	}
+	key := addr.EncodeAddress()
+
+	// Nothing is stored yet
+	assert.Equal(ErrPreconditionFailed, keyDb.SetIf(key, versions[0], Condition{MatchAny: true}))
+	assert.Equal(ErrPreconditionFailed, keyDb.SetIf(key, versions[0], Condition{Match: []int64{now}}))
+	assert.Nil(keyDb.SetIf(key, versions[0], Condition{NoneMatchAny: true}))
+
+	// Now it is
+	assert.Equal(ErrPreconditionFailed, keyDb.SetIf(key, versions[1], Condition{NoneMatchAny: true}))
+	assert.Equal(ErrPreconditionFailed, keyDb.SetIf(key, versions[1], Condition{NoneMatch: []int64{now}}))
+	assert.Equal(ErrPreconditionFailed, keyDb.SetIf(key, versions[1], Condition{Match: []int64{}}))
+	assert.Nil(keyDb.SetIf(key, versions[1], Condition{Match: []int64{now - 1, now}}))
+
+	// Updating from a version which has since been replaced fails
+	assert.Equal(ErrPreconditionFailed, keyDb.SetIf(key, versions[2], Condition{Match: []int64{now}}))
+	assert.Equal(KindPreconditionFailed, Kind(keyDb.SetIf(key, versions[2], Condition{Match: []int64{now}})))
+	assert.Nil(keyDb.SetIf(key, versions[2], Condition{MatchAny: true, NoneMatch: []int64{now}}))
+
+	fetched, err := keyDb.Get(key)
+	assert.Nil(err)
+	assert.True(proto.Equal(versions[2], fetched), "Fetch value did not match expected value")
+}
+
+// SignDeletion returns a deletion of the address for privKey at timestamp
+func SignDeletion(assert *assert.Assertions, privKey *bchec.PrivateKey, addr bchutil.Address, timestamp int64) *models.Deletion {
+	key, err := keyid.FromAddress(addr)
+	assert.Nil(err)
+	msgHash := DeletionHash(key, timestamp)
+	sig, err := privKey.SignSchnorr(msgHash[:])
+	assert.Nil(err)
+	return &models.Deletion{
+		PubKey:    privKey.PubKey().SerializeUncompressed(),
+		Signature: sig.Serialize(),
+		Timestamp: timestamp,
+	}
+}
+
+func TestDelete(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory, HistorySize: 10})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now().Unix()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	addr, addrMetadata := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now - 10,
+		},
+	})
+	key := addr.EncodeAddress()
+
+	// There's nothing to delete yet
+	assert.Equal(ErrNotFound, errors.Cause(keyDb.Delete(key, SignDeletion(assert, privKey, addr, now))))
+	assert.Nil(keyDb.Set(key, addrMetadata))
+
+	// Deletions must be signed by the address's key, for this address, and be newer than
+	// the stored metadata
+	otherKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	assert.Equal(ErrPubkeyDoesNotMatch, keyDb.Delete(key, SignDeletion(assert, otherKey, addr, now)))
+	otherAddr, _ := SignPayload(assert, otherKey, &models.AddressMetadata{Payload: &models.Payload{}})
+	forged := SignDeletion(assert, privKey, otherAddr, now)
+	assert.Equal(ErrSignatureMismatch, keyDb.Delete(key, forged))
+	assert.Equal(ErrOutdatedValue, keyDb.Delete(key, SignDeletion(assert, privKey, addr, now-10)))
+	assert.Equal(ErrFutureTimestamp, keyDb.Delete(key, SignDeletion(assert, privKey, addr, now+86400)))
+
+	deletion := SignDeletion(assert, privKey, addr, now)
+	assert.Nil(keyDb.Delete(key, deletion))
+	_, err = keyDb.Get(key)
+	assert.Equal(KindNotFound, Kind(err))
+	_, err = keyDb.GetHistory(key)
+	assert.Equal(KindNotFound, Kind(err))
+
+	// The tombstone stops the old metadata coming back
+	assert.Equal(ErrReplayedValue, keyDb.Set(key, addrMetadata))
+	_, replayed := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now,
+		},
+	})
+	assert.Equal(ErrReplayedValue, keyDb.Set(key, replayed))
+	assert.Equal(ErrNotFound, errors.Cause(keyDb.Delete(key, deletion)))
+
+	// But newer metadata is accepted
+	_, newer := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now + 1,
+		},
+	})
+	assert.Nil(keyDb.Set(key, newer))
+}
+
+func TestDeleteExpired(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory, HistorySize: 10})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	// A record which has expired, but hasn't been collected yet
+	now := time.Now().Unix()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	addr, addrMetadata := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now - 120,
+			Ttl:       60,
+		},
+	})
+	address := addr.EncodeAddress()
+	key, err := keyid.FromAddress(addr)
+	assert.Nil(err)
+	rawMetadata, err := proto.Marshal(addrMetadata)
+	assert.Nil(err)
+	assert.Nil(keyDb.db.Update(func(tx Tx) error {
+		return keyDb.put(tx, key.Bytes(), rawMetadata, now-120, now-60)
+	}))
+
+	// Neither it nor its history are served
+	_, err = keyDb.Get(address)
+	assert.Equal(ErrExpiredTTL, err)
+	_, err = keyDb.GetHistory(address)
+	assert.Equal(ErrExpiredTTL, err)
+
+	// But its owner can still delete them
+	assert.Nil(keyDb.Delete(address, SignDeletion(assert, privKey, addr, now)))
+	assert.Nil(keyDb.db.View(func(tx Tx) error {
+		assert.Nil(tx.Bucket(historyBucket).Bucket(key.Bytes()))
+		_, err := keyDb.getRaw(tx, key.Bytes())
+		assert.Equal(ErrNotFound, errors.Cause(err))
+		return nil
+	}))
+	_, err = keyDb.GetHistory(address)
+	assert.Equal(KindNotFound, Kind(err))
+}
@@ -0,0 +1,153 @@
+package keydb
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/models"
+
+	"github.com/pkg/errors"
+)
+
+// kindsBucket holds one nested bucket per entry kind, mapping the key of every address
+// whose current metadata has an entry of that kind to the metadata's big-endian expiry.
+var kindsBucket = []byte("kinds")
+
+// MaxKindLength is the longest entry kind which is indexed.  Entries with longer kinds are
+// stored and served as usual, but can't be listed by their kind.
+const MaxKindLength = 255
+
+// ListKind returns up to limit addresses, in key order, whose unexpired metadata has an
+// entry of the given kind.  If after is set, listing starts after that address, so that
+// passing the last address of one page returns the next.
+func (db *KeyDB) ListKind(kind, after string, limit int) ([]string, error) {
+	if limit <= 0 {
+		return nil, errors.New("limit must be positive")
+	}
+	var start []byte
+	if after != "" {
+		key, err := db.parseKey(after)
+		if err != nil {
+			return nil, err
+		}
+		start = key.Bytes()
+	}
+	if !indexable(kind) {
+		return nil, nil
+	}
+
+	now := time.Now().Unix()
+	var addresses []string
+	err := db.db.View(func(tx Tx) error {
+		b := tx.Bucket(kindsBucket).Bucket([]byte(kind))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := seekAfter(c, start); k != nil && len(addresses) < limit; k, v = c.Next() {
+			// Expired records stay indexed until they're collected
+			if int64(binary.BigEndian.Uint64(v)) < now {
+				continue
+			}
+			if address, ok := db.address(k); ok {
+				addresses = append(addresses, address)
+			}
+		}
+		return nil
+	})
+	return addresses, err
+}
+
+// indexable reports whether entries of kind are indexed
+func indexable(kind string) bool {
+	return kind != "" && len(kind) <= MaxKindLength
+}
+
+// kindsOf returns the distinct, indexable kinds of the entries in metadata
+func kindsOf(metadata *models.AddressMetadata) []string {
+	var kinds []string
+	seen := map[string]bool{}
+	for _, entry := range metadata.GetPayload().GetEntries() {
+		kind := entry.GetKind()
+		if !indexable(kind) || seen[kind] {
+			continue
+		}
+		seen[kind] = true
+		kinds = append(kinds, kind)
+	}
+	return kinds
+}
+
+// indexKinds adds key to the index of each kind of entry in rawMetadata.  Migrations which
+// run before the index exists store records without indexing them, and the index is
+// built from them once it's created.
+func indexKinds(tx Tx, key, rawMetadata []byte, expiry int64) error {
+	index := tx.Bucket(kindsBucket)
+	if index == nil {
+		return nil
+	}
+	metadata, err := unmarshalMetadata(rawMetadata)
+	if err != nil {
+		return err
+	}
+	rawExpiry := make([]byte, 8)
+	binary.BigEndian.PutUint64(rawExpiry, uint64(expiry))
+	for _, kind := range kindsOf(metadata) {
+		b, err := index.CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return errors.Wrapf(err, "failed to create kind bucket")
+		}
+		if err := b.Put(key, rawExpiry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexKinds removes key from the index of each kind of entry in rawMetadata, dropping
+// kinds which no address has any more
+func unindexKinds(tx Tx, key, rawMetadata []byte) error {
+	index := tx.Bucket(kindsBucket)
+	if index == nil {
+		return nil
+	}
+	metadata, err := unmarshalMetadata(rawMetadata)
+	if err != nil {
+		return err
+	}
+	for _, kind := range kindsOf(metadata) {
+		b := index.Bucket([]byte(kind))
+		if b == nil {
+			continue
+		}
+		if err := b.Delete(key); err != nil {
+			return err
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			if err := index.DeleteBucket([]byte(kind)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createKindIndex creates the index of entry kinds.  Every stored record is then indexed
+// by indexRecordKinds.
+func createKindIndex(db *KeyDB, tx Tx) error {
+	_, err := tx.CreateBucketIfNotExists(kindsBucket)
+	return errors.Wrapf(err, "failed to create bucket")
+}
+
+// indexRecordKinds adds the record for key to the index of entry kinds
+func indexRecordKinds(db *KeyDB, tx Tx, key, rawEntry []byte) error {
+	entry, _ := decodeIndexEntry(rawEntry)
+	rawMetadata, err := db.get(tx, key)
+	if errors.Cause(err) == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return indexKinds(tx, key, rawMetadata, entry.expiry)
+}
@@ -0,0 +1,108 @@
+package keydb
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/keyid"
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/gcash/bchd/bchec"
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListKind(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now().Unix()
+	entries := func(kinds ...string) []*models.Entry {
+		var entries []*models.Entry
+		for _, kind := range kinds {
+			entries = append(entries, &models.Entry{Kind: kind})
+		}
+		return entries
+	}
+
+	canonical := func(address string) keyid.Key {
+		key, err := keyid.Parse(address, &chaincfg.MainNetParams)
+		assert.Nil(err)
+		return key
+	}
+
+	// Addresses are listed in key order, canonically encoded, a page at a time
+	var keys []keyid.Key
+	for i := 0; i < 5; i++ {
+		addr, addrMetadata := GeneratePayload(assert, &models.AddressMetadata{
+			Payload: &models.Payload{
+				Timestamp: now,
+				Ttl:       3600,
+				Entries:   entries("relay", "relay", ""),
+			},
+		})
+		assert.Nil(keyDb.Set(addr.EncodeAddress(), addrMetadata))
+		keys = append(keys, canonical(addr.EncodeAddress()))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i].Bytes(), keys[j].Bytes()) < 0
+	})
+	var addresses []string
+	for _, key := range keys {
+		addresses = append(addresses, key.Encode(&chaincfg.MainNetParams))
+	}
+	page, err := keyDb.ListKind("relay", "", 3)
+	assert.Nil(err)
+	assert.Equal(addresses[:3], page)
+	page, err = keyDb.ListKind("relay", page[len(page)-1], 3)
+	assert.Nil(err)
+	assert.Equal(addresses[3:], page)
+	page, err = keyDb.ListKind("", "", 3)
+	assert.Nil(err)
+	assert.Empty(page)
+
+	_, err = keyDb.ListKind("relay", "", 0)
+	assert.NotNil(err)
+	_, err = keyDb.ListKind("relay", "notanaddress", 1)
+	assert.NotNil(err)
+
+	// The index follows each address's current metadata
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	addr, first := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: now, Ttl: 3600, Entries: entries("vcard", "avatar")},
+	})
+	address := canonical(addr.EncodeAddress()).Encode(&chaincfg.MainNetParams)
+	assert.Nil(keyDb.Set(address, first))
+	page, err = keyDb.ListKind("vcard", "", 10)
+	assert.Nil(err)
+	assert.Equal([]string{address}, page)
+
+	_, second := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: now + 1, Ttl: 3600, Entries: entries("avatar")},
+	})
+	assert.Nil(keyDb.Set(address, second))
+	page, err = keyDb.ListKind("vcard", "", 10)
+	assert.Nil(err)
+	assert.Empty(page)
+	page, err = keyDb.ListKind("avatar", "", 10)
+	assert.Nil(err)
+	assert.Equal([]string{address}, page)
+
+	assert.Nil(keyDb.Delete(address, SignDeletion(assert, privKey, addr, now+2)))
+	page, err = keyDb.ListKind("avatar", "", 10)
+	assert.Nil(err)
+	assert.Empty(page)
+
+	// Collected records are dropped from the index
+	_, err = keyDb.Collect(time.Unix(now+7200, 0))
+	assert.Nil(err)
+	assert.Nil(keyDb.db.View(func(tx Tx) error {
+		assert.Nil(tx.Bucket(kindsBucket).Bucket([]byte("relay")))
+		return nil
+	}))
+}
@@ -0,0 +1,57 @@
+package keydb
+
+import (
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/models"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLimitExceeded indicates the metadata is larger than the KeyDB's limits allow
+var ErrLimitExceeded = errors.New("payload exceeds limits")
+
+// Limits bounds the metadata KeyDB accepts, so that a single update can't store an
+// unbounded amount of data.  Zero fields are unlimited.
+type Limits struct {
+	// MaxEntries is the number of entries allowed in a payload
+	MaxEntries int
+	// MaxHeaders is the number of headers allowed in each entry
+	MaxHeaders int
+	// MaxEntryData is the size in bytes allowed for each entry's data
+	MaxEntryData int
+	// MinTTL and MaxTTL bound the payload's TTL.  A payload without a TTL is checked
+	// against the default TTL of one month.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+}
+
+// Check returns ErrLimitExceeded, detailing the first limit exceeded, if metadata isn't
+// within the limits.
+func (l Limits) Check(metadata *models.AddressMetadata) error {
+	entries := metadata.GetPayload().GetEntries()
+	if l.MaxEntries > 0 && len(entries) > l.MaxEntries {
+		return errors.Wrapf(ErrLimitExceeded, "%d entries, at most %d allowed", len(entries), l.MaxEntries)
+	}
+	for i, entry := range entries {
+		if l.MaxHeaders > 0 && len(entry.GetHeaders()) > l.MaxHeaders {
+			return errors.Wrapf(ErrLimitExceeded, "entry %d has %d headers, at most %d allowed", i, len(entry.GetHeaders()), l.MaxHeaders)
+		}
+		if l.MaxEntryData > 0 && len(entry.GetEntryData()) > l.MaxEntryData {
+			return errors.Wrapf(ErrLimitExceeded, "entry %d has %d bytes of data, at most %d allowed", i, len(entry.GetEntryData()), l.MaxEntryData)
+		}
+	}
+
+	// Compare in seconds, as a hostile TTL can overflow a Duration
+	ttl := metadata.GetPayload().GetTtl()
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+	if l.MinTTL > 0 && ttl < int64(l.MinTTL/time.Second) {
+		return errors.Wrapf(ErrLimitExceeded, "ttl of %ds, at least %s required", ttl, l.MinTTL)
+	}
+	if l.MaxTTL > 0 && ttl > int64(l.MaxTTL/time.Second) {
+		return errors.Wrapf(ErrLimitExceeded, "ttl of %ds, at most %s allowed", ttl, l.MaxTTL)
+	}
+	return nil
+}
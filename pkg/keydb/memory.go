@@ -0,0 +1,267 @@
+package keydb
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var errStoreClosed = errors.New("store is closed")
+
+// memoryStore is a Store which keeps everything in memory.  Transactions are serialized
+// with a readers/writer lock, and updates keep an undo log so they can be rolled back.
+type memoryStore struct {
+	mu   sync.RWMutex
+	root *memBucket
+}
+
+// NewMemoryStore returns an empty in-memory Store
+func NewMemoryStore() Store {
+	return &memoryStore{root: newMemBucket()}
+}
+
+func (s *memoryStore) View(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.root == nil {
+		return errStoreClosed
+	}
+	return fn(&memBucketRef{tx: &memTx{}, b: s.root})
+}
+
+func (s *memoryStore) Update(fn func(Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.root == nil {
+		return errStoreClosed
+	}
+
+	tx := &memTx{writable: true}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+	if err := fn(&memBucketRef{tx: tx, b: s.root}); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.root = nil
+	return nil
+}
+
+// memTx tracks the changes made by a transaction so that they can be undone
+type memTx struct {
+	writable bool
+	undo     []func()
+}
+
+func (tx *memTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+}
+
+// memBucket holds the values and nested buckets of a bucket, along with their names in
+// sorted order for cursors.
+type memBucket struct {
+	names   []string
+	values  map[string][]byte
+	buckets map[string]*memBucket
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{
+		values:  make(map[string][]byte),
+		buckets: make(map[string]*memBucket),
+	}
+}
+
+func (b *memBucket) insertName(name string) {
+	i := sort.SearchStrings(b.names, name)
+	b.names = append(b.names, "")
+	copy(b.names[i+1:], b.names[i:])
+	b.names[i] = name
+}
+
+func (b *memBucket) removeName(name string) {
+	i := sort.SearchStrings(b.names, name)
+	if i < len(b.names) && b.names[i] == name {
+		b.names = append(b.names[:i], b.names[i+1:]...)
+	}
+}
+
+// memBucketRef is a bucket as seen from within a transaction.  The root bucket doubles
+// as the transaction itself.
+type memBucketRef struct {
+	tx *memTx
+	b  *memBucket
+}
+
+func (r *memBucketRef) Get(key []byte) []byte {
+	return r.b.values[string(key)]
+}
+
+func (r *memBucketRef) Put(key, value []byte) error {
+	if !r.tx.writable {
+		return ErrTxNotWritable
+	}
+	name := string(key)
+	if _, ok := r.b.buckets[name]; ok {
+		return ErrIncompatibleValue
+	}
+
+	b := r.b
+	prev, existed := b.values[name]
+	b.values[name] = append([]byte{}, value...)
+	if existed {
+		r.tx.undo = append(r.tx.undo, func() { b.values[name] = prev })
+		return nil
+	}
+	b.insertName(name)
+	r.tx.undo = append(r.tx.undo, func() {
+		delete(b.values, name)
+		b.removeName(name)
+	})
+	return nil
+}
+
+func (r *memBucketRef) Delete(key []byte) error {
+	if !r.tx.writable {
+		return ErrTxNotWritable
+	}
+	name := string(key)
+	if _, ok := r.b.buckets[name]; ok {
+		return ErrIncompatibleValue
+	}
+
+	b := r.b
+	prev, existed := b.values[name]
+	if !existed {
+		return nil
+	}
+	delete(b.values, name)
+	b.removeName(name)
+	r.tx.undo = append(r.tx.undo, func() {
+		b.values[name] = prev
+		b.insertName(name)
+	})
+	return nil
+}
+
+func (r *memBucketRef) Bucket(name []byte) Bucket {
+	nested, ok := r.b.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+	return &memBucketRef{tx: r.tx, b: nested}
+}
+
+func (r *memBucketRef) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if nested := r.Bucket(name); nested != nil {
+		return nested, nil
+	}
+	if !r.tx.writable {
+		return nil, ErrTxNotWritable
+	}
+	key := string(name)
+	if _, ok := r.b.values[key]; ok {
+		return nil, ErrIncompatibleValue
+	}
+
+	b := r.b
+	nested := newMemBucket()
+	b.buckets[key] = nested
+	b.insertName(key)
+	r.tx.undo = append(r.tx.undo, func() {
+		delete(b.buckets, key)
+		b.removeName(key)
+	})
+	return &memBucketRef{tx: r.tx, b: nested}, nil
+}
+
+func (r *memBucketRef) DeleteBucket(name []byte) error {
+	if !r.tx.writable {
+		return ErrTxNotWritable
+	}
+	key := string(name)
+	b := r.b
+	nested, ok := b.buckets[key]
+	if !ok {
+		if _, ok := b.values[key]; ok {
+			return ErrIncompatibleValue
+		}
+		return ErrBucketNotFound
+	}
+
+	delete(b.buckets, key)
+	b.removeName(key)
+	r.tx.undo = append(r.tx.undo, func() {
+		b.buckets[key] = nested
+		b.insertName(key)
+	})
+	return nil
+}
+
+func (r *memBucketRef) Cursor() Cursor {
+	return &memCursor{b: r.b}
+}
+
+// memCursor remembers the key it is positioned at rather than an index, so that it keeps
+// its place if the bucket is modified during iteration.
+type memCursor struct {
+	b   *memBucket
+	key *string
+}
+
+func (c *memCursor) First() ([]byte, []byte) {
+	return c.at(0)
+}
+
+func (c *memCursor) Last() ([]byte, []byte) {
+	return c.at(len(c.b.names) - 1)
+}
+
+func (c *memCursor) Next() ([]byte, []byte) {
+	if c.key == nil {
+		return nil, nil
+	}
+	i := sort.SearchStrings(c.b.names, *c.key)
+	if i < len(c.b.names) && c.b.names[i] == *c.key {
+		i++
+	}
+	return c.at(i)
+}
+
+func (c *memCursor) Prev() ([]byte, []byte) {
+	if c.key == nil {
+		return nil, nil
+	}
+	return c.at(sort.SearchStrings(c.b.names, *c.key) - 1)
+}
+
+func (c *memCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.at(sort.SearchStrings(c.b.names, string(seek)))
+}
+
+func (c *memCursor) at(i int) ([]byte, []byte) {
+	if i < 0 || i >= len(c.b.names) {
+		c.key = nil
+		return nil, nil
+	}
+	name := c.b.names[i]
+	c.key = &name
+	if _, ok := c.b.buckets[name]; ok {
+		return []byte(name), nil
+	}
+	return []byte(name), c.b.values[name]
+}
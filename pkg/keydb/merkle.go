@@ -0,0 +1,388 @@
+package keydb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/bits"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/keyid"
+	"github.com/cashweb/keyserver/pkg/models"
+
+	"github.com/pkg/errors"
+)
+
+// The sparse Merkle tree commits to every stored record, including expired records which
+// haven't been collected yet.  Each record is a leaf whose path is the SHA-256 of its key,
+// and whose value is the SHA-256 of its metadata as it's served.  A subtree holding no
+// leaves hashes to zero and one holding a single leaf hashes to that leaf, so only the
+// subtrees holding two or more leaves, whose hashes are kept in merkleNodesBucket, need
+// storing.  See docs/merkle.md.
+var (
+	// merkleLeavesBucket maps the path of each leaf to its value
+	merkleLeavesBucket = []byte("merkleLeaves")
+	// merkleNodesBucket maps the depth and path prefix of each subtree holding two or more
+	// leaves to its hash
+	merkleNodesBucket = []byte("merkleNodes")
+)
+
+// merkleDepth is the number of bits in a leaf's path
+const merkleDepth = sha256.Size * 8
+
+// ErrInvalidProof is returned when a Merkle proof doesn't prove what it's checked against
+var ErrInvalidProof = errors.New("invalid merkle proof")
+
+// emptyHash is the hash of a subtree without any leaves
+var emptyHash = make([]byte, sha256.Size)
+
+// MerkleRoot returns the root hash of the tree over every stored record
+func (db *KeyDB) MerkleRoot() ([]byte, error) {
+	var root []byte
+	err := db.db.View(func(tx Tx) error {
+		root = subtreeHash(tx, 0, emptyHash)
+		return nil
+	})
+	return root, err
+}
+
+// GetRawWithProof returns the same as GetRaw, along with a proof against the current root
+// of whether the address's metadata is in the tree.  The record and proof are read
+// together, so the proof always matches the record.  The proof is also returned along
+// with ErrNotFound, ErrExpiredTTL and ErrRevoked, so that clients can check the record
+// really is missing.
+func (db *KeyDB) GetRawWithProof(keyAddress string) (*RawRecord, *models.MerkleProof, error) {
+	key, err := db.parseKey(keyAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var record *RawRecord
+	var proof *models.MerkleProof
+	err = db.db.View(func(tx Tx) error {
+		proof = prove(tx, key.Bytes())
+		if revoked(tx, key.Bytes()) {
+			return ErrRevoked
+		}
+		var err error
+		record, err = db.getRaw(tx, key.Bytes())
+		return err
+	})
+	if err != nil {
+		return nil, proof, err
+	}
+	if record.expired(time.Now()) {
+		return nil, proof, ErrExpiredTTL
+	}
+	return record, proof, nil
+}
+
+// VerifyProof checks that proof shows the metadata stored under key is rawMetadata, or
+// that nothing is stored under it if rawMetadata is nil.  Callers should also check the
+// proof's root against one they trust, such as another keyserver's.
+func VerifyProof(proof *models.MerkleProof, key keyid.Key, rawMetadata []byte) error {
+	path := merklePath(key.Bytes())
+	siblings := proof.GetSiblings()
+	if len(siblings) >= merkleDepth {
+		return errors.Wrap(ErrInvalidProof, "too many siblings")
+	}
+
+	hash := emptyHash
+	if leafPath := proof.GetLeafPath(); leafPath != nil {
+		if len(leafPath) != sha256.Size || !hasPrefix(leafPath, path, len(siblings)) {
+			return errors.Wrap(ErrInvalidProof, "leaf is not beneath the key's position")
+		}
+		included := bytes.Equal(leafPath, path)
+		if rawMetadata == nil && included {
+			return errors.Wrap(ErrInvalidProof, "key is in the tree")
+		}
+		if rawMetadata != nil {
+			value := sha256.Sum256(rawMetadata)
+			if !included || !bytes.Equal(proof.GetLeafValue(), value[:]) {
+				return errors.Wrap(ErrInvalidProof, "metadata is not in the tree")
+			}
+		}
+		hash = leafHash(leafPath, proof.GetLeafValue())
+	} else if rawMetadata != nil {
+		return errors.Wrap(ErrInvalidProof, "metadata is not in the tree")
+	}
+
+	for depth := len(siblings) - 1; depth >= 0; depth-- {
+		if bit(path, depth) == 0 {
+			hash = nodeHash(hash, siblings[depth])
+		} else {
+			hash = nodeHash(siblings[depth], hash)
+		}
+	}
+	if !bytes.Equal(hash, proof.GetRoot()) {
+		return errors.Wrap(ErrInvalidProof, "root does not match")
+	}
+	return nil
+}
+
+// prove returns a proof of whether anything is stored under key
+func prove(tx Tx, key []byte) *models.MerkleProof {
+	proof := &models.MerkleProof{Root: subtreeHash(tx, 0, emptyHash)}
+	leaves := tx.Bucket(merkleLeavesBucket)
+	if leaves == nil {
+		return proof
+	}
+	path := merklePath(key)
+	for depth := 0; ; depth++ {
+		paths, values := subtreeLeaves(leaves, depth, prefixOf(path, depth))
+		if len(paths) < 2 {
+			if len(paths) == 1 {
+				proof.LeafPath, proof.LeafValue = paths[0], values[0]
+			}
+			return proof
+		}
+		sibling := prefixOf(path, depth+1)
+		flipBit(sibling, depth)
+		proof.Siblings = append(proof.Siblings, subtreeHash(tx, depth+1, sibling))
+	}
+}
+
+// updateMerkle sets the leaf for key to the hash of rawMetadata, or removes it if
+// rawMetadata is nil, and rehashes the subtrees on its path.  Migrations which run before
+// the tree exists leave it alone, and the tree is built once it's created.
+func updateMerkle(tx Tx, key, rawMetadata []byte) error {
+	leaves := tx.Bucket(merkleLeavesBucket)
+	nodes := tx.Bucket(merkleNodesBucket)
+	if leaves == nil || nodes == nil {
+		return nil
+	}
+
+	path := merklePath(key)
+	if rawMetadata == nil {
+		if err := leaves.Delete(path); err != nil {
+			return err
+		}
+	} else {
+		value := sha256.Sum256(rawMetadata)
+		if err := leaves.Put(path, value[:]); err != nil {
+			return err
+		}
+	}
+
+	// Nodes are only stored for subtrees holding two or more leaves, so any on the path
+	// below the deepest of those are stale
+	deepest := deepestNode(leaves, path)
+	for depth := deepest + 1; depth < merkleDepth; depth++ {
+		k := nodeKey(depth, prefixOf(path, depth))
+		if nodes.Get(k) == nil {
+			break
+		}
+		if err := nodes.Delete(k); err != nil {
+			return err
+		}
+	}
+	if deepest < 0 {
+		return nil
+	}
+
+	// Rehash the path from the bottom up.  Only the sibling of each subtree on the path
+	// needs looking up, and they're unchanged.
+	hash := subtreeHash(tx, deepest+1, prefixOf(path, deepest+1))
+	for depth := deepest; depth >= 0; depth-- {
+		sibling := prefixOf(path, depth+1)
+		flipBit(sibling, depth)
+		if bit(path, depth) == 0 {
+			hash = nodeHash(hash, subtreeHash(tx, depth+1, sibling))
+		} else {
+			hash = nodeHash(subtreeHash(tx, depth+1, sibling), hash)
+		}
+		if err := nodes.Put(nodeKey(depth, prefixOf(path, depth)), hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deepestNode returns the depth of the deepest subtree on path which holds two or more
+// leaves, or -1 if there isn't one.  The leaves sharing the most leading bits with path
+// are next to it in key order, so only those are looked at.
+func deepestNode(leaves Bucket, path []byte) int {
+	// Gather path, if it's a leaf, with enough of the leaves either side to find two
+	// sharing the most bits with it
+	var after [][]byte
+	c := leaves.Cursor()
+	k, _ := c.Seek(path)
+	present := bytes.Equal(k, path)
+	if present {
+		k, _ = c.Next()
+	}
+	want := 2
+	if present {
+		want = 1
+	}
+	for k != nil {
+		after = append(after, append([]byte{}, k...))
+		if len(after) == want {
+			break
+		}
+		k, _ = c.Next()
+	}
+
+	var before [][]byte
+	c = leaves.Cursor()
+	if k, _ = c.Seek(path); k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	for k != nil {
+		before = append([][]byte{append([]byte{}, k...)}, before...)
+		if len(before) == want {
+			break
+		}
+		k, _ = c.Prev()
+	}
+
+	run := before
+	if present {
+		run = append(run, path)
+	}
+	run = append(run, after...)
+
+	// The subtree at depth holds two or more leaves if two neighbouring leaves both share
+	// depth bits with path
+	deepest := -1
+	for i := 1; i < len(run); i++ {
+		depth := sharedBits(path, run[i-1])
+		if shared := sharedBits(path, run[i]); shared < depth {
+			depth = shared
+		}
+		if depth > deepest {
+			deepest = depth
+		}
+	}
+	return deepest
+}
+
+// subtreeHash returns the hash of the subtree at depth whose paths start with prefix
+func subtreeHash(tx Tx, depth int, prefix []byte) []byte {
+	leaves := tx.Bucket(merkleLeavesBucket)
+	if leaves == nil {
+		return emptyHash
+	}
+	// Nodes are stored for every subtree holding two or more leaves, so any other holds
+	// at most one
+	if depth < merkleDepth {
+		if hash := tx.Bucket(merkleNodesBucket).Get(nodeKey(depth, prefix)); hash != nil {
+			return append([]byte{}, hash...)
+		}
+	}
+	k, v := leaves.Cursor().Seek(prefix)
+	if k == nil || !hasPrefix(k, prefix, depth) {
+		return emptyHash
+	}
+	return leafHash(k, v)
+}
+
+// subtreeLeaves returns the paths and values of up to two of the leaves in the subtree at
+// depth whose paths start with prefix, which is enough to tell how it's hashed
+func subtreeLeaves(leaves Bucket, depth int, prefix []byte) ([][]byte, [][]byte) {
+	var paths, values [][]byte
+	c := leaves.Cursor()
+	for k, v := c.Seek(prefix); k != nil && len(paths) < 2 && hasPrefix(k, prefix, depth); k, v = c.Next() {
+		paths = append(paths, append([]byte{}, k...))
+		values = append(values, append([]byte{}, v...))
+	}
+	return paths, values
+}
+
+// merklePath returns the path of the leaf for key
+func merklePath(key []byte) []byte {
+	path := sha256.Sum256(key)
+	return path[:]
+}
+
+// leafHash returns the hash of the leaf at path with the given value
+func leafHash(path, value []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(path)
+	h.Write(value)
+	return h.Sum(nil)
+}
+
+// nodeHash returns the hash of a subtree holding two or more leaves from the hashes of
+// its children.  Leaves and nodes are hashed with different prefixes, so that one can't
+// be passed off as the other.
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// nodeKey returns the key of the node for the subtree at depth whose paths start with
+// prefix
+func nodeKey(depth int, prefix []byte) []byte {
+	return append([]byte{byte(depth)}, prefix...)
+}
+
+// bit returns the bit of path at depth, counting from the most significant
+func bit(path []byte, depth int) byte {
+	return path[depth/8] >> (7 - uint(depth%8)) & 1
+}
+
+// flipBit flips the bit of path at depth
+func flipBit(path []byte, depth int) {
+	path[depth/8] ^= 1 << (7 - uint(depth%8))
+}
+
+// prefixOf returns a copy of the first depth bits of path, padded with zeros
+func prefixOf(path []byte, depth int) []byte {
+	prefix := make([]byte, len(path))
+	copy(prefix, path[:depth/8])
+	if depth%8 != 0 {
+		prefix[depth/8] = path[depth/8] &^ (0xff >> uint(depth%8))
+	}
+	return prefix
+}
+
+// sharedBits returns the number of leading bits which paths a and b have in common
+func sharedBits(a, b []byte) int {
+	for i := range a {
+		if diff := a[i] ^ b[i]; diff != 0 {
+			return i*8 + bits.LeadingZeros8(diff)
+		}
+	}
+	return len(a) * 8
+}
+
+// hasPrefix reports whether the first depth bits of path and prefix match
+func hasPrefix(path, prefix []byte, depth int) bool {
+	if !bytes.Equal(path[:depth/8], prefix[:depth/8]) {
+		return false
+	}
+	if depth%8 == 0 {
+		return true
+	}
+	mask := byte(0xff) &^ (0xff >> uint(depth%8))
+	return path[depth/8]&mask == prefix[depth/8]&mask
+}
+
+// createMerkleTree creates the sparse Merkle tree.  Every stored record is then added to
+// it by addMerkleLeaf.
+func createMerkleTree(db *KeyDB, tx Tx) error {
+	for _, name := range [][]byte{merkleLeavesBucket, merkleNodesBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return errors.Wrapf(err, "failed to create bucket")
+		}
+	}
+	return nil
+}
+
+// addMerkleLeaf adds the record for key to the sparse Merkle tree
+func addMerkleLeaf(db *KeyDB, tx Tx, key, rawEntry []byte) error {
+	rawMetadata, err := db.get(tx, key)
+	if errors.Cause(err) == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return updateMerkle(tx, key, rawMetadata)
+}
@@ -0,0 +1,179 @@
+package keydb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/keyid"
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/gcash/bchd/bchec"
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// naiveRoot hashes a subtree from scratch, given the sorted paths and values of its leaves
+func naiveRoot(depth int, paths, values [][]byte) []byte {
+	switch len(paths) {
+	case 0:
+		return emptyHash
+	case 1:
+		return leafHash(paths[0], values[0])
+	}
+	split := sort.Search(len(paths), func(i int) bool { return bit(paths[i], depth) == 1 })
+	return nodeHash(
+		naiveRoot(depth+1, paths[:split], values[:split]),
+		naiveRoot(depth+1, paths[split:], values[split:]),
+	)
+}
+
+// naiveNodes returns the keys of the nodes for every subtree holding two or more of the
+// leaves at paths
+func naiveNodes(paths [][]byte) map[string]bool {
+	nodes := map[string]bool{}
+	for depth := 0; depth < merkleDepth; depth++ {
+		seen := map[string]bool{}
+		for _, path := range paths {
+			k := string(nodeKey(depth, prefixOf(path, depth)))
+			if seen[k] {
+				nodes[k] = true
+			}
+			seen[k] = true
+		}
+	}
+	return nodes
+}
+
+func TestMerkleTree(t *testing.T) {
+	assert := assert.New(t)
+
+	store := NewMemoryStore()
+	defer store.Close()
+	assert.Nil(store.Update(func(tx Tx) error {
+		for _, name := range [][]byte{merkleLeavesBucket, merkleNodesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	// The tree matches one built from scratch, however it's been updated
+	random := rand.New(rand.NewSource(1))
+	stored := map[string][]byte{}
+	for i := 0; i < 300; i++ {
+		key := keyid.Key{0, byte(random.Intn(100))}.Bytes()
+		metadata := []byte{byte(random.Intn(256))}
+		if random.Intn(3) == 0 {
+			metadata = nil
+			delete(stored, string(key))
+		} else {
+			stored[string(key)] = metadata
+		}
+		assert.Nil(store.Update(func(tx Tx) error {
+			return updateMerkle(tx, key, metadata)
+		}))
+
+		var paths, values [][]byte
+		for key, metadata := range stored {
+			value := sha256.Sum256(metadata)
+			paths = append(paths, merklePath([]byte(key)))
+			values = append(values, value[:])
+		}
+		sort.Sort(byPath{paths, values})
+		assert.Nil(store.View(func(tx Tx) error {
+			assert.Equal(naiveRoot(0, paths, values), subtreeHash(tx, 0, emptyHash))
+			// Nodes are kept for exactly the subtrees holding two or more leaves
+			nodes := map[string]bool{}
+			assert.Nil(forEach(tx.Bucket(merkleNodesBucket), func(k, v []byte) error {
+				nodes[string(k)] = true
+				return nil
+			}))
+			assert.Equal(naiveNodes(paths), nodes)
+			return nil
+		}))
+	}
+
+	// Every key can be proven present or absent, and nothing else
+	assert.Nil(store.View(func(tx Tx) error {
+		for i := 0; i < 100; i++ {
+			key := keyid.Key{0, byte(i)}
+			proof := prove(tx, key.Bytes())
+			metadata, ok := stored[string(key.Bytes())]
+			if ok {
+				assert.Nil(VerifyProof(proof, key, metadata))
+				assert.Equal(ErrInvalidProof, errors.Cause(VerifyProof(proof, key, nil)))
+				assert.Equal(ErrInvalidProof, errors.Cause(VerifyProof(proof, key, []byte("other"))))
+			} else {
+				assert.Nil(VerifyProof(proof, key, nil))
+				assert.Equal(ErrInvalidProof, errors.Cause(VerifyProof(proof, key, []byte("other"))))
+			}
+			if len(proof.Siblings) > 0 {
+				proof.Siblings[0] = emptyHash
+				assert.Equal(ErrInvalidProof, errors.Cause(VerifyProof(proof, key, metadata)))
+			}
+		}
+		return nil
+	}))
+}
+
+// byPath sorts leaves by their path
+type byPath struct {
+	paths, values [][]byte
+}
+
+func (b byPath) Len() int           { return len(b.paths) }
+func (b byPath) Less(i, j int) bool { return bytes.Compare(b.paths[i], b.paths[j]) < 0 }
+func (b byPath) Swap(i, j int) {
+	b.paths[i], b.paths[j] = b.paths[j], b.paths[i]
+	b.values[i], b.values[j] = b.values[j], b.values[i]
+}
+
+func TestGetRawWithProof(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	emptyRoot, err := keyDb.MerkleRoot()
+	assert.Nil(err)
+	assert.Equal(emptyHash, emptyRoot)
+
+	now := time.Now().Unix()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	addr, addrMetadata := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: now},
+	})
+	address := addr.EncodeAddress()
+	key, err := keyid.Parse(address, &chaincfg.MainNetParams)
+	assert.Nil(err)
+
+	_, proof, err := keyDb.GetRawWithProof(address)
+	assert.Equal(ErrNotFound, errors.Cause(err))
+	assert.Nil(VerifyProof(proof, key, nil))
+
+	rawMetadata, err := proto.Marshal(addrMetadata)
+	assert.Nil(err)
+	assert.Nil(keyDb.SetRaw(address, rawMetadata))
+	record, proof, err := keyDb.GetRawWithProof(address)
+	assert.Nil(err)
+	assert.Equal(rawMetadata, record.Metadata)
+	assert.Nil(VerifyProof(proof, key, record.Metadata))
+	root, err := keyDb.MerkleRoot()
+	assert.Nil(err)
+	assert.Equal(root, proof.GetRoot())
+
+	// Once the metadata's deleted, the tree is back to how it was
+	assert.Nil(keyDb.Delete(address, SignDeletion(assert, privKey, addr, now+1)))
+	_, proof, err = keyDb.GetRawWithProof(address)
+	assert.Equal(ErrNotFound, errors.Cause(err))
+	assert.Nil(VerifyProof(proof, key, nil))
+	assert.Equal(emptyRoot, proof.GetRoot())
+}
@@ -0,0 +1,172 @@
+package keydb
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/models"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// ErrMalformedMetadata indicates raw metadata which can't be decoded
+var ErrMalformedMetadata = errors.New("malformed metadata")
+
+// RawRecord is an address's metadata exactly as it was stored, along with the fields of it
+// which KeyDB indexes
+type RawRecord struct {
+	// Metadata is the serialized models.AddressMetadata, byte for byte as it was set
+	Metadata []byte
+	// Timestamp is the metadata's payload timestamp
+	Timestamp int64
+	// Expiry is the unix time after which the metadata is considered expired
+	Expiry int64
+}
+
+// expired reports whether the record has expired as of now
+func (r *RawRecord) expired(now time.Time) bool {
+	return r.Expiry < now.Unix()
+}
+
+// indexEntrySize is the size of the values in expiryIndexBucket: the name of the records
+// bucket holding the address, followed by the record's big-endian expiry and timestamp
+const indexEntrySize = 24
+
+// indexEntry is the value stored for an address in expiryIndexBucket.  It lets a record's
+// expiry and version be checked without decoding it.
+type indexEntry struct {
+	// bucket is the name of the nested records bucket holding the record
+	bucket []byte
+	// expiry is the unix time after which the record is considered expired
+	expiry int64
+	// timestamp is the record's payload timestamp
+	timestamp int64
+}
+
+func (e indexEntry) encode() []byte {
+	v := make([]byte, indexEntrySize)
+	copy(v, e.bucket)
+	binary.BigEndian.PutUint64(v[8:], uint64(e.expiry))
+	binary.BigEndian.PutUint64(v[16:], uint64(e.timestamp))
+	return v
+}
+
+// decodeIndexEntry decodes a value from expiryIndexBucket.  Entries written before the
+// expiry and timestamp were indexed only name the bucket, and are reported as not ok.
+func decodeIndexEntry(v []byte) (indexEntry, bool) {
+	if len(v) != indexEntrySize {
+		return indexEntry{bucket: v[:8]}, false
+	}
+	return indexEntry{
+		bucket:    v[:8],
+		expiry:    int64(binary.BigEndian.Uint64(v[8:])),
+		timestamp: int64(binary.BigEndian.Uint64(v[16:])),
+	}, true
+}
+
+// SetRaw is Set for serialized metadata.  The bytes are stored exactly as given, so that
+// GetRaw returns them byte for byte.
+func (db *KeyDB) SetRaw(keyAddress string, rawMetadata []byte) error {
+	return db.SetRawIf(keyAddress, rawMetadata, Condition{}, nil)
+}
+
+// SetRawIf is SetIf for serialized metadata, as SetRaw is to Set.  If receipt isn't nil,
+// it's stored alongside the record, with its ReceivedAt filled in if it's unset.
+func (db *KeyDB) SetRawIf(keyAddress string, rawMetadata []byte, cond Condition, receipt *models.Receipt) error {
+	metadata := &models.AddressMetadata{}
+	if err := proto.Unmarshal(rawMetadata, metadata); err != nil {
+		return errors.Wrap(ErrMalformedMetadata, err.Error())
+	}
+	return db.setIf(keyAddress, metadata, rawMetadata, cond, receipt)
+}
+
+// GetRaw returns an address's metadata exactly as it was stored, without decoding it.
+// Like Get, it returns ErrExpiredTTL once the metadata has expired.
+func (db *KeyDB) GetRaw(keyAddress string) (*RawRecord, error) {
+	key, err := db.parseKey(keyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	cached, generation := db.cache.get(key)
+	if cached != nil {
+		if cached.expired(now) {
+			db.cache.invalidate(key)
+			return nil, ErrExpiredTTL
+		}
+		return cached.copy(), nil
+	}
+
+	var record *RawRecord
+	err = db.db.View(func(tx Tx) error {
+		if revoked(tx, key.Bytes()) {
+			return ErrRevoked
+		}
+		var err error
+		record, err = db.getRaw(tx, key.Bytes())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if record.expired(now) {
+		return nil, ErrExpiredTTL
+	}
+	db.cache.add(key, record, generation)
+	return record.copy(), nil
+}
+
+// getRaw returns the record stored under key, copied out of the transaction
+func (db *KeyDB) getRaw(tx Tx, key []byte) (*RawRecord, error) {
+	rawEntry := tx.Bucket(expiryIndexBucket).Get(key)
+	if rawEntry == nil {
+		return nil, errors.Wrap(ErrNotFound, "failed to find address metadata")
+	}
+	entry, ok := decodeIndexEntry(rawEntry)
+	if !ok {
+		return nil, errors.Errorf("malformed index entry for %x", key)
+	}
+	rawMetadata, err := db.get(tx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &RawRecord{
+		Metadata:  append([]byte{}, rawMetadata...),
+		Timestamp: entry.timestamp,
+		Expiry:    entry.expiry,
+	}, nil
+}
+
+// copy returns a copy of the record which its caller is free to modify
+func (r *RawRecord) copy() *RawRecord {
+	c := *r
+	c.Metadata = append([]byte{}, r.Metadata...)
+	return &c
+}
+
+// indexRecord adds the expiry and timestamp of the record for key to its entry in
+// expiryIndexBucket, for databases written before they were indexed.  Entries whose
+// record is missing are dropped.
+func indexRecord(db *KeyDB, tx Tx, key, rawEntry []byte) error {
+	entry, ok := decodeIndexEntry(rawEntry)
+	if ok {
+		return nil
+	}
+	index := tx.Bucket(expiryIndexBucket)
+	rawMetadata, err := db.get(tx, key)
+	if errors.Cause(err) == ErrNotFound {
+		return index.Delete(key)
+	}
+	if err != nil {
+		return err
+	}
+	metadata, err := unmarshalMetadata(rawMetadata)
+	if err != nil {
+		return errors.Wrapf(err, "failed to index record %x", key)
+	}
+	entry.expiry = expiryOf(metadata)
+	entry.timestamp = metadata.GetPayload().GetTimestamp()
+	return index.Put(key, entry.encode())
+}
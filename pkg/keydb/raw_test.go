@@ -0,0 +1,52 @@
+package keydb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetGetRaw(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory, CacheSize: 10})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now().Unix()
+	addr, addrMetadata := GeneratePayload(assert, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now,
+			Ttl:       3600,
+		},
+	})
+	rawMetadata, err := proto.Marshal(addrMetadata)
+	assert.Nil(err)
+	// Append the scheme encoded as a non-minimal zero, which re-marshalling would drop
+	rawMetadata = append(rawMetadata, 0x18, 0x80, 0x00)
+	decoded, err := unmarshalMetadata(rawMetadata)
+	assert.Nil(err)
+	remarshalled, err := proto.Marshal(decoded)
+	assert.Nil(err)
+	assert.NotEqual(rawMetadata, remarshalled)
+
+	assert.Equal(ErrMalformedMetadata, errors.Cause(keyDb.SetRaw(addr.EncodeAddress(), []byte{0xff})))
+	assert.Nil(keyDb.SetRaw(addr.EncodeAddress(), rawMetadata))
+
+	// Reads are byte-identical to what was set, whether or not they're cached
+	for i := 0; i < 2; i++ {
+		record, err := keyDb.GetRaw(addr.EncodeAddress())
+		assert.Nil(err)
+		assert.Equal(&RawRecord{Metadata: rawMetadata, Timestamp: now, Expiry: now + 3600}, record)
+		record.Metadata[0] ^= 0xff
+	}
+	fetched, err := keyDb.Get(addr.EncodeAddress())
+	assert.Nil(err)
+	assert.Equal(addrMetadata.GetSignature(), fetched.GetSignature())
+	assert.True(proto.Equal(addrMetadata.GetPayload(), fetched.GetPayload()), "Fetch value did not match expected value")
+	assert.Equal(CacheStats{Hits: 2, Misses: 1, Entries: 1, Capacity: 10}, keyDb.CacheStats())
+}
@@ -0,0 +1,63 @@
+package keydb
+
+import (
+	"github.com/cashweb/keyserver/pkg/models"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// receiptsBucket maps each key to the marshalled Receipt for its current record
+var receiptsBucket = []byte("receipts")
+
+// GetReceipt returns the receipt stored with an address's current record, or ErrNotFound
+// if there is none.  Records stored before receipts were kept have none.
+func (db *KeyDB) GetReceipt(keyAddress string) (*models.Receipt, error) {
+	key, err := db.parseKey(keyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &models.Receipt{}
+	err = db.db.View(func(tx Tx) error {
+		rawReceipt := tx.Bucket(receiptsBucket).Get(key.Bytes())
+		if rawReceipt == nil {
+			return errors.Wrap(ErrNotFound, "failed to find receipt")
+		}
+		return proto.Unmarshal(rawReceipt, receipt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// putReceipt stores receipt for the record just stored under key.  If receipt is nil, as
+// the write's provenance isn't known, the previous record's receipt is kept.
+func putReceipt(tx Tx, key []byte, receipt *models.Receipt) error {
+	if receipt == nil {
+		return nil
+	}
+	rawReceipt, err := proto.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(receiptsBucket).Put(key, rawReceipt)
+}
+
+// deleteReceipt drops the receipt for key.  Migrations which run before receipts are kept
+// have none to drop.
+func deleteReceipt(tx Tx, key []byte) error {
+	receipts := tx.Bucket(receiptsBucket)
+	if receipts == nil {
+		return nil
+	}
+	return receipts.Delete(key)
+}
+
+// createReceipts creates the bucket receipts are kept in.  Records stored before then have
+// none.
+func createReceipts(db *KeyDB, tx Tx) error {
+	_, err := tx.CreateBucketIfNotExists(receiptsBucket)
+	return errors.Wrapf(err, "failed to create bucket")
+}
@@ -0,0 +1,72 @@
+package keydb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/gcash/bchd/bchec"
+	"github.com/gcash/bchutil"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceipts(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now().Unix()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	var addr *bchutil.AddressPubKeyHash
+	sign := func(timestamp int64) []byte {
+		var addrMetadata *models.AddressMetadata
+		addr, addrMetadata = SignPayload(assert, privKey, &models.AddressMetadata{
+			Payload: &models.Payload{Timestamp: timestamp, Ttl: 60},
+		})
+		rawMetadata, err := proto.Marshal(addrMetadata)
+		assert.Nil(err)
+		return rawMetadata
+	}
+	first := sign(now)
+	address := addr.EncodeAddress()
+
+	// The receipt is stored with the record, and its arrival time filled in
+	receipt := &models.Receipt{RequestId: "request", RemoteAddr: "192.0.2.1"}
+	assert.Nil(keyDb.SetRawIf(address, first, Condition{}, receipt))
+	stored, err := keyDb.GetReceipt(address)
+	assert.Nil(err)
+	assert.Equal("request", stored.GetRequestId())
+	assert.Equal("192.0.2.1", stored.GetRemoteAddr())
+	assert.InDelta(time.Now().Unix(), stored.GetReceivedAt(), 5)
+	assert.Zero(receipt.GetReceivedAt())
+
+	// Rejected writes leave it alone, as do accepted writes without one
+	assert.Equal(ErrReplayedValue, errors.Cause(keyDb.SetRawIf(address, sign(now-1), Condition{}, &models.Receipt{})))
+	stored, err = keyDb.GetReceipt(address)
+	assert.Nil(err)
+	assert.Equal("request", stored.GetRequestId())
+	assert.Nil(keyDb.SetRaw(address, sign(now+1)))
+	stored, err = keyDb.GetReceipt(address)
+	assert.Nil(err)
+	assert.Equal("request", stored.GetRequestId())
+
+	// It goes along with the record when it's deleted or collected
+	assert.Nil(keyDb.SetRawIf(address, sign(now+2), Condition{}, receipt))
+	assert.Nil(keyDb.Delete(address, SignDeletion(assert, privKey, addr, now+3)))
+	_, err = keyDb.GetReceipt(address)
+	assert.Equal(ErrNotFound, errors.Cause(err))
+
+	assert.Nil(keyDb.SetRawIf(address, sign(now+4), Condition{}, receipt))
+	_, err = keyDb.Collect(time.Unix(now+7200, 0))
+	assert.Nil(err)
+	_, err = keyDb.GetReceipt(address)
+	assert.Equal(ErrNotFound, errors.Cause(err))
+
+	_, err = keyDb.GetReceipt("notanaddress")
+	assert.Equal(ErrInvalidAddress, errors.Cause(err))
+}
@@ -0,0 +1,102 @@
+package keydb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/keyid"
+	"github.com/cashweb/keyserver/pkg/models"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// ErrRevoked indicates the address's key has been revoked, so nothing more is accepted
+// or served for it
+var ErrRevoked = errors.New("key has been revoked")
+
+// revocationDomain separates the messages signed for revocations from those signed for
+// metadata and deletions
+const revocationDomain = "keyserver-revocation\x00"
+
+// Revoke permanently revokes an address's key, if revocation is signed by it.  The
+// address's metadata and history are dropped, and from then on Get returns ErrRevoked and
+// the revocation is served by GetRevocation instead.  A revocation can't be replaced or
+// removed.
+func (db *KeyDB) Revoke(keyAddress string, revocation *models.Revocation) error {
+	key, err := db.parseKey(keyAddress)
+	if err != nil {
+		return err
+	}
+
+	if revocation.GetTimestamp() > time.Now().Unix()+db.maxClockSkew {
+		return ErrFutureTimestamp
+	}
+
+	msgHash := RevocationHash(key, revocation.GetTimestamp(), revocation.GetReason())
+	if err := db.verify(key, revocation, msgHash[:]); err != nil {
+		return err
+	}
+
+	rawRevocation, err := proto.Marshal(revocation)
+	if err != nil {
+		return err
+	}
+	return db.updateKey(key, func(tx Tx) error {
+		if revoked(tx, key.Bytes()) {
+			return ErrRevoked
+		}
+		if err := tx.Bucket(revocationsBucket).Put(key.Bytes(), rawRevocation); err != nil {
+			return err
+		}
+
+		if err := deleteRecord(tx, key.Bytes()); err != nil {
+			return err
+		}
+		if err := unflag(tx, key.Bytes()); err != nil {
+			return err
+		}
+		err := tx.Bucket(historyBucket).DeleteBucket(key.Bytes())
+		if err != nil && err != ErrBucketNotFound {
+			return err
+		}
+		return db.appendChange(tx, key.Bytes(), models.Change_REVOKE, revocation.GetTimestamp())
+	})
+}
+
+// GetRevocation returns the revocation of an address's key, or ErrNotFound if it hasn't
+// been revoked
+func (db *KeyDB) GetRevocation(keyAddress string) (*models.Revocation, error) {
+	key, err := db.parseKey(keyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	revocation := &models.Revocation{}
+	err = db.db.View(func(tx Tx) error {
+		rawRevocation := tx.Bucket(revocationsBucket).Get(key.Bytes())
+		if rawRevocation == nil {
+			return errors.Wrap(ErrNotFound, "failed to find revocation")
+		}
+		return proto.Unmarshal(rawRevocation, revocation)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revocation, nil
+}
+
+// RevocationHash returns the hash signed by a revocation of key at timestamp
+func RevocationHash(key keyid.Key, timestamp int64, reason string) [sha256.Size]byte {
+	msg := append([]byte(revocationDomain), key.Bytes()...)
+	rawTimestamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(rawTimestamp, uint64(timestamp))
+	msg = append(msg, rawTimestamp...)
+	return sha256.Sum256(append(msg, reason...))
+}
+
+// revoked reports whether key has been revoked
+func revoked(tx Tx, key []byte) bool {
+	return tx.Bucket(revocationsBucket).Get(key) != nil
+}
@@ -0,0 +1,90 @@
+package keydb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/keyid"
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/gcash/bchd/bchec"
+	"github.com/gcash/bchutil"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// SignRevocation returns a revocation of the address for privKey
+func SignRevocation(assert *assert.Assertions, privKey *bchec.PrivateKey, addr bchutil.Address, timestamp int64, reason string) *models.Revocation {
+	key, err := keyid.FromAddress(addr)
+	assert.Nil(err)
+	msgHash := RevocationHash(key, timestamp, reason)
+	sig, err := privKey.SignSchnorr(msgHash[:])
+	assert.Nil(err)
+	return &models.Revocation{
+		PubKey:    privKey.PubKey().SerializeUncompressed(),
+		Signature: sig.Serialize(),
+		Timestamp: timestamp,
+		Reason:    reason,
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	assert := assert.New(t)
+
+	keyDb, err := New(&Config{Driver: DriverMemory, HistorySize: 10})
+	assert.Nil(err)
+	defer keyDb.Close()
+
+	now := time.Now().Unix()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	addr, addrMetadata := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now,
+		},
+	})
+	key := addr.EncodeAddress()
+	assert.Nil(keyDb.Set(key, addrMetadata))
+
+	_, err = keyDb.GetRevocation(key)
+	assert.Equal(ErrNotFound, errors.Cause(err))
+
+	// The reason is covered by the signature
+	revocation := SignRevocation(assert, privKey, addr, now, "lost my phone")
+	tampered := proto.Clone(revocation).(*models.Revocation)
+	tampered.Reason = "nothing to see here"
+	assert.Equal(ErrSignatureMismatch, keyDb.Revoke(key, tampered))
+	// As is the kind of message, so a deletion can't be passed off as a revocation
+	deletion := SignDeletion(assert, privKey, addr, now)
+	assert.Equal(ErrSignatureMismatch, keyDb.Revoke(key, &models.Revocation{
+		PubKey:    deletion.PubKey,
+		Signature: deletion.Signature,
+		Timestamp: now,
+	}))
+
+	assert.Nil(keyDb.Revoke(key, revocation))
+	fetched, err := keyDb.GetRevocation(key)
+	assert.Nil(err)
+	assert.True(proto.Equal(revocation, fetched), "Fetch value did not match expected value")
+
+	// Nothing else is served or accepted for the address from then on
+	_, err = keyDb.Get(key)
+	assert.Equal(ErrRevoked, err)
+	assert.Equal(KindRevoked, Kind(err))
+	_, err = keyDb.GetHistory(key)
+	assert.Equal(ErrRevoked, err)
+	_, newer := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now + 1,
+		},
+	})
+	assert.Equal(ErrRevoked, keyDb.Set(key, newer))
+	assert.Equal(ErrRevoked, keyDb.Delete(key, SignDeletion(assert, privKey, addr, now+1)))
+	assert.Equal(ErrRevoked, keyDb.Revoke(key, SignRevocation(assert, privKey, addr, now+1, "")))
+
+	// Revocations outlive garbage collection
+	_, err = keyDb.Collect(time.Now().Add(365 * 24 * time.Hour))
+	assert.Nil(err)
+	_, err = keyDb.GetRevocation(key)
+	assert.Nil(err)
+}
@@ -0,0 +1,265 @@
+package keydb
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// metaBucket holds information about the database itself, such as its schema version
+	metaBucket = []byte("meta")
+	// schemaVersionKey maps to the big-endian number of migrations applied to the database
+	schemaVersionKey = []byte("schemaVersion")
+	// migrationProgressKey maps to the key last returned by the pending migration's batch,
+	// while it's part way through
+	migrationProgressKey = []byte("migrationProgress")
+)
+
+// ErrSchemaTooNew is returned when opening a database written by a newer version of KeyDB,
+// whose layout this version doesn't understand
+var ErrSchemaTooNew = errors.New("database schema is newer than this version supports")
+
+// ErrSchemaOutdated is returned by Open for a database which has migrations pending
+var ErrSchemaOutdated = errors.New("database schema is out of date")
+
+// errDryRun rolls back the transaction a dry run is made in
+var errDryRun = errors.New("dry run")
+
+// Migration describes a step in the upgrade of the database layout
+type Migration struct {
+	// Version is the schema version of a database once the migration is applied
+	Version int
+	// Name describes the migration
+	Name string
+}
+
+// migration is a step in the upgrade of the database layout.  Each one is applied within a
+// single transaction, along with the bump to the schema version, unless it touches every
+// record.  Those are applied in batches of records, as described at defaultBatchSize.
+type migration struct {
+	name string
+	// migrate, if set, is applied first
+	migrate func(db *KeyDB, tx Tx) error
+	// batch, if set, is then applied repeatedly, each time in its own transaction, until
+	// it returns nil.  It's passed the key it last returned, or nil the first time, and
+	// picks up after it.
+	batch func(db *KeyDB, tx Tx, after []byte) ([]byte, error)
+}
+
+// migrations upgrade the database layout, in order.  A database's schema version is the
+// number which have been applied to it.  Databases written before versions were recorded
+// are at version 0, whatever their layout, so every migration must be safe to apply to
+// them.  Migrations are only ever appended.
+var migrations = []migration{
+	{"create buckets", createBuckets, nil},
+	{"move records out of the legacy addressMetadata bucket", nil, (*KeyDB).upgradeLegacyBucket},
+	{"canonicalize keys", nil, (*KeyDB).canonicalizeKeys},
+	{"index record expiry and timestamps", nil, eachRecord(indexRecord)},
+	{"index entry kinds", createKindIndex, eachRecord(indexRecordKinds)},
+	{"create the change feed", createFeed, nil},
+	{"build the merkle tree", createMerkleTree, eachRecord(addMerkleLeaf)},
+	{"create the receipts bucket", createReceipts, nil},
+}
+
+// SchemaVersion is the schema version of databases written by this version of KeyDB
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// Migrate applies any pending migrations to the database described by config, returning
+// those which were applied.  New migrates the database itself, so this is only needed to
+// inspect or test an upgrade without opening the database for use.
+//
+// If dryRun is set, the migrations are run within a single transaction and then rolled
+// back, leaving the database untouched.  That transaction isn't split into batches, so a
+// dry run against a large badger database can fail with ErrTxnTooBig, or take far longer
+// than the upgrade itself, even though the upgrade would succeed.
+func Migrate(config *Config, dryRun bool) ([]Migration, error) {
+	db, err := open(config)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return db.migrate(dryRun)
+}
+
+// Open returns a KeyDB for the database described by config without migrating it, for
+// tools which read or copy a database and mustn't change its layout along the way.  It
+// returns ErrSchemaOutdated if any migrations are pending, unless the database is empty,
+// in which case it is created at the current schema version.  Unlike New, it doesn't
+// collect garbage.
+func Open(config *Config) (*KeyDB, error) {
+	db, err := open(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var empty bool
+	var version int
+	err = db.db.View(func(tx Tx) error {
+		name, _ := tx.Cursor().First()
+		empty = name == nil
+		if meta := tx.Bucket(metaBucket); meta != nil {
+			version = schemaVersion(meta)
+		}
+		return nil
+	})
+	switch {
+	case err != nil:
+	case empty:
+		_, err = db.migrate(false)
+	case version < len(migrations):
+		err = errors.Wrapf(ErrSchemaOutdated, "version %d, %d is current", version, len(migrations))
+	case version > len(migrations):
+		err = errors.Wrapf(ErrSchemaTooNew, "version %d, at most %d supported", version, len(migrations))
+	}
+	if err != nil {
+		db.db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrate applies any pending migrations, one transaction at a time, or all of them in a
+// single transaction which is rolled back if dryRun is set.
+func (db *KeyDB) migrate(dryRun bool) ([]Migration, error) {
+	var applied []Migration
+	if dryRun {
+		err := db.update(func(tx Tx) error {
+			applied = applied[:0]
+			for {
+				m, done, err := db.migrateStep(tx)
+				if err != nil {
+					return err
+				}
+				if m == nil {
+					return errDryRun
+				}
+				if done {
+					applied = append(applied, *m)
+				}
+			}
+		})
+		if err != errDryRun {
+			return nil, err
+		}
+		return applied, nil
+	}
+
+	for {
+		var m *Migration
+		var done bool
+		err := db.update(func(tx Tx) (err error) {
+			m, done, err = db.migrateStep(tx)
+			return err
+		})
+		if err != nil {
+			return applied, err
+		}
+		if m == nil {
+			return applied, nil
+		}
+		if !done {
+			continue
+		}
+		log.Info().Int("version", m.Version).Msgf("applied migration: %s", m.Name)
+		applied = append(applied, *m)
+	}
+}
+
+// migrateStep applies the next pending migration within tx, or the next batch of its
+// records, and reports whether it's finished.  It returns nil once there are none left.
+func (db *KeyDB) migrateStep(tx Tx) (*Migration, bool, error) {
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to create bucket")
+	}
+	version := schemaVersion(meta)
+	if version > len(migrations) {
+		return nil, false, errors.Wrapf(ErrSchemaTooNew, "version %d, at most %d supported", version, len(migrations))
+	}
+	if version == len(migrations) {
+		return nil, false, nil
+	}
+
+	next := migrations[version]
+	m := &Migration{Version: version + 1, Name: next.name}
+	progress := meta.Get(migrationProgressKey)
+	if progress == nil && next.migrate != nil {
+		if err := next.migrate(db, tx); err != nil {
+			return nil, false, errors.Wrapf(err, "migration %d (%s) failed", version+1, next.name)
+		}
+	}
+	if next.batch != nil {
+		last, err := next.batch(db, tx, progress)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "migration %d (%s) failed", version+1, next.name)
+		}
+		if last != nil {
+			return m, false, meta.Put(migrationProgressKey, last)
+		}
+		if err := meta.Delete(migrationProgressKey); err != nil {
+			return nil, false, err
+		}
+	}
+
+	rawVersion := make([]byte, 8)
+	binary.BigEndian.PutUint64(rawVersion, uint64(version+1))
+	if err := meta.Put(schemaVersionKey, rawVersion); err != nil {
+		return nil, false, err
+	}
+	return m, true, nil
+}
+
+// eachRecord returns a migration batch which applies fn to the key and index entry of
+// every record
+func eachRecord(fn func(db *KeyDB, tx Tx, key, rawEntry []byte) error) func(*KeyDB, Tx, []byte) ([]byte, error) {
+	return func(db *KeyDB, tx Tx, after []byte) ([]byte, error) {
+		return migrateRecords(db, tx, fn, after)
+	}
+}
+
+// migrateRecords applies fn to up to a batch of records with keys after after.  It
+// returns the key of the last one if there may be more left, or nil otherwise.
+func migrateRecords(db *KeyDB, tx Tx, fn func(db *KeyDB, tx Tx, key, rawEntry []byte) error, after []byte) ([]byte, error) {
+	// Gather the keys first, as migrations may modify the index
+	var keys, entries [][]byte
+	c := tx.Bucket(expiryIndexBucket).Cursor()
+	for k, v := seekAfter(c, after); k != nil && len(keys) < db.batchSize; k, v = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+		entries = append(entries, append([]byte{}, v...))
+	}
+	for i, k := range keys {
+		if err := fn(db, tx, k, entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	if len(keys) < db.batchSize {
+		return nil, nil
+	}
+	return keys[len(keys)-1], nil
+}
+
+// schemaVersion returns the number of migrations applied to the database
+func schemaVersion(meta Bucket) int {
+	rawVersion := meta.Get(schemaVersionKey)
+	if rawVersion == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(rawVersion))
+}
+
+// createBuckets ensures our buckets exist.  Records are kept in buckets ordered by their
+// expiry time so that garbage collection can drop whole buckets at once.  Wallets can
+// readvertise occasionally if they want to keep their metadata up to date and online.
+func createBuckets(db *KeyDB, tx Tx) error {
+	for _, name := range [][]byte{recordsBucket, expiryIndexBucket, highWaterBucket, historyBucket, flaggedBucket, revocationsBucket} {
+		_, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create bucket")
+		}
+	}
+	return nil
+}
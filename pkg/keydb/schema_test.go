@@ -0,0 +1,389 @@
+package keydb
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/keyid"
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// legacyStore returns a bolt database holding a single record written the way databases
+// were before versions were recorded
+func legacyStore(assert *assert.Assertions, dir string) (string, string, *models.AddressMetadata) {
+	dbPath := filepath.Join(dir, "legacy.db")
+	addr, addrMetadata := GeneratePayload(assert, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: time.Now().Unix(),
+			Entries:   []*models.Entry{{Kind: "relay"}},
+		},
+	})
+	rawMetadata, err := proto.Marshal(addrMetadata)
+	assert.Nil(err)
+
+	store, err := NewBoltStore(dbPath)
+	assert.Nil(err)
+	defer store.Close()
+	assert.Nil(store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(addressMetadataBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(addr.EncodeAddress()), rawMetadata)
+	}))
+	return dbPath, addr.EncodeAddress(), addrMetadata
+}
+
+func TestMigrationSteps(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "example")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	dbPath, address, addrMetadata := legacyStore(assert, dir)
+	key, err := keyid.Parse(address, &chaincfg.MainNetParams)
+	assert.Nil(err)
+
+	db, err := open(&Config{DBPath: dbPath, HistorySize: 10})
+	assert.Nil(err)
+	defer db.Close()
+
+	// Each step is checked once it, and only it, has been applied
+	checks := []func(tx Tx){
+		// create buckets
+		func(tx Tx) {
+			for _, name := range [][]byte{recordsBucket, expiryIndexBucket, highWaterBucket, historyBucket, flaggedBucket, revocationsBucket} {
+				assert.NotNil(tx.Bucket(name), string(name))
+			}
+			assert.NotNil(tx.Bucket(addressMetadataBucket))
+		},
+		// move records out of the legacy addressMetadata bucket
+		func(tx Tx) {
+			assert.Nil(tx.Bucket(addressMetadataBucket))
+			_, err := db.get(tx, []byte(address))
+			assert.Nil(err)
+		},
+		// canonicalize keys
+		func(tx Tx) {
+			_, err := db.get(tx, []byte(address))
+			assert.Equal(ErrNotFound, errors.Cause(err))
+			rawMetadata, err := db.get(tx, key.Bytes())
+			assert.Nil(err)
+			metadata, err := unmarshalMetadata(rawMetadata)
+			assert.Nil(err)
+			assert.True(proto.Equal(addrMetadata, metadata), "Migrated value did not match expected value")
+		},
+		// index record expiry and timestamps
+		func(tx Tx) {
+			record, err := db.getRaw(tx, key.Bytes())
+			assert.Nil(err)
+			assert.Equal(addrMetadata.GetPayload().GetTimestamp(), record.Timestamp)
+			assert.Equal(expiryOf(addrMetadata), record.Expiry)
+			assert.Nil(tx.Bucket(kindsBucket))
+		},
+		// index entry kinds
+		func(tx Tx) {
+			kind := tx.Bucket(kindsBucket).Bucket([]byte("relay"))
+			assert.NotNil(kind)
+			assert.NotNil(kind.Get(key.Bytes()))
+			assert.Nil(tx.Bucket(feedBucket))
+		},
+		// create the change feed
+		func(tx Tx) {
+			assert.NotNil(tx.Bucket(feedBucket))
+			assert.Equal(uint64(0), feedSequence(tx))
+			assert.Equal(emptyHash, subtreeHash(tx, 0, emptyHash))
+		},
+		// build the merkle tree
+		func(tx Tx) {
+			rawMetadata, err := db.get(tx, key.Bytes())
+			assert.Nil(err)
+			assert.Nil(VerifyProof(prove(tx, key.Bytes()), key, rawMetadata))
+			assert.Nil(tx.Bucket(receiptsBucket))
+		},
+		// create the receipts bucket
+		func(tx Tx) {
+			assert.NotNil(tx.Bucket(receiptsBucket))
+		},
+	}
+	assert.Equal(SchemaVersion(), len(checks), "Every migration needs a test")
+
+	for i, check := range checks {
+		assert.Nil(db.db.Update(func(tx Tx) error {
+			m, done, err := db.migrateStep(tx)
+			assert.Nil(err)
+			assert.True(done)
+			assert.Equal(&Migration{Version: i + 1, Name: migrations[i].name}, m)
+			check(tx)
+			assert.Equal(i+1, schemaVersion(tx.Bucket(metaBucket)))
+			return nil
+		}))
+	}
+	assert.Nil(db.db.Update(func(tx Tx) error {
+		m, _, err := db.migrateStep(tx)
+		assert.Nil(err)
+		assert.Nil(m)
+		return nil
+	}))
+}
+
+func TestMigrateBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := open(&Config{Driver: DriverMemory})
+	assert.Nil(err)
+	defer db.Close()
+
+	// Store more records than are migrated in one transaction before the kinds are indexed
+	for {
+		var m *Migration
+		assert.Nil(db.db.Update(func(tx Tx) (err error) {
+			m, _, err = db.migrateStep(tx)
+			return err
+		}))
+		if m.Name == "index record expiry and timestamps" {
+			break
+		}
+	}
+	now := time.Now().Unix()
+	rawMetadata, err := proto.Marshal(&models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: now,
+			Entries:   []*models.Entry{{Kind: "relay"}},
+		},
+	})
+	assert.Nil(err)
+	records := db.batchSize + 1
+	var last keyid.Key
+	assert.Nil(db.db.Update(func(tx Tx) error {
+		for i := 0; i < records; i++ {
+			last = keyid.Key{0, byte(i >> 8), byte(i)}
+			if err := db.put(tx, last.Bytes(), rawMetadata, now, now+3600); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	// The first batch leaves the migration pending
+	assert.Nil(db.db.Update(func(tx Tx) error {
+		m, done, err := db.migrateStep(tx)
+		assert.Nil(err)
+		assert.Equal("index entry kinds", m.Name)
+		assert.False(done)
+		assert.Equal(4, schemaVersion(tx.Bucket(metaBucket)))
+		return nil
+	}))
+	applied, err := db.migrate(false)
+	assert.Nil(err)
+	assert.Equal(SchemaVersion()-4, len(applied))
+
+	assert.Nil(db.db.View(func(tx Tx) error {
+		assert.Nil(tx.Bucket(metaBucket).Get(migrationProgressKey))
+		indexed := 0
+		assert.Nil(forEach(tx.Bucket(kindsBucket).Bucket([]byte("relay")), func(k, v []byte) error {
+			indexed++
+			return nil
+		}))
+		assert.Equal(records, indexed)
+		assert.Nil(VerifyProof(prove(tx, last.Bytes()), last, rawMetadata))
+		return nil
+	}))
+}
+
+func TestMigrateRecords(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := New(&Config{Driver: DriverMemory})
+	assert.Nil(err)
+	defer db.Close()
+
+	now := time.Now().Unix()
+	rawMetadata, err := proto.Marshal(&models.AddressMetadata{Payload: &models.Payload{Timestamp: now}})
+	assert.Nil(err)
+	records := db.batchSize + 1
+	assert.Nil(db.db.Update(func(tx Tx) error {
+		for i := 0; i < records; i++ {
+			key := keyid.Key{0, byte(i >> 8), byte(i)}.Bytes()
+			if err := db.put(tx, key, rawMetadata, now, now+3600); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	// Records are visited in batches, each picking up after the last
+	var visited [][]byte
+	visit := func(db *KeyDB, tx Tx, key, rawEntry []byte) error {
+		visited = append(visited, key)
+		return nil
+	}
+	var last []byte
+	assert.Nil(db.db.Update(func(tx Tx) (err error) {
+		last, err = migrateRecords(db, tx, visit, nil)
+		return err
+	}))
+	assert.Equal(db.batchSize, len(visited))
+	assert.Equal(visited[len(visited)-1], last)
+	assert.Nil(db.db.Update(func(tx Tx) (err error) {
+		last, err = migrateRecords(db, tx, visit, last)
+		return err
+	}))
+	assert.Nil(last)
+	assert.Equal(records, len(visited))
+	lastIndex := records - 1
+	assert.Equal(keyid.Key{0, byte(lastIndex >> 8), byte(lastIndex)}.Bytes(), visited[lastIndex])
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "example")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	dbPath, address, addrMetadata := legacyStore(assert, dir)
+
+	// A dry run reports every migration, but leaves the database untouched
+	applied, err := Migrate(&Config{DBPath: dbPath}, true)
+	assert.Nil(err)
+	assert.Equal(SchemaVersion(), len(applied))
+	store, err := NewBoltStore(dbPath)
+	assert.Nil(err)
+	assert.Nil(store.View(func(tx Tx) error {
+		assert.Nil(tx.Bucket(metaBucket))
+		assert.Nil(tx.Bucket(recordsBucket))
+		assert.NotNil(tx.Bucket(addressMetadataBucket))
+		return nil
+	}))
+	assert.Nil(store.Close())
+
+	applied, err = Migrate(&Config{DBPath: dbPath}, false)
+	assert.Nil(err)
+	assert.Equal(SchemaVersion(), len(applied))
+
+	// Once migrated, there's nothing left to do
+	applied, err = Migrate(&Config{DBPath: dbPath}, true)
+	assert.Nil(err)
+	assert.Empty(applied)
+
+	keyDb, err := New(&Config{DBPath: dbPath})
+	assert.Nil(err)
+	defer keyDb.Close()
+	fetchedMetadata, err := keyDb.Get(address)
+	assert.Nil(err)
+	assert.True(proto.Equal(addrMetadata, fetchedMetadata), "Fetch value did not match expected value")
+}
+
+func TestOpen(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "example")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	dbPath, address, addrMetadata := legacyStore(assert, dir)
+
+	// An out of date database is refused, and left as it was
+	_, err = Open(&Config{DBPath: dbPath})
+	assert.Equal(ErrSchemaOutdated, errors.Cause(err))
+	store, err := NewBoltStore(dbPath)
+	assert.Nil(err)
+	assert.Nil(store.View(func(tx Tx) error {
+		assert.Nil(tx.Bucket(metaBucket))
+		assert.NotNil(tx.Bucket(addressMetadataBucket))
+		return nil
+	}))
+	assert.Nil(store.Close())
+
+	// Once it's upgraded, it opens
+	_, err = Migrate(&Config{DBPath: dbPath}, false)
+	assert.Nil(err)
+	keyDb, err := Open(&Config{DBPath: dbPath})
+	assert.Nil(err)
+	fetchedMetadata, err := keyDb.Get(address)
+	assert.Nil(err)
+	assert.True(proto.Equal(addrMetadata, fetchedMetadata), "Fetch value did not match expected value")
+	keyDb.Close()
+
+	// As does a new database
+	keyDb, err = Open(&Config{DBPath: filepath.Join(dir, "new.db")})
+	assert.Nil(err)
+	_, err = keyDb.Get(address)
+	assert.Equal(ErrNotFound, errors.Cause(err))
+	keyDb.Close()
+}
+
+func TestSchemaTooNew(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "example")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "future.db")
+
+	store, err := NewBoltStore(dbPath)
+	assert.Nil(err)
+	assert.Nil(store.Update(func(tx Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		rawVersion := make([]byte, 8)
+		binary.BigEndian.PutUint64(rawVersion, uint64(SchemaVersion()+1))
+		return meta.Put(schemaVersionKey, rawVersion)
+	}))
+	assert.Nil(store.Close())
+
+	_, err = New(&Config{DBPath: dbPath})
+	assert.Equal(ErrSchemaTooNew, errors.Cause(err))
+}
+
+func TestIndexRecords(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := open(&Config{Driver: DriverMemory})
+	assert.Nil(err)
+	defer db.Close()
+
+	addr, addrMetadata := GeneratePayload(assert, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: time.Now().Unix(),
+			Ttl:       60,
+		},
+	})
+	key, err := keyid.FromAddress(addr)
+	assert.Nil(err)
+	rawMetadata, err := proto.Marshal(addrMetadata)
+	assert.Nil(err)
+	name := db.bucketName(expiryOf(addrMetadata))
+	dangling := []byte("dangling")
+
+	// Index entries used to only name the records bucket
+	assert.Nil(db.db.Update(func(tx Tx) error {
+		assert.Nil(createBuckets(db, tx))
+		b, err := tx.Bucket(recordsBucket).CreateBucketIfNotExists(name)
+		assert.Nil(err)
+		assert.Nil(b.Put(key.Bytes(), rawMetadata))
+		assert.Nil(tx.Bucket(expiryIndexBucket).Put(key.Bytes(), name))
+		assert.Nil(tx.Bucket(expiryIndexBucket).Put(dangling, name))
+		_, err = migrateRecords(db, tx, indexRecord, nil)
+		return err
+	}))
+
+	assert.Nil(db.db.View(func(tx Tx) error {
+		record, err := db.getRaw(tx, key.Bytes())
+		assert.Nil(err)
+		assert.Equal(rawMetadata, record.Metadata)
+		assert.Equal(addrMetadata.GetPayload().GetTimestamp(), record.Timestamp)
+		assert.Equal(expiryOf(addrMetadata), record.Expiry)
+		assert.Nil(tx.Bucket(expiryIndexBucket).Get(dangling))
+		return nil
+	}))
+}
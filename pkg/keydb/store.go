@@ -0,0 +1,224 @@
+package keydb
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	// DriverBolt stores keys in a bbolt database file at Config.DBPath
+	DriverBolt = "bolt"
+	// DriverMemory stores keys in memory.  Nothing is persisted once the KeyDB is closed.
+	DriverMemory = "memory"
+	// DriverBadger stores keys in a badger LSM tree in the directory at Config.DBPath.  It
+	// suits write-heavy nodes, as writes are appended to a log rather than rewriting
+	// pages in place.
+	DriverBadger = "badger"
+)
+
+// Work which touches every record, such as migrations and garbage collection, is split
+// into batches of records, each written in its own transaction, as backends may limit how
+// much a single transaction can write.  Badger's transactions also slow down as they
+// grow, as every cursor opened within one sorts the writes made so far, so it gets much
+// smaller batches.
+const (
+	defaultBatchSize = 1000
+	badgerBatchSize  = 50
+)
+
+var (
+	// ErrBucketNotFound is returned when deleting a bucket which doesn't exist
+	ErrBucketNotFound = errors.New("bucket not found")
+	// ErrIncompatibleValue is returned when a key is used as both a value and a bucket
+	ErrIncompatibleValue = errors.New("incompatible value")
+	// ErrTxNotWritable is returned when modifying a store within a read-only transaction
+	ErrTxNotWritable = errors.New("tx not writable")
+	// ErrUnknownDriver is returned when a Config names a driver which doesn't exist
+	ErrUnknownDriver = errors.New("unknown storage driver")
+	// ErrStoreNotEmpty is returned when copying into a store which already holds data
+	ErrStoreNotEmpty = errors.New("store is not empty")
+)
+
+// Store is a transactional key/value store whose keys are kept in order within nested
+// buckets.  KeyDB handles validation and the layout of records on top of a Store, so a
+// backend only has to provide storage.
+type Store interface {
+	// View runs fn within a read-only transaction
+	View(fn func(Tx) error) error
+	// Update runs fn within a read-write transaction.  If fn returns an error, none of
+	// its changes are applied.  Stores which allow concurrent writers may run fn more
+	// than once if it conflicts with another transaction.  Work which touches every
+	// record should be split across several, as described at defaultBatchSize.
+	Update(fn func(Tx) error) error
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// Tx is a transaction against a Store.  Slices returned by a transaction, and the buckets
+// and cursors created within it, are only valid until the transaction ends.
+type Tx interface {
+	// Bucket returns the top-level bucket with the given name, or nil if it doesn't exist
+	Bucket(name []byte) Bucket
+	// CreateBucketIfNotExists returns the named top-level bucket, creating it if needed
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	// DeleteBucket removes a top-level bucket and everything within it
+	DeleteBucket(name []byte) error
+	// Cursor iterates over the names of the top-level buckets
+	Cursor() Cursor
+}
+
+// Bucket is an ordered collection of key/value pairs and nested buckets
+type Bucket interface {
+	// Get returns the value of key, or nil if it doesn't exist or is a nested bucket
+	Get(key []byte) []byte
+	// Put sets the value of key
+	Put(key, value []byte) error
+	// Delete removes key.  Deleting a key which doesn't exist is not an error.
+	Delete(key []byte) error
+	// Bucket returns the nested bucket with the given name, or nil if it doesn't exist
+	Bucket(name []byte) Bucket
+	// CreateBucketIfNotExists returns the named nested bucket, creating it if needed
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	// DeleteBucket removes a nested bucket and everything within it
+	DeleteBucket(name []byte) error
+	// Cursor iterates over the bucket in key order.  Nested buckets are returned with a
+	// nil value.
+	Cursor() Cursor
+}
+
+// Cursor iterates over a bucket in key order.  Each method returns a nil key once the
+// cursor has moved past either end of the bucket.
+type Cursor interface {
+	First() (key []byte, value []byte)
+	Last() (key []byte, value []byte)
+	Next() (key []byte, value []byte)
+	Prev() (key []byte, value []byte)
+	// Seek moves to the first key at or after seek
+	Seek(seek []byte) (key []byte, value []byte)
+}
+
+// OpenStore opens the storage backend selected by config
+func OpenStore(config *Config) (Store, error) {
+	switch config.Driver {
+	case "", DriverBolt:
+		if config.DBPath == "" {
+			return nil, errors.New("no DBPath provided in config")
+		}
+		return NewBoltStore(config.DBPath)
+	case DriverMemory:
+		return NewMemoryStore(), nil
+	case DriverBadger:
+		if config.DBPath == "" {
+			return nil, errors.New("no DBPath provided in config")
+		}
+		return NewBadgerStore(config.DBPath)
+	}
+	return nil, errors.Wrapf(ErrUnknownDriver, "driver %q", config.Driver)
+}
+
+// forEach calls fn for every key in b, in order.  Nested buckets are passed with a nil value.
+func forEach(b Bucket, fn func(k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBatchSize is the number of writes CopyStore commits in each transaction
+const copyBatchSize = 1000
+
+// CopyStore copies every bucket and value in src into dst, which must be empty.  Writes
+// are committed to dst in batches, as described at defaultBatchSize, which means a failed
+// copy can leave dst partially written.
+func CopyStore(dst, src Store) error {
+	err := dst.View(func(tx Tx) error {
+		if name, _ := tx.Cursor().First(); name != nil {
+			return ErrStoreNotEmpty
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	batch := &copyBatch{dst: dst}
+	err = src.View(func(tx Tx) error {
+		c := tx.Cursor()
+		for name, _ := c.First(); name != nil; name, _ = c.Next() {
+			if err := batch.copyBucket([][]byte{name}, tx.Bucket(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return batch.flush()
+}
+
+// copyWrite creates the bucket at path, and sets key to value within it if key is set
+type copyWrite struct {
+	path       [][]byte
+	key, value []byte
+}
+
+type copyBatch struct {
+	dst    Store
+	writes []copyWrite
+}
+
+func (c *copyBatch) copyBucket(path [][]byte, b Bucket) error {
+	if err := c.add(copyWrite{path: path}); err != nil {
+		return err
+	}
+	return forEach(b, func(k, v []byte) error {
+		if v == nil {
+			nested := append(append([][]byte{}, path...), append([]byte{}, k...))
+			return c.copyBucket(nested, b.Bucket(k))
+		}
+		return c.add(copyWrite{
+			path:  path,
+			key:   append([]byte{}, k...),
+			value: append([]byte{}, v...),
+		})
+	})
+}
+
+func (c *copyBatch) add(write copyWrite) error {
+	c.writes = append(c.writes, write)
+	if len(c.writes) < copyBatchSize {
+		return nil
+	}
+	return c.flush()
+}
+
+func (c *copyBatch) flush() error {
+	err := c.dst.Update(func(tx Tx) error {
+		for _, write := range c.writes {
+			b, err := tx.CreateBucketIfNotExists(write.path[0])
+			if err != nil {
+				return err
+			}
+			for _, name := range write.path[1:] {
+				if b, err = b.CreateBucketIfNotExists(name); err != nil {
+					return err
+				}
+			}
+			if write.key == nil {
+				continue
+			}
+			if err := b.Put(write.key, write.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to copy into store")
+	}
+	c.writes = c.writes[:0]
+	return nil
+}
@@ -0,0 +1,443 @@
+package keydb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/gcash/bchd/bchec"
+	"github.com/gcash/bchutil"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// storeFactories opens a fresh, empty instance of every storage backend.  Each one must
+// pass the conformance tests below.
+var storeFactories = map[string]func(t *testing.T) (*Config, func()){
+	DriverBolt: func(t *testing.T) (*Config, func()) {
+		dir, err := ioutil.TempDir("", "example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := &Config{
+			Driver: DriverBolt,
+			DBPath: filepath.Join(dir, "conformance.db"),
+		}
+		return cfg, func() { os.RemoveAll(dir) }
+	},
+	DriverMemory: func(t *testing.T) (*Config, func()) {
+		return &Config{Driver: DriverMemory}, func() {}
+	},
+	DriverBadger: func(t *testing.T) (*Config, func()) {
+		dir, err := ioutil.TempDir("", "example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := &Config{
+			Driver: DriverBadger,
+			DBPath: dir,
+		}
+		return cfg, func() { os.RemoveAll(dir) }
+	},
+}
+
+func TestStoreConformance(t *testing.T) {
+	for driver, factory := range storeFactories {
+		factory := factory
+		t.Run(driver, func(t *testing.T) {
+			t.Run("Values", func(t *testing.T) { withStore(t, factory, testStoreValues) })
+			t.Run("NestedBuckets", func(t *testing.T) { withStore(t, factory, testStoreNestedBuckets) })
+			t.Run("Cursor", func(t *testing.T) { withStore(t, factory, testStoreCursor) })
+			t.Run("Rollback", func(t *testing.T) { withStore(t, factory, testStoreRollback) })
+			t.Run("ReadOnly", func(t *testing.T) { withStore(t, factory, testStoreReadOnly) })
+			t.Run("KeyDB", func(t *testing.T) { withKeyDB(t, factory, testKeyDBConformance) })
+			t.Run("ConcurrentSet", func(t *testing.T) { withKeyDB(t, factory, testKeyDBConcurrentSet) })
+			t.Run("Backup", func(t *testing.T) { withKeyDB(t, factory, testKeyDBBackup) })
+		})
+	}
+}
+
+func withStore(t *testing.T, factory func(t *testing.T) (*Config, func()), test func(*assert.Assertions, Store)) {
+	cfg, cleanup := factory(t)
+	defer cleanup()
+	store, err := OpenStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	test(assert.New(t), store)
+}
+
+func withKeyDB(t *testing.T, factory func(t *testing.T) (*Config, func()), test func(*assert.Assertions, *KeyDB)) {
+	cfg, cleanup := factory(t)
+	defer cleanup()
+	cfg.BucketWidth = time.Minute
+	cfg.HistorySize = 2
+	keyDb, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyDb.Close()
+	test(assert.New(t), keyDb)
+}
+
+func testStoreValues(assert *assert.Assertions, store Store) {
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("bucket"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("a"), []byte("1")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("b"), []byte("2")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("a"), []byte("3")); err != nil {
+			return err
+		}
+		return b.Delete([]byte("b"))
+	})
+	assert.Nil(err)
+
+	err = store.View(func(tx Tx) error {
+		assert.Nil(tx.Bucket([]byte("missing")))
+		b := tx.Bucket([]byte("bucket"))
+		assert.NotNil(b)
+		assert.Equal([]byte("3"), b.Get([]byte("a")))
+		assert.Nil(b.Get([]byte("b")))
+		assert.Nil(b.Get([]byte("c")))
+		return nil
+	})
+	assert.Nil(err)
+}
+
+func testStoreNestedBuckets(assert *assert.Assertions, store Store) {
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("parent"))
+		if err != nil {
+			return err
+		}
+		nested, err := b.CreateBucketIfNotExists([]byte("child"))
+		if err != nil {
+			return err
+		}
+		if err := nested.Put([]byte("k"), []byte("v")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("value"), []byte("v")); err != nil {
+			return err
+		}
+
+		// Keys can't be both a value and a bucket
+		assert.Equal(ErrIncompatibleValue, b.Put([]byte("child"), []byte("v")))
+		_, err = b.CreateBucketIfNotExists([]byte("value"))
+		assert.Equal(ErrIncompatibleValue, err)
+		assert.Equal(ErrBucketNotFound, b.DeleteBucket([]byte("missing")))
+		return nil
+	})
+	assert.Nil(err)
+
+	err = store.View(func(tx Tx) error {
+		b := tx.Bucket([]byte("parent"))
+		assert.Nil(b.Get([]byte("child")), "buckets have no value")
+		assert.Equal([]byte("v"), b.Bucket([]byte("child")).Get([]byte("k")))
+		assert.Nil(b.Bucket([]byte("value")))
+		return nil
+	})
+	assert.Nil(err)
+
+	err = store.Update(func(tx Tx) error {
+		if err := tx.Bucket([]byte("parent")).DeleteBucket([]byte("child")); err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte("parent"))
+	})
+	assert.Nil(err)
+
+	err = store.View(func(tx Tx) error {
+		assert.Nil(tx.Bucket([]byte("parent")))
+		return nil
+	})
+	assert.Nil(err)
+}
+
+func testStoreCursor(assert *assert.Assertions, store Store) {
+	err := store.Update(func(tx Tx) error {
+		for _, name := range []string{"second", "first"} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		b := tx.Bucket([]byte("first"))
+		for _, k := range []string{"d", "b", "a"} {
+			if err := b.Put([]byte(k), []byte(k+k)); err != nil {
+				return err
+			}
+		}
+		// Nested buckets are listed once, without their contents
+		nested, err := b.CreateBucketIfNotExists([]byte("c"))
+		if err != nil {
+			return err
+		}
+		return nested.Put([]byte("x"), []byte("xx"))
+	})
+	assert.Nil(err)
+
+	err = store.View(func(tx Tx) error {
+		var names []string
+		c := tx.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			names = append(names, string(k))
+		}
+		assert.Equal([]string{"first", "second"}, names)
+
+		var keys, values []string
+		err := forEach(tx.Bucket([]byte("first")), func(k, v []byte) error {
+			keys = append(keys, string(k))
+			values = append(values, string(v))
+			return nil
+		})
+		assert.Nil(err)
+		assert.Equal([]string{"a", "b", "c", "d"}, keys)
+		assert.Equal([]string{"aa", "bb", "", "dd"}, values)
+
+		c = tx.Bucket([]byte("first")).Cursor()
+		k, v := c.Last()
+		assert.Equal("d", string(k))
+		assert.Equal("dd", string(v))
+		k, v = c.Prev()
+		assert.Equal("c", string(k))
+		assert.Nil(v, "buckets have no value")
+		k, _ = c.Seek([]byte("bb"))
+		assert.Equal("c", string(k))
+		k, _ = c.Seek([]byte("b"))
+		assert.Equal("b", string(k))
+		k, _ = c.Seek([]byte("e"))
+		assert.Nil(k)
+		k, _ = c.First()
+		assert.Equal("a", string(k))
+		k, _ = c.Prev()
+		assert.Nil(k)
+		return nil
+	})
+	assert.Nil(err)
+}
+
+func testStoreRollback(assert *assert.Assertions, store Store) {
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("bucket"))
+		if err != nil {
+			return err
+		}
+		if _, err := b.CreateBucketIfNotExists([]byte("nested")); err != nil {
+			return err
+		}
+		return b.Put([]byte("kept"), []byte("1"))
+	})
+	assert.Nil(err)
+
+	failure := errors.New("failure")
+	err = store.Update(func(tx Tx) error {
+		b := tx.Bucket([]byte("bucket"))
+		if err := b.Put([]byte("kept"), []byte("2")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("added"), []byte("2")); err != nil {
+			return err
+		}
+		if err := b.DeleteBucket([]byte("nested")); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte("added")); err != nil {
+			return err
+		}
+		return failure
+	})
+	assert.Equal(failure, err)
+
+	err = store.View(func(tx Tx) error {
+		assert.Nil(tx.Bucket([]byte("added")))
+		b := tx.Bucket([]byte("bucket"))
+		assert.Equal([]byte("1"), b.Get([]byte("kept")))
+		assert.Nil(b.Get([]byte("added")))
+		assert.NotNil(b.Bucket([]byte("nested")))
+		return nil
+	})
+	assert.Nil(err)
+}
+
+func testStoreReadOnly(assert *assert.Assertions, store Store) {
+	err := store.Update(func(tx Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("bucket"))
+		return err
+	})
+	assert.Nil(err)
+
+	err = store.View(func(tx Tx) error {
+		return tx.Bucket([]byte("bucket")).Put([]byte("k"), []byte("v"))
+	})
+	assert.Equal(ErrTxNotWritable, err)
+}
+
+func testKeyDBConformance(assert *assert.Assertions, keyDb *KeyDB) {
+	now := time.Now()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	metadata := func(timestamp int64) *models.AddressMetadata {
+		return &models.AddressMetadata{
+			Payload: &models.Payload{
+				Timestamp: timestamp,
+				Ttl:       60,
+			},
+		}
+	}
+
+	addr, first := SignPayload(assert, privKey, metadata(now.Unix()))
+	assert.Nil(keyDb.Set(addr.EncodeAddress(), first))
+	_, second := SignPayload(assert, privKey, metadata(now.Unix()+1))
+	assert.Nil(keyDb.Set(addr.EncodeAddress(), second))
+	// Replays of the current record, or of older ones, are rejected
+	assert.Equal(ErrReplayedValue, keyDb.Set(addr.EncodeAddress(), first))
+	assert.Equal(ErrReplayedValue, keyDb.Set(addr.EncodeAddress(), second))
+
+	fetched, err := keyDb.Get(addr.EncodeAddress())
+	assert.Nil(err)
+	assert.True(proto.Equal(second, fetched), "Fetch value did not match expected value")
+
+	history, err := keyDb.GetHistory(addr.EncodeAddress())
+	assert.Nil(err)
+	assert.Equal(2, len(history))
+	assert.True(proto.Equal(second, history[0]), "Newest version should be first")
+
+	stats, err := keyDb.Collect(now.Add(5 * time.Minute))
+	assert.Nil(err)
+	assert.Equal(1, stats.Records)
+	_, err = keyDb.Get(addr.EncodeAddress())
+	assert.NotNil(err)
+	_, err = keyDb.GetHistory(addr.EncodeAddress())
+	assert.NotNil(err)
+	// As are replays of collected ones
+	assert.Equal(ErrReplayedValue, keyDb.Set(addr.EncodeAddress(), first))
+	assert.Equal(ErrReplayedValue, keyDb.Set(addr.EncodeAddress(), second))
+}
+
+func testKeyDBConcurrentSet(assert *assert.Assertions, keyDb *KeyDB) {
+	now := time.Now().Unix()
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+
+	// Race versions against each other.  Whatever order they land in, the newest wins,
+	// and only one request may set each version.
+	const versions = 20
+	var addr *bchutil.AddressPubKeyHash
+	signed := make([]*models.AddressMetadata, versions)
+	for i := range signed {
+		addr, signed[i] = SignPayload(assert, privKey, &models.AddressMetadata{
+			Payload: &models.Payload{
+				Timestamp: now - int64(i),
+			},
+		})
+	}
+
+	var wg sync.WaitGroup
+	accepted := 0
+	results := make(chan error, 2*versions)
+	for i := 0; i < 2*versions; i++ {
+		wg.Add(1)
+		go func(metadata *models.AddressMetadata) {
+			defer wg.Done()
+			results <- keyDb.SetIf(addr.EncodeAddress(), metadata, Condition{})
+		}(signed[i%versions])
+	}
+	wg.Wait()
+	close(results)
+	for err := range results {
+		if err == nil {
+			accepted++
+			continue
+		}
+		assert.Equal(KindOutdated, Kind(err))
+	}
+	assert.True(accepted >= 1 && accepted <= versions)
+
+	fetched, err := keyDb.Get(addr.EncodeAddress())
+	assert.Nil(err)
+	assert.True(proto.Equal(signed[0], fetched), "Newest version should win")
+}
+
+func testKeyDBBackup(assert *assert.Assertions, keyDb *KeyDB) {
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	addr, metadata := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: time.Now().Unix()},
+	})
+	assert.Nil(keyDb.Set(addr.EncodeAddress(), metadata))
+
+	dir, err := ioutil.TempDir("", "example")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup.db")
+	f, err := os.Create(path)
+	assert.Nil(err)
+	n, err := keyDb.Backup(f)
+	assert.Nil(err)
+	assert.True(n > 0)
+	assert.Nil(f.Close())
+
+	// Writes after the backup aren't in it
+	_, newer := SignPayload(assert, privKey, &models.AddressMetadata{
+		Payload: &models.Payload{Timestamp: time.Now().Unix() + 1},
+	})
+	assert.Nil(keyDb.Set(addr.EncodeAddress(), newer))
+
+	// Whatever the driver, the backup opens as a bolt database
+	restored, err := New(&Config{Driver: DriverBolt, DBPath: path})
+	assert.Nil(err)
+	defer restored.Close()
+	fetched, err := restored.Get(addr.EncodeAddress())
+	assert.Nil(err)
+	assert.True(proto.Equal(metadata, fetched), "Restored value did not match backed up value")
+}
+
+func TestCopyStore(t *testing.T) {
+	assert := assert.New(t)
+
+	srcCfg, cleanupSrc := storeFactories[DriverBolt](t)
+	defer cleanupSrc()
+	dstCfg, cleanupDst := storeFactories[DriverBadger](t)
+	defer cleanupDst()
+
+	srcDb, err := New(srcCfg)
+	assert.Nil(err)
+	addr, metadata := GeneratePayload(assert, &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: time.Now().Unix(),
+		},
+	})
+	assert.Nil(srcDb.Set(addr.EncodeAddress(), metadata))
+	srcDb.Close()
+
+	src, err := OpenStore(srcCfg)
+	assert.Nil(err)
+	dst, err := OpenStore(dstCfg)
+	assert.Nil(err)
+	assert.Nil(CopyStore(dst, src))
+	// Copying again would mix the two, so is refused
+	assert.Equal(ErrStoreNotEmpty, CopyStore(dst, src))
+	assert.Nil(src.Close())
+	assert.Nil(dst.Close())
+
+	dstDb, err := New(dstCfg)
+	assert.Nil(err)
+	defer dstDb.Close()
+	fetched, err := dstDb.Get(addr.EncodeAddress())
+	assert.Nil(err)
+	assert.True(proto.Equal(metadata, fetched), "Fetch value did not match expected value")
+	assert.Equal(ErrReplayedValue, dstDb.Set(addr.EncodeAddress(), metadata))
+}
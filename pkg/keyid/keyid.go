@@ -0,0 +1,94 @@
+// Package keyid maps the many ways of writing an address onto the canonical key that
+// records for it are stored under.  Legacy base58 addresses, and cashaddrs with or without
+// their prefix and in either case, all name the same key.
+package keyid
+
+import (
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/gcash/bchutil"
+	"github.com/pkg/errors"
+)
+
+// Size is the length of a canonical key: a type byte followed by a hash160
+const Size = 21
+
+const (
+	// TypePubKeyHash is the type of keys for P2PKH addresses
+	TypePubKeyHash byte = 0
+	// TypeScriptHash is the type of keys for P2SH addresses
+	TypeScriptHash byte = 1
+)
+
+var (
+	// ErrUnsupportedAddress is returned for addresses which aren't P2PKH or P2SH
+	ErrUnsupportedAddress = errors.New("unsupported address type")
+	// ErrWrongNetwork indicates the address is for a different network
+	ErrWrongNetwork = errors.New("address is for a different network")
+)
+
+// Key is the canonical form of an address: its type followed by its hash160
+type Key [Size]byte
+
+// Parse decodes address, in any of the encodings accepted on the network described by
+// params, into its canonical key.
+func Parse(address string, params *chaincfg.Params) (Key, error) {
+	addr, err := bchutil.DecodeAddress(address, params)
+	if err != nil {
+		return Key{}, err
+	}
+	if !addr.IsForNet(params) {
+		return Key{}, ErrWrongNetwork
+	}
+	return FromAddress(addr)
+}
+
+// FromAddress returns the canonical key of a decoded address
+func FromAddress(addr bchutil.Address) (Key, error) {
+	var key Key
+	switch addr.(type) {
+	case *bchutil.AddressPubKeyHash, *bchutil.LegacyAddressPubKeyHash:
+		key[0] = TypePubKeyHash
+	case *bchutil.AddressScriptHash, *bchutil.LegacyAddressScriptHash:
+		key[0] = TypeScriptHash
+	default:
+		return Key{}, ErrUnsupportedAddress
+	}
+	copy(key[1:], addr.ScriptAddress())
+	return key, nil
+}
+
+// FromBytes returns the key stored as b, and whether b is a canonical key at all
+func FromBytes(b []byte) (Key, bool) {
+	var key Key
+	if len(b) != Size || (b[0] != TypePubKeyHash && b[0] != TypeScriptHash) {
+		return key, false
+	}
+	copy(key[:], b)
+	return key, true
+}
+
+// Type returns the type of address the key is for
+func (k Key) Type() byte {
+	return k[0]
+}
+
+// Hash returns the hash160 of the pubkey or script the key is for
+func (k Key) Hash() []byte {
+	return k[1:]
+}
+
+// Bytes returns the key as stored in the database
+func (k Key) Bytes() []byte {
+	return k[:]
+}
+
+// Encode returns the prefixed cashaddr for the key on the network described by params
+func (k Key) Encode(params *chaincfg.Params) string {
+	var addr bchutil.Address
+	if k.Type() == TypeScriptHash {
+		addr, _ = bchutil.NewAddressScriptHashFromHash(k.Hash(), params)
+	} else {
+		addr, _ = bchutil.NewAddressPubKeyHash(k.Hash(), params)
+	}
+	return params.CashAddressPrefix + ":" + addr.String()
+}
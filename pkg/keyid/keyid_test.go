@@ -0,0 +1,55 @@
+package keyid
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/gcash/bchutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+
+	hash := bchutil.Hash160([]byte("keyid"))
+	cashAddr, err := bchutil.NewAddressPubKeyHash(hash, &chaincfg.MainNetParams)
+	assert.Nil(err)
+	legacyAddr, err := bchutil.NewLegacyAddressPubKeyHash(hash, &chaincfg.MainNetParams)
+	assert.Nil(err)
+
+	prefixed := "bitcoincash:" + cashAddr.String()
+	forms := []string{
+		prefixed,
+		cashAddr.String(),
+		strings.ToUpper(prefixed),
+		strings.ToUpper(cashAddr.String()),
+		legacyAddr.EncodeAddress(),
+	}
+	for _, form := range forms {
+		key, err := Parse(form, &chaincfg.MainNetParams)
+		assert.Nil(err, form)
+		assert.Equal(TypePubKeyHash, key.Type())
+		assert.Equal(hash, key.Hash())
+		assert.Equal(prefixed, key.Encode(&chaincfg.MainNetParams))
+	}
+
+	// The same hash as a script is a different key
+	scriptAddr, err := bchutil.NewAddressScriptHashFromHash(hash, &chaincfg.MainNetParams)
+	assert.Nil(err)
+	key, err := Parse(scriptAddr.String(), &chaincfg.MainNetParams)
+	assert.Nil(err)
+	assert.Equal(TypeScriptHash, key.Type())
+	assert.Equal("bitcoincash:"+scriptAddr.String(), key.Encode(&chaincfg.MainNetParams))
+
+	stored, ok := FromBytes(key.Bytes())
+	assert.True(ok)
+	assert.Equal(key, stored)
+	_, ok = FromBytes([]byte(prefixed))
+	assert.False(ok)
+
+	_, err = Parse(legacyAddr.EncodeAddress(), &chaincfg.TestNet3Params)
+	assert.Equal(ErrWrongNetwork, err)
+	_, err = Parse("foo", &chaincfg.MainNetParams)
+	assert.NotNil(err)
+}
@@ -0,0 +1,105 @@
+package keytp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cashweb/keyserver/pkg/keydb"
+	"github.com/cashweb/keyserver/pkg/models"
+
+	"github.com/go-chi/chi"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/rs/zerolog/hlog"
+	"github.com/spf13/viper"
+)
+
+// AdminDatabase is the expected interface for an AdminServer's database
+type AdminDatabase interface {
+	Backup(io.Writer) (int64, error)
+	CacheStats() keydb.CacheStats
+	GetReceipt(string) (*models.Receipt, error)
+}
+
+// Stats is the JSON body served by the admin server's stats endpoint
+type Stats struct {
+	// Cache reports the database's read cache, so that it can be sized
+	Cache keydb.CacheStats `json:"cache"`
+}
+
+// AdminServer serves operational endpoints, such as backups and stats, which shouldn't be
+// exposed alongside the public API.  It should only be bound to a trusted interface.
+type AdminServer struct {
+	mux *chi.Mux
+	db  AdminDatabase
+}
+
+// NewAdmin returns the HTTP admin server for db
+func NewAdmin(db AdminDatabase) *AdminServer {
+	mux := chi.NewRouter()
+	// Backups outlast the public API's timeout, and must be able to abort a response
+	// which has already started, so neither the timeout nor the recoverer is installed.
+	setupLogMiddleware(mux)
+	server := &AdminServer{
+		mux: mux,
+		db:  db,
+	}
+	mux.Get("/backup", server.backup)
+	mux.Get("/stats", server.stats)
+	mux.Get("/keys/{keyID}/receipt", server.receipt)
+	return server
+}
+
+// backup streams a consistent snapshot of the database
+func (s *AdminServer) backup(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	defer r.Body.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", keydb.BackupName(time.Now())))
+	n, err := s.db.Backup(w)
+	if err != nil {
+		log.Error().Msgf("unable to back up database: %s", err)
+		if n == 0 {
+			writeError(w, http.StatusInternalServerError, codeInternal, "internal server error")
+			return
+		}
+		// The snapshot is partly written, so abort the response rather than let the
+		// client mistake it for a complete one
+		panic(http.ErrAbortHandler)
+	}
+	log.Info().Int64("bytes", n).Msg("Backed up database.")
+}
+
+// stats reports the server's counters
+func (s *AdminServer) stats(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&Stats{
+		Cache: s.db.CacheStats(),
+	})
+}
+
+// receipt reports where an address's current metadata came from
+func (s *AdminServer) receipt(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	defer r.Body.Close()
+
+	receipt, err := s.db.GetReceipt(chi.URLParam(r, "keyID"))
+	if err != nil {
+		log.Error().Msgf("unable to find receipt: %s", err)
+		writeDBError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := (&jsonpb.Marshaler{}).Marshal(w, receipt); err != nil {
+		log.Error().Msgf("unable to marshal receipt to JSON: %s", err)
+	}
+}
+
+// ListenAndServe listens and serves admin requests
+func (s *AdminServer) ListenAndServe() error {
+	return http.ListenAndServe(viper.GetString("adminbind"), s.mux)
+}
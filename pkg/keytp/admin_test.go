@@ -0,0 +1,101 @@
+package keytp
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cashweb/keyserver/pkg/keydb"
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// backupFunc is an AdminDatabase whose backups are written by the function, and whose
+// stats and receipts are fixed
+type backupFunc func(io.Writer) (int64, error)
+
+func (f backupFunc) Backup(w io.Writer) (int64, error) {
+	return f(w)
+}
+
+func (f backupFunc) CacheStats() keydb.CacheStats {
+	return keydb.CacheStats{Hits: 3, Misses: 1, Entries: 1, Capacity: 10}
+}
+
+func (f backupFunc) GetReceipt(keyID string) (*models.Receipt, error) {
+	if keyID != testKeyID {
+		return nil, keydb.ErrNotFound
+	}
+	return &models.Receipt{ReceivedAt: 1560000000, RequestId: "request", RemoteAddr: "192.0.2.1"}, nil
+}
+
+func TestBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	snapshot := []byte("snapshot")
+	server := NewAdmin(backupFunc(func(w io.Writer) (int64, error) {
+		n, err := w.Write(snapshot)
+		return int64(n), err
+	}))
+	req, err := http.NewRequest("GET", "/backup", bytes.NewBuffer([]byte("")))
+	assert.Nil(err)
+	rr := httptest.NewRecorder()
+	server.mux.ServeHTTP(rr, req)
+
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal(snapshot, rr.Body.Bytes())
+	assert.Contains(rr.Header().Get("Content-Disposition"), "keyserver-")
+
+	// A backup which fails before anything is written is reported
+	server = NewAdmin(backupFunc(func(w io.Writer) (int64, error) {
+		return 0, errors.New("disk on fire")
+	}))
+	rr = httptest.NewRecorder()
+	server.mux.ServeHTTP(rr, req)
+	assert.Equal(http.StatusInternalServerError, rr.Code)
+
+	// A backup which fails partway through aborts the response
+	server = NewAdmin(backupFunc(func(w io.Writer) (int64, error) {
+		n, _ := w.Write(snapshot[:4])
+		return int64(n), errors.New("disk on fire")
+	}))
+	rr = httptest.NewRecorder()
+	assert.PanicsWithValue(http.ErrAbortHandler, func() {
+		server.mux.ServeHTTP(rr, req)
+	})
+}
+
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+
+	server := NewAdmin(backupFunc(nil))
+	req, err := http.NewRequest("GET", "/stats", bytes.NewBuffer([]byte("")))
+	assert.Nil(err)
+	rr := httptest.NewRecorder()
+	server.mux.ServeHTTP(rr, req)
+
+	assert.Equal(http.StatusOK, rr.Code)
+	var stats Stats
+	assert.Nil(json.Unmarshal(rr.Body.Bytes(), &stats))
+	assert.Equal(Stats{Cache: keydb.CacheStats{Hits: 3, Misses: 1, Entries: 1, Capacity: 10}}, stats)
+}
+
+func TestReceipt(t *testing.T) {
+	assert := assert.New(t)
+
+	server := NewAdmin(backupFunc(nil))
+	rr := httptest.NewRecorder()
+	server.mux.ServeHTTP(rr, httptest.NewRequest("GET", "/keys/"+testKeyID+"/receipt", nil))
+
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal("application/json", rr.Header().Get("Content-Type"))
+	assert.JSONEq(`{"receivedAt":"1560000000","requestId":"request","remoteAddr":"192.0.2.1"}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	server.mux.ServeHTTP(rr, httptest.NewRequest("GET", "/keys/"+testLegacyKeyID+"/receipt", nil))
+	assert.Equal(http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,64 @@
+package keytp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cashweb/keyserver/pkg/keydb"
+)
+
+// Error codes for failures which happen before the database is reached.  Errors from the
+// database use the name of their keydb.ErrorKind as their code.
+const (
+	codeMalformedRequest = "malformed_request"
+	codeBodyTooLarge     = "body_too_large"
+	codeNoEnumeration    = "enumeration_disabled"
+	codeInternal         = "internal"
+)
+
+// ErrorResponse is the JSON body of every error returned by the server
+type ErrorResponse struct {
+	// Code is a stable, machine-readable name for the error
+	Code string `json:"error"`
+	// Message is a human readable description of the error
+	Message string `json:"message"`
+}
+
+// statuses maps the kinds of database error onto HTTP status codes
+var statuses = map[keydb.ErrorKind]int{
+	keydb.KindBadAddress:         http.StatusBadRequest,
+	keydb.KindMalformedMetadata:  http.StatusBadRequest,
+	keydb.KindUnknownScheme:      http.StatusBadRequest,
+	keydb.KindFutureTimestamp:    http.StatusBadRequest,
+	keydb.KindPubkeyMismatch:     http.StatusForbidden,
+	keydb.KindBadSignature:       http.StatusForbidden,
+	keydb.KindOutdated:           http.StatusConflict,
+	keydb.KindExpired:            http.StatusGone,
+	keydb.KindLimitExceeded:      http.StatusUnprocessableEntity,
+	keydb.KindPreconditionFailed: http.StatusPreconditionFailed,
+	keydb.KindNotFound:           http.StatusNotFound,
+	keydb.KindRevoked:            http.StatusLocked,
+}
+
+// writeError writes a JSON error body with the given status
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// writeDBError writes the response for an error returned by the database.  Internal
+// errors aren't described to the client.
+func writeDBError(w http.ResponseWriter, err error) {
+	kind := keydb.Kind(err)
+	status, ok := statuses[kind]
+	if !ok {
+		writeError(w, http.StatusInternalServerError, codeInternal, "internal server error")
+		return
+	}
+	writeError(w, status, kind.String(), err.Error())
+}
@@ -0,0 +1,74 @@
+package keytp
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cashweb/keyserver/pkg/keydb"
+)
+
+// etag returns the entity tag for a version of a key's metadata.  The version is the
+// payload timestamp, so clients can also read it from the metadata itself.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// parseETags parses the entity tags listed in the values of an If-Match or If-None-Match
+// header.  any is set if the header is "*".  Tags which aren't versions this server
+// issued can never match, so they are dropped, as are weak tags unless weak is set.
+func parseETags(values []string, weak bool) (versions []int64, any bool) {
+	versions = []int64{}
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" {
+				any = true
+				continue
+			}
+			if strings.HasPrefix(tag, "W/") {
+				if !weak {
+					continue
+				}
+				tag = tag[2:]
+			}
+			if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+				continue
+			}
+			version, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64)
+			if err != nil {
+				continue
+			}
+			versions = append(versions, version)
+		}
+	}
+	return versions, any
+}
+
+// condition returns the precondition a request's If-Match and If-None-Match headers
+// place on the version stored for its key
+func condition(r *http.Request) keydb.Condition {
+	var cond keydb.Condition
+	if values := r.Header["If-Match"]; len(values) > 0 {
+		// If-Match uses the strong comparison, so only strong tags can match
+		versions, any := parseETags(values, false)
+		if any {
+			cond.MatchAny = true
+		} else {
+			cond.Match = versions
+		}
+	}
+	if values := r.Header["If-None-Match"]; len(values) > 0 {
+		cond.NoneMatch, cond.NoneMatchAny = parseETags(values, true)
+	}
+	return cond
+}
+
+func containsVersion(versions []int64, version int64) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package keytp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseETags(t *testing.T) {
+	assert := assert.New(t)
+
+	versions, any := parseETags([]string{`"1", W/"2"`, `"3",garbage, "x"`}, false)
+	assert.Equal([]int64{1, 3}, versions)
+	assert.False(any)
+
+	versions, any = parseETags([]string{`"1", W/"2"`}, true)
+	assert.Equal([]int64{1, 2}, versions)
+	assert.False(any)
+
+	versions, any = parseETags([]string{"*"}, false)
+	assert.Empty(versions)
+	assert.True(any)
+
+	assert.Equal(`"-7"`, etag(-7))
+	versions, _ = parseETags([]string{etag(-7)}, false)
+	assert.Equal([]int64{-7}, versions)
+}
@@ -1,12 +1,25 @@
 package keytp
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"github.com/cashweb/keyserver/pkg/keydb"
+	"github.com/cashweb/keyserver/pkg/keyid"
 	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/cashweb/keyserver/pkg/payforput"
+	"github.com/cashweb/keyserver/pkg/recordio"
 	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
 	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/hlog"
 )
 
@@ -15,35 +28,94 @@ func (h HTTPKeyServer) setKey(w http.ResponseWriter,
 	log := hlog.FromRequest(r)
 
 	defer r.Body.Close()
-	keyID := chi.URLParam(r, "keyID")
-	if keyID == "" {
-		log.Error().Msg("missing key id")
-		http.Error(w, "missing keyID", http.StatusBadRequest)
+	keyID, ok := h.keyID(w, r)
+	if !ok {
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Error().Msg("error reading the key metadata")
-		http.Error(w, "internal server error",
-			http.StatusInternalServerError)
+	body, ok := h.readBody(w, r)
+	if !ok {
 		return
 	}
 
 	var keyMessage models.AddressMetadata
-	err = proto.Unmarshal(body, &keyMessage)
+	err := proto.Unmarshal(body, &keyMessage)
 	if err != nil {
 		log.Error().Msgf("unable to unmarshal request to PROTO: %s", err)
-		http.Error(w, "malformed request",
-			http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeMalformedRequest, "malformed request")
 		return
 	}
 
-	err = h.db.Set(keyID, &keyMessage)
+	// Honour If-Match and If-None-Match, so clients can update safely from a version
+	// they've already seen.  The body is stored as it is, so that it's served byte for
+	// byte as the signer uploaded it, and the receipt is only served to operators.
+	err = h.db.SetRawIf(keyID, body, condition(r), h.receipt(r))
 	if err != nil {
 		log.Error().Msgf("unable to set key in database: %s", err)
-		http.Error(w, "internal server error",
-			http.StatusInternalServerError)
+		writeDBError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag(keyMessage.GetPayload().GetTimestamp()))
+}
+
+func (h HTTPKeyServer) deleteKey(w http.ResponseWriter,
+	r *http.Request) {
+	log := hlog.FromRequest(r)
+
+	defer r.Body.Close()
+	keyID, ok := h.keyID(w, r)
+	if !ok {
+		return
+	}
+
+	body, ok := h.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var deletion models.Deletion
+	err := proto.Unmarshal(body, &deletion)
+	if err != nil {
+		log.Error().Msgf("unable to unmarshal request to PROTO: %s", err)
+		writeError(w, http.StatusBadRequest, codeMalformedRequest, "malformed request")
+		return
+	}
+
+	err = h.db.Delete(keyID, &deletion)
+	if err != nil {
+		log.Error().Msgf("unable to delete key from database: %s", err)
+		writeDBError(w, err)
+		return
+	}
+}
+
+func (h HTTPKeyServer) revokeKey(w http.ResponseWriter,
+	r *http.Request) {
+	log := hlog.FromRequest(r)
+
+	defer r.Body.Close()
+	keyID, ok := h.keyID(w, r)
+	if !ok {
+		return
+	}
+
+	body, ok := h.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var revocation models.Revocation
+	err := proto.Unmarshal(body, &revocation)
+	if err != nil {
+		log.Error().Msgf("unable to unmarshal request to PROTO: %s", err)
+		writeError(w, http.StatusBadRequest, codeMalformedRequest, "malformed request")
+		return
+	}
+
+	err = h.db.Revoke(keyID, &revocation)
+	if err != nil {
+		log.Error().Msgf("unable to revoke key in database: %s", err)
+		writeDBError(w, err)
 		return
 	}
 }
@@ -53,28 +125,317 @@ func (h HTTPKeyServer) getKey(w http.ResponseWriter,
 	log := hlog.FromRequest(r)
 
 	defer r.Body.Close()
-	keyID := chi.URLParam(r, "keyID")
-	if keyID == "" {
-		log.Error().Msg("missing key id")
-		http.Error(w, "missing keyID", http.StatusBadRequest)
+	keyID, ok := h.keyID(w, r)
+	if !ok {
 		return
 	}
 
-	model, err := h.db.Get(keyID)
+	var record *keydb.RawRecord
+	var err error
+	if wantProof(r) {
+		// The proof is sent whether or not the key is found, so that clients can check
+		// that it's really missing
+		var proof *models.MerkleProof
+		record, proof, err = h.db.GetRawWithProof(keyID)
+		if proof != nil && !writeProof(w, r, proof) {
+			return
+		}
+	} else {
+		record, err = h.db.GetRaw(keyID)
+	}
+	if keydb.Kind(err) == keydb.KindRevoked {
+		h.writeRevocation(w, r, keyID)
+		return
+	}
 	if err != nil {
 		log.Error().Msgf("unable to find key: %s", err)
-		http.Error(w, "key not found",
-			http.StatusNotFound)
+		writeDBError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(record.Timestamp))
+	versions, any := parseETags(r.Header["If-None-Match"], true)
+	if any || containsVersion(versions, record.Timestamp) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// The metadata is served exactly as it was stored, without decoding it
+	w.Write(record.Metadata)
+}
+
+func (h HTTPKeyServer) getHistory(w http.ResponseWriter,
+	r *http.Request) {
+	log := hlog.FromRequest(r)
+
+	defer r.Body.Close()
+	keyID, ok := h.keyID(w, r)
+	if !ok {
+		return
+	}
+
+	versions, err := h.db.GetHistory(keyID)
+	if keydb.Kind(err) == keydb.KindRevoked {
+		h.writeRevocation(w, r, keyID)
+		return
+	}
+	if err != nil {
+		log.Error().Msgf("unable to find key history: %s", err)
+		writeDBError(w, err)
+		return
+	}
+
+	resp, err := proto.Marshal(&models.AddressMetadataHistory{Versions: versions})
+	if err != nil {
+		log.Error().Msgf("unable to marshal request to PROTO: %s", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "internal server error")
+		return
+	}
+
+	w.Write(resp)
+}
+
+// defaultListLimit is the size of a page of listings when the client doesn't ask for one,
+// and maxListLimit the largest it may ask for
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// The numbers of the RecordPage message's fields
+const (
+	pageRecordsField = 1
+	pageNextField    = 2
+)
+
+func (h HTTPKeyServer) listKind(w http.ResponseWriter,
+	r *http.Request) {
+	log := hlog.FromRequest(r)
+
+	defer r.Body.Close()
+	limit, ok := listLimit(w, r)
+	if !ok {
+		return
+	}
+
+	// The kind is taken from the unescaped path rather than the route, since URLFormat
+	// strips anything after a dot from the route
+	kind := strings.TrimPrefix(r.URL.Path, "/kinds/")
+	addresses, err := h.db.ListKind(kind, r.URL.Query().Get("after"), limit)
+	if err != nil {
+		log.Error().Msgf("unable to list kind: %s", err)
+		writeDBError(w, err)
+		return
+	}
+
+	// A full page may be followed by another, which starts after its last address
+	page := &models.AddressPage{Addresses: addresses}
+	if len(addresses) == limit {
+		page.Next = addresses[len(addresses)-1]
+	}
+	resp, err := proto.Marshal(page)
+	if err != nil {
+		log.Error().Msgf("unable to marshal request to PROTO: %s", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "internal server error")
+		return
+	}
+
+	w.Write(resp)
+}
+
+func (h HTTPKeyServer) listKeys(w http.ResponseWriter,
+	r *http.Request) {
+	log := hlog.FromRequest(r)
+
+	defer r.Body.Close()
+	if !h.enumeration {
+		log.Error().Msg("enumeration is disabled")
+		writeError(w, http.StatusForbidden, codeNoEnumeration, "listing keys is disabled on this server")
+		return
+	}
+	limit, ok := listLimit(w, r)
+	if !ok {
+		return
+	}
+
+	records, err := h.db.List(r.URL.Query().Get("after"), limit)
+	if err != nil {
+		log.Error().Msgf("unable to list keys: %s", err)
+		writeDBError(w, err)
+		return
+	}
+
+	var next string
+	if len(records) == limit {
+		next = records[len(records)-1].Address
+	}
+	resp, err := marshalPage(records, next)
+	if err != nil {
+		log.Error().Msgf("unable to marshal request to PROTO: %s", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "internal server error")
+		return
+	}
+
+	w.Write(resp)
+}
+
+// marshalPage encodes records as a RecordPage message.  Each record's metadata is copied
+// into the message as it was stored, so that it still matches its signature.
+func marshalPage(records []*recordio.Record, next string) ([]byte, error) {
+	buf := proto.NewBuffer(nil)
+	for _, record := range records {
+		raw, err := recordio.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		buf.EncodeVarint(pageRecordsField<<3 | proto.WireBytes)
+		buf.EncodeRawBytes(raw)
+	}
+	if next != "" {
+		buf.EncodeVarint(pageNextField<<3 | proto.WireBytes)
+		buf.EncodeStringBytes(next)
+	}
+	return buf.Bytes(), nil
+}
+
+// listLimit returns the page size requested by a listing.  If it's invalid, an error is
+// written to w and ok is false.
+func listLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	rawLimit := r.URL.Query().Get("limit")
+	if rawLimit == "" {
+		return defaultListLimit, true
+	}
+	limit, err := strconv.Atoi(rawLimit)
+	if err != nil || limit <= 0 || limit > maxListLimit {
+		hlog.FromRequest(r).Error().Msgf("invalid limit %q", rawLimit)
+		writeError(w, http.StatusBadRequest, codeMalformedRequest,
+			fmt.Sprintf("limit must be between 1 and %d", maxListLimit))
+		return 0, false
+	}
+	return limit, true
+}
+
+func (h HTTPKeyServer) getRoot(w http.ResponseWriter,
+	r *http.Request) {
+	log := hlog.FromRequest(r)
+
+	defer r.Body.Close()
+	root, err := h.db.MerkleRoot()
+	if err != nil {
+		log.Error().Msgf("unable to find merkle root: %s", err)
+		writeDBError(w, err)
+		return
+	}
+
+	w.Write(root)
+}
+
+// receipt describes where the metadata uploaded by a request came from
+func (h HTTPKeyServer) receipt(r *http.Request) *models.Receipt {
+	receipt := &models.Receipt{
+		RequestId:  middleware.GetReqID(r.Context()),
+		RemoteAddr: socketAddr(r),
+		Peer:       h.peer(r),
+	}
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		receipt.ForwardedFor = forwardedFor
+	} else {
+		receipt.ForwardedFor = r.Header.Get("X-Real-IP")
+	}
+	if token := payforput.Token(r); token != "" {
+		hash := sha256.Sum256([]byte(token))
+		receipt.PaymentTokenHash = hash[:]
+	}
+	return receipt
+}
+
+// wantProof reports whether the client asked for a Merkle proof along with a key
+func wantProof(r *http.Request) bool {
+	proof, _ := strconv.ParseBool(r.URL.Query().Get("proof"))
+	return proof
+}
+
+// writeProof sets the headers carrying a Merkle proof and the root it's against.  If the
+// proof can't be encoded, an error is written to w and ok is false.
+func writeProof(w http.ResponseWriter, r *http.Request, proof *models.MerkleProof) bool {
+	rawProof, err := proto.Marshal(proof)
+	if err != nil {
+		hlog.FromRequest(r).Error().Msgf("unable to marshal request to PROTO: %s", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "internal server error")
+		return false
+	}
+	w.Header().Set("X-Merkle-Root", hex.EncodeToString(proof.GetRoot()))
+	w.Header().Set("X-Merkle-Proof", base64.StdEncoding.EncodeToString(rawProof))
+	return true
+}
+
+// writeRevocation responds to a request for a revoked key with its revocation, so that
+// clients can verify it and warn their users
+func (h HTTPKeyServer) writeRevocation(w http.ResponseWriter, r *http.Request, keyID string) {
+	log := hlog.FromRequest(r)
+
+	revocation, err := h.db.GetRevocation(keyID)
+	if err != nil {
+		log.Error().Msgf("unable to find revocation: %s", err)
+		writeDBError(w, err)
 		return
 	}
 
-	resp, err := proto.Marshal(model)
+	resp, err := proto.Marshal(revocation)
 	if err != nil {
 		log.Error().Msgf("unable to marshal request to PROTO: %s", err)
-		http.Error(w, "internal server error",
-			http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, codeInternal, "internal server error")
 		return
 	}
 
+	w.WriteHeader(http.StatusLocked)
 	w.Write(resp)
 }
+
+// readBody reads the request body, up to the configured limit.  If it can't be read, or
+// is too large, an error is written to w and ok is false.
+func (h HTTPKeyServer) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	log := hlog.FromRequest(r)
+
+	if r.ContentLength > h.maxBodyBytes {
+		log.Error().Msgf("request body of %d bytes is too large", r.ContentLength)
+		writeError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge,
+			fmt.Sprintf("request body is larger than %d bytes", h.maxBodyBytes))
+		return nil, false
+	}
+	// Read one byte past the limit, so that we can tell if the body was cut short
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, h.maxBodyBytes+1))
+	if err != nil {
+		log.Error().Msg("error reading the request body")
+		writeError(w, http.StatusInternalServerError, codeInternal, "internal server error")
+		return nil, false
+	}
+	if int64(len(body)) > h.maxBodyBytes {
+		log.Error().Msg("request body is too large")
+		writeError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge,
+			fmt.Sprintf("request body is larger than %d bytes", h.maxBodyBytes))
+		return nil, false
+	}
+	return body, true
+}
+
+// keyID returns the canonical form of the address in the request's URL.  If it's missing
+// or can't be decoded, an error is written to w and ok is false.
+func (h HTTPKeyServer) keyID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	log := hlog.FromRequest(r)
+
+	keyID := chi.URLParam(r, "keyID")
+	if keyID == "" {
+		log.Error().Msg("missing key id")
+		writeError(w, http.StatusBadRequest, keydb.KindBadAddress.String(), "missing keyID")
+		return "", false
+	}
+
+	key, err := keyid.Parse(keyID, h.params)
+	if err != nil {
+		log.Error().Msgf("invalid key id %q: %s", keyID, err)
+		writeDBError(w, errors.Wrap(keydb.ErrInvalidAddress, err.Error()))
+		return "", false
+	}
+	return key.Encode(h.params), true
+}
@@ -3,21 +3,38 @@ package keytp
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"testing/quick"
 	"time"
 
+	"github.com/cashweb/keyserver/pkg/keydb"
 	mocks "github.com/cashweb/keyserver/pkg/keytp/mocks"
 	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/cashweb/keyserver/pkg/recordio"
 	"github.com/gcash/bchd/bchec"
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/gcash/bchd/txscript"
+	"github.com/gcash/bchutil"
 	"github.com/go-chi/chi"
 	"github.com/golang/mock/gomock"
 	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
+const (
+	testKeyID       = "bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a"
+	testLegacyKeyID = "1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu"
+)
+
 func TestSetKey(t *testing.T) {
 	assert := assert.New(t)
 	mockCtrl := gomock.NewController(t)
@@ -49,15 +66,24 @@ func TestSetKey(t *testing.T) {
 	addMetadataBytes, err := proto.Marshal(addrMetadata)
 	assert.Nil(err)
 
-	mockDB.EXPECT().Set("foo", gomock.Any()).Times(1)
-	server := New(mockDB)
+	// Keys are passed to the database in their canonical form, along with a receipt for
+	// the upload
+	tokenHash := sha256.Sum256([]byte("token"))
+	mockDB.EXPECT().SetRawIf(testKeyID, addMetadataBytes, keydb.Condition{}, gomock.Any()).Do(
+		func(_ string, _ []byte, _ keydb.Condition, receipt *models.Receipt) {
+			assert.Equal("192.0.2.1:1234", receipt.GetRemoteAddr())
+			assert.Equal(tokenHash[:], receipt.GetPaymentTokenHash())
+		}).Times(1)
+	server := New(mockDB, &chaincfg.MainNetParams)
 
-	req, err := http.NewRequest("PUT", "/keys/foo", bytes.NewBuffer(addMetadataBytes))
+	req, err := http.NewRequest("PUT", "/keys/"+testLegacyKeyID, bytes.NewBuffer(addMetadataBytes))
 	assert.Nil(err)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Authorization", "POP token")
 
 	rr := httptest.NewRecorder()
 	rctx := chi.NewRouteContext()
-	rctx.URLParams.Add("keyID", "foo")
+	rctx.URLParams.Add("keyID", testLegacyKeyID)
 
 	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
 
@@ -67,6 +93,49 @@ func TestSetKey(t *testing.T) {
 	assert.Equal(rr.Code, http.StatusOK)
 }
 
+func TestReceiptRemoteAddr(t *testing.T) {
+	assert := assert.New(t)
+
+	// The receipt keeps the connection's address, even once RealIP has replaced it with the
+	// one the client claims
+	var got *models.Receipt
+	server := HTTPKeyServer{}
+	mux := chi.NewRouter()
+	setupLogMiddleware(mux)
+	mux.Put("/", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("198.51.100.7", r.RemoteAddr)
+		got = server.receipt(r)
+	})
+
+	req := httptest.NewRequest("PUT", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7, 203.0.113.9")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal("192.0.2.1:1234", got.GetRemoteAddr())
+	assert.Equal("198.51.100.7, 203.0.113.9", got.GetForwardedFor())
+
+	req = httptest.NewRequest("PUT", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Real-IP", "198.51.100.7")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal("192.0.2.1:1234", got.GetRemoteAddr())
+	assert.Equal("198.51.100.7", got.GetForwardedFor())
+	assert.Empty(got.GetPeer())
+
+	// Uploads relayed by a peer are credited to it, going by the connection's address
+	// rather than the claimed one
+	server.peers = resolvePeers([]string{"http://192.0.2.1:8080", "http://198.51.100.7", "::garbage"})
+	assert.Equal(map[string]string{"192.0.2.1": "http://192.0.2.1:8080", "198.51.100.7": "http://198.51.100.7"}, server.peers)
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal("http://192.0.2.1:8080", got.GetPeer())
+
+	req.RemoteAddr = "203.0.113.9:1234"
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Empty(got.GetPeer())
+}
+
 func TestGetKey(t *testing.T) {
 	assert := assert.New(t)
 	mockCtrl := gomock.NewController(t)
@@ -97,16 +166,21 @@ func TestGetKey(t *testing.T) {
 
 	addMetadataBytes, err := proto.Marshal(addrMetadata)
 	assert.Nil(err)
+	// Stored bytes are served verbatim, including fields the server doesn't know about
+	addMetadataBytes = append(addMetadataBytes, 0xf8, 0x01, 0x01)
 
-	mockDB.EXPECT().Get("foo").Return(addrMetadata, nil).Times(1)
-	server := New(mockDB)
+	mockDB.EXPECT().GetRaw(testKeyID).Return(&keydb.RawRecord{
+		Metadata:  addMetadataBytes,
+		Timestamp: addrMetadata.GetPayload().GetTimestamp(),
+	}, nil).Times(1)
+	server := New(mockDB, &chaincfg.MainNetParams)
 
-	req, err := http.NewRequest("GET", "/keys/foo", bytes.NewBuffer([]byte("")))
+	req, err := http.NewRequest("GET", "/keys/"+testLegacyKeyID, bytes.NewBuffer([]byte("")))
 	assert.Nil(err)
 
 	rr := httptest.NewRecorder()
 	rctx := chi.NewRouteContext()
-	rctx.URLParams.Add("keyID", "foo")
+	rctx.URLParams.Add("keyID", testLegacyKeyID)
 
 	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
 
@@ -120,3 +194,589 @@ func TestGetKey(t *testing.T) {
 
 	assert.Equal(returnedBytes, addMetadataBytes)
 }
+
+func TestGetHistory(t *testing.T) {
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDB := mocks.NewMockDatabase(mockCtrl)
+
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	pubkey := privKey.PubKey()
+	now := time.Now().Unix()
+	versions := []*models.AddressMetadata{
+		&models.AddressMetadata{
+			PubKey: pubkey.SerializeUncompressed(),
+			Payload: &models.Payload{
+				Timestamp: now,
+			},
+		},
+		&models.AddressMetadata{
+			PubKey: pubkey.SerializeUncompressed(),
+			Payload: &models.Payload{
+				Timestamp: now - 1,
+			},
+		},
+	}
+
+	mockDB.EXPECT().GetHistory(testKeyID).Return(versions, nil).Times(1)
+	server := New(mockDB, &chaincfg.MainNetParams)
+
+	req, err := http.NewRequest("GET", "/keys/"+testLegacyKeyID+"/history", bytes.NewBuffer([]byte("")))
+	assert.Nil(err)
+
+	rr := httptest.NewRecorder()
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("keyID", testLegacyKeyID)
+
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	handler := http.HandlerFunc(server.getHistory)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(rr.Code, http.StatusOK)
+
+	history := &models.AddressMetadataHistory{}
+	err = proto.Unmarshal(rr.Body.Bytes(), history)
+	assert.Nil(err)
+	assert.True(proto.Equal(history, &models.AddressMetadataHistory{Versions: versions}))
+}
+
+func TestInvalidKeyID(t *testing.T) {
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDB := mocks.NewMockDatabase(mockCtrl)
+
+	server := New(mockDB, &chaincfg.MainNetParams)
+
+	req, err := http.NewRequest("GET", "/keys/foo", bytes.NewBuffer([]byte("")))
+	assert.Nil(err)
+
+	rr := httptest.NewRecorder()
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("keyID", "foo")
+
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	handler := http.HandlerFunc(server.getKey)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(http.StatusBadRequest, rr.Code)
+	var body ErrorResponse
+	assert.Nil(json.NewDecoder(rr.Body).Decode(&body))
+	assert.Equal("bad_address", body.Code)
+}
+
+func TestSetKeyErrors(t *testing.T) {
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDB := mocks.NewMockDatabase(mockCtrl)
+
+	server := New(mockDB, &chaincfg.MainNetParams)
+	addMetadataBytes, err := proto.Marshal(&models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: time.Now().Unix(),
+		},
+	})
+	assert.Nil(err)
+
+	for _, test := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{keydb.ErrWrongNetwork, http.StatusBadRequest, "bad_address"},
+		{keydb.ErrUnknownScheme, http.StatusBadRequest, "unknown_scheme"},
+		{keydb.ErrPubkeyDoesNotMatch, http.StatusForbidden, "pubkey_mismatch"},
+		{keydb.ErrSignatureMismatch, http.StatusForbidden, "bad_signature"},
+		{errors.Wrap(keydb.ErrMalformedSignature, "bad der"), http.StatusForbidden, "bad_signature"},
+		{keydb.ErrOutdatedValue, http.StatusConflict, "outdated"},
+		{keydb.ErrReplayedValue, http.StatusConflict, "outdated"},
+		{keydb.ErrExpiredTTL, http.StatusGone, "expired"},
+		{errors.Wrap(keydb.ErrLimitExceeded, "3 entries, at most 2 allowed"), http.StatusUnprocessableEntity, "limit_exceeded"},
+		{errors.New("disk on fire"), http.StatusInternalServerError, "internal"},
+	} {
+		mockDB.EXPECT().SetRawIf(testKeyID, gomock.Any(), keydb.Condition{}, gomock.Any()).Return(test.err).Times(1)
+
+		req, err := http.NewRequest("PUT", "/keys/"+testKeyID, bytes.NewBuffer(addMetadataBytes))
+		assert.Nil(err)
+
+		rr := httptest.NewRecorder()
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("keyID", testKeyID)
+
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+		handler := http.HandlerFunc(server.setKey)
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(test.status, rr.Code, test.err.Error())
+		assert.Equal("application/json", rr.Header().Get("Content-Type"))
+		var body ErrorResponse
+		assert.Nil(json.NewDecoder(rr.Body).Decode(&body))
+		assert.Equal(test.code, body.Code)
+	}
+}
+
+func TestGetKeyErrors(t *testing.T) {
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDB := mocks.NewMockDatabase(mockCtrl)
+
+	server := New(mockDB, &chaincfg.MainNetParams)
+
+	for _, test := range []struct {
+		err    error
+		status int
+	}{
+		{keydb.ErrExpiredTTL, http.StatusGone},
+		{errors.Wrap(keydb.ErrNotFound, "failed to find address metadata"), http.StatusNotFound},
+	} {
+		mockDB.EXPECT().GetRaw(testKeyID).Return(nil, test.err).Times(1)
+
+		req, err := http.NewRequest("GET", "/keys/"+testKeyID, bytes.NewBuffer([]byte("")))
+		assert.Nil(err)
+
+		rr := httptest.NewRecorder()
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("keyID", testKeyID)
+
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+		handler := http.HandlerFunc(server.getKey)
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(test.status, rr.Code, test.err.Error())
+	}
+}
+
+func TestSetKeyMalformed(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := keydb.New(&keydb.Config{Driver: keydb.DriverMemory})
+	assert.Nil(err)
+	defer db.Close()
+	server := New(db, &chaincfg.MainNetParams)
+
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	pubKey := privKey.PubKey().SerializeCompressed()
+	addr, err := bchutil.NewAddressPubKeyHash(bchutil.Hash160(pubKey), &chaincfg.MainNetParams)
+	assert.Nil(err)
+	multiSigKey, err := bchutil.NewAddressPubKey(pubKey, &chaincfg.MainNetParams)
+	assert.Nil(err)
+	script, err := txscript.MultiSigScript([]*bchutil.AddressPubKey{multiSigKey}, 1)
+	assert.Nil(err)
+	scriptAddr, err := bchutil.NewAddressScriptHash(script, &chaincfg.MainNetParams)
+	assert.Nil(err)
+
+	put := func(keyID string, body []byte) int {
+		req, err := http.NewRequest("PUT", "/keys/"+keyID, bytes.NewBuffer(body))
+		assert.Nil(err)
+
+		rr := httptest.NewRecorder()
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("keyID", keyID)
+
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+		handler := http.HandlerFunc(server.setKey)
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	rejected := func(status int) bool {
+		return status >= 400 && status < 500
+	}
+
+	// Whatever is sent, the request is rejected as the client's fault rather than panicking
+	randomBody := func(body []byte) bool {
+		return rejected(put(addr.String(), body))
+	}
+	assert.Nil(quick.Check(randomBody, nil))
+
+	randomMetadata := func(scheme int32, signature, redeemScript []byte, signatures [][]byte, scriptHash bool) bool {
+		keyID := addr.String()
+		if scriptHash {
+			keyID = scriptAddr.String()
+			// Mostly send the right script, so that the signatures are checked
+			if len(redeemScript)%4 != 0 {
+				redeemScript = script
+			}
+		}
+		body, err := proto.Marshal(&models.AddressMetadata{
+			PubKey:       pubKey,
+			Signature:    signature,
+			Scheme:       models.AddressMetadata_SignatureScheme(scheme),
+			RedeemScript: redeemScript,
+			Signatures:   signatures,
+			Payload: &models.Payload{
+				Timestamp: time.Now().Unix(),
+			},
+		})
+		assert.Nil(err)
+		return rejected(put(keyID, body))
+	}
+	assert.Nil(quick.Check(randomMetadata, nil))
+}
+
+func TestSetKeyTooLarge(t *testing.T) {
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDB := mocks.NewMockDatabase(mockCtrl)
+
+	viper.Set("maxbodybytes", 16)
+	defer viper.Set("maxbodybytes", 0)
+	server := New(mockDB, &chaincfg.MainNetParams)
+
+	for _, contentLength := range []int64{17, -1} {
+		req, err := http.NewRequest("PUT", "/keys/"+testKeyID, bytes.NewBuffer(make([]byte, 17)))
+		assert.Nil(err)
+		// A body of unknown length is only rejected once it has been read
+		req.ContentLength = contentLength
+
+		rr := httptest.NewRecorder()
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("keyID", testKeyID)
+
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+		handler := http.HandlerFunc(server.setKey)
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(http.StatusRequestEntityTooLarge, rr.Code)
+		var body ErrorResponse
+		assert.Nil(json.NewDecoder(rr.Body).Decode(&body))
+		assert.Equal("body_too_large", body.Code)
+	}
+}
+
+func TestConditionalKey(t *testing.T) {
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDB := mocks.NewMockDatabase(mockCtrl)
+
+	server := New(mockDB, &chaincfg.MainNetParams)
+	addrMetadata := &models.AddressMetadata{
+		Payload: &models.Payload{
+			Timestamp: 5,
+		},
+	}
+	addMetadataBytes, err := proto.Marshal(addrMetadata)
+	assert.Nil(err)
+
+	serve := func(method string, handler http.HandlerFunc, headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "/keys/"+testKeyID, bytes.NewBuffer(addMetadataBytes))
+		assert.Nil(err)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		rr := httptest.NewRecorder()
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("keyID", testKeyID)
+
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The stored version is exposed as an ETag
+	record := &keydb.RawRecord{Timestamp: addrMetadata.GetPayload().GetTimestamp()}
+	mockDB.EXPECT().GetRaw(testKeyID).Return(record, nil).Times(1)
+	rr := serve("GET", server.getKey, nil)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal(`"5"`, rr.Header().Get("ETag"))
+
+	mockDB.EXPECT().GetRaw(testKeyID).Return(record, nil).Times(1)
+	rr = serve("GET", server.getKey, map[string]string{"If-None-Match": `"4", W/"5"`})
+	assert.Equal(http.StatusNotModified, rr.Code)
+
+	// Preconditions on PUT are passed to the database
+	mockDB.EXPECT().SetRawIf(testKeyID, gomock.Any(), keydb.Condition{Match: []int64{4}}, gomock.Any()).Return(nil).Times(1)
+	rr = serve("PUT", server.setKey, map[string]string{"If-Match": `"4", W/"3"`})
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal(`"5"`, rr.Header().Get("ETag"))
+
+	mockDB.EXPECT().SetRawIf(testKeyID, gomock.Any(), keydb.Condition{NoneMatch: []int64{}, NoneMatchAny: true}, gomock.Any()).Return(keydb.ErrPreconditionFailed).Times(1)
+	rr = serve("PUT", server.setKey, map[string]string{"If-None-Match": "*"})
+	assert.Equal(http.StatusPreconditionFailed, rr.Code)
+}
+
+func TestDeleteKey(t *testing.T) {
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDB := mocks.NewMockDatabase(mockCtrl)
+
+	server := New(mockDB, &chaincfg.MainNetParams)
+	deletion := &models.Deletion{
+		Timestamp: time.Now().Unix(),
+	}
+	deletionBytes, err := proto.Marshal(deletion)
+	assert.Nil(err)
+
+	for _, test := range []struct {
+		body   []byte
+		err    error
+		status int
+	}{
+		{deletionBytes, nil, http.StatusOK},
+		{deletionBytes, keydb.ErrOutdatedValue, http.StatusConflict},
+		{deletionBytes, keydb.ErrSignatureMismatch, http.StatusForbidden},
+		{[]byte("garbage"), nil, http.StatusBadRequest},
+	} {
+		if !bytes.Equal(test.body, []byte("garbage")) {
+			mockDB.EXPECT().Delete(testKeyID, gomock.Any()).Return(test.err).Times(1)
+		}
+
+		req, err := http.NewRequest("DELETE", "/keys/"+testLegacyKeyID, bytes.NewBuffer(test.body))
+		assert.Nil(err)
+
+		rr := httptest.NewRecorder()
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("keyID", testLegacyKeyID)
+
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+		handler := http.HandlerFunc(server.deleteKey)
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(test.status, rr.Code)
+	}
+}
+
+func TestRevokeKey(t *testing.T) {
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDB := mocks.NewMockDatabase(mockCtrl)
+
+	server := New(mockDB, &chaincfg.MainNetParams)
+	revocation := &models.Revocation{
+		Timestamp: time.Now().Unix(),
+		Reason:    "key compromised",
+	}
+	revocationBytes, err := proto.Marshal(revocation)
+	assert.Nil(err)
+
+	for _, test := range []struct {
+		body   []byte
+		err    error
+		status int
+	}{
+		{revocationBytes, nil, http.StatusOK},
+		{revocationBytes, keydb.ErrRevoked, http.StatusLocked},
+		{revocationBytes, keydb.ErrSignatureMismatch, http.StatusForbidden},
+		{[]byte("garbage"), nil, http.StatusBadRequest},
+	} {
+		if !bytes.Equal(test.body, []byte("garbage")) {
+			mockDB.EXPECT().Revoke(testKeyID, gomock.Any()).Return(test.err).Times(1)
+		}
+
+		req, err := http.NewRequest("POST", "/keys/"+testLegacyKeyID+"/revocation", bytes.NewBuffer(test.body))
+		assert.Nil(err)
+
+		rr := httptest.NewRecorder()
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("keyID", testLegacyKeyID)
+
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+		handler := http.HandlerFunc(server.revokeKey)
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(test.status, rr.Code)
+	}
+}
+
+func TestGetRevokedKey(t *testing.T) {
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDB := mocks.NewMockDatabase(mockCtrl)
+
+	server := New(mockDB, &chaincfg.MainNetParams)
+	revocation := &models.Revocation{
+		Timestamp: time.Now().Unix(),
+		Reason:    "key compromised",
+	}
+
+	// Both the key and its history are replaced by the revocation
+	mockDB.EXPECT().GetRaw(testKeyID).Return(nil, keydb.ErrRevoked).Times(1)
+	mockDB.EXPECT().GetHistory(testKeyID).Return(nil, keydb.ErrRevoked).Times(1)
+	mockDB.EXPECT().GetRevocation(testKeyID).Return(revocation, nil).Times(2)
+
+	for _, handler := range []http.HandlerFunc{server.getKey, server.getHistory} {
+		req, err := http.NewRequest("GET", "/keys/"+testLegacyKeyID, bytes.NewBuffer([]byte("")))
+		assert.Nil(err)
+
+		rr := httptest.NewRecorder()
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("keyID", testLegacyKeyID)
+
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(http.StatusLocked, rr.Code)
+		var got models.Revocation
+		assert.Nil(proto.Unmarshal(rr.Body.Bytes(), &got))
+		assert.Equal(revocation.Reason, got.Reason)
+		assert.Equal(revocation.Timestamp, got.Timestamp)
+	}
+}
+
+func TestListKind(t *testing.T) {
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDB := mocks.NewMockDatabase(mockCtrl)
+
+	server := New(mockDB, &chaincfg.MainNetParams)
+
+	for _, test := range []struct {
+		url       string
+		kind      string
+		after     string
+		limit     int
+		addresses []string
+		err       error
+		status    int
+		next      string
+	}{
+		{"/kinds/relay", "relay", "", 100, []string{testKeyID}, nil, http.StatusOK, ""},
+		{"/kinds/vcard.v2?limit=1", "vcard.v2", "", 1, []string{testKeyID}, nil, http.StatusOK, testKeyID},
+		{"/kinds/a%2Fb?after=" + testKeyID, "a/b", testKeyID, 100, nil, nil, http.StatusOK, ""},
+		{"/kinds/relay?after=garbage", "relay", "garbage", 100, nil, keydb.ErrInvalidAddress, http.StatusBadRequest, ""},
+		{"/kinds/relay?limit=0", "", "", 0, nil, nil, http.StatusBadRequest, ""},
+		{"/kinds/relay?limit=1001", "", "", 0, nil, nil, http.StatusBadRequest, ""},
+		{"/kinds/relay?limit=ten", "", "", 0, nil, nil, http.StatusBadRequest, ""},
+	} {
+		if test.limit != 0 {
+			mockDB.EXPECT().ListKind(test.kind, test.after, test.limit).Return(test.addresses, test.err).Times(1)
+		}
+
+		rr := httptest.NewRecorder()
+		server.mux.ServeHTTP(rr, httptest.NewRequest("GET", test.url, nil))
+
+		assert.Equal(test.status, rr.Code, test.url)
+		if test.status != http.StatusOK {
+			continue
+		}
+		var page models.AddressPage
+		assert.Nil(proto.Unmarshal(rr.Body.Bytes(), &page))
+		assert.Equal(test.addresses, page.GetAddresses())
+		assert.Equal(test.next, page.GetNext())
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDB := mocks.NewMockDatabase(mockCtrl)
+
+	// Enumeration is refused unless it's been enabled
+	rr := httptest.NewRecorder()
+	New(mockDB, &chaincfg.MainNetParams).mux.ServeHTTP(rr, httptest.NewRequest("GET", "/keys", nil))
+	assert.Equal(http.StatusForbidden, rr.Code)
+
+	viper.Set("enumeration", true)
+	defer viper.Set("enumeration", false)
+	server := New(mockDB, &chaincfg.MainNetParams)
+
+	// The metadata's fields are out of order, so re-encoding it would change it
+	metadata := []byte{2<<3 | proto.WireBytes, 1, 2, 1<<3 | proto.WireBytes, 1, 1}
+	records := []*recordio.Record{{Address: testKeyID, Metadata: metadata}}
+	for _, test := range []struct {
+		url     string
+		after   string
+		limit   int
+		records []*recordio.Record
+		err     error
+		status  int
+		next    string
+	}{
+		{"/keys", "", 100, records, nil, http.StatusOK, ""},
+		{"/keys?limit=1", "", 1, records, nil, http.StatusOK, testKeyID},
+		{"/keys?after=" + testKeyID, testKeyID, 100, nil, nil, http.StatusOK, ""},
+		{"/keys?after=garbage", "garbage", 100, nil, keydb.ErrInvalidAddress, http.StatusBadRequest, ""},
+		{"/keys?limit=-1", "", 0, nil, nil, http.StatusBadRequest, ""},
+	} {
+		if test.limit != 0 {
+			mockDB.EXPECT().List(test.after, test.limit).Return(test.records, test.err).Times(1)
+		}
+
+		rr := httptest.NewRecorder()
+		server.mux.ServeHTTP(rr, httptest.NewRequest("GET", test.url, nil))
+
+		assert.Equal(test.status, rr.Code, test.url)
+		if test.status != http.StatusOK {
+			continue
+		}
+		var page models.RecordPage
+		assert.Nil(proto.Unmarshal(rr.Body.Bytes(), &page))
+		assert.Equal(len(test.records), len(page.GetRecords()))
+		for i, record := range test.records {
+			assert.Equal(record.Address, page.GetRecords()[i].GetAddress())
+			assert.True(bytes.Contains(rr.Body.Bytes(), record.Metadata), "Listed metadata was not sent as stored")
+		}
+		assert.Equal(test.next, page.GetNext())
+	}
+}
+
+func TestGetKeyProof(t *testing.T) {
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDB := mocks.NewMockDatabase(mockCtrl)
+
+	server := New(mockDB, &chaincfg.MainNetParams)
+	proof := &models.MerkleProof{
+		Root:     bytes.Repeat([]byte{1}, 32),
+		Siblings: [][]byte{bytes.Repeat([]byte{2}, 32)},
+	}
+	record := &keydb.RawRecord{Metadata: []byte("metadata"), Timestamp: 1}
+
+	for _, test := range []struct {
+		record *keydb.RawRecord
+		err    error
+		status int
+	}{
+		{record, nil, http.StatusOK},
+		// Proofs of non-inclusion are sent with a missing key
+		{nil, keydb.ErrNotFound, http.StatusNotFound},
+	} {
+		mockDB.EXPECT().GetRawWithProof(testKeyID).Return(test.record, proof, test.err).Times(1)
+
+		rr := httptest.NewRecorder()
+		server.mux.ServeHTTP(rr, httptest.NewRequest("GET", "/keys/"+testLegacyKeyID+"?proof=true", nil))
+
+		assert.Equal(test.status, rr.Code)
+		assert.Equal(strings.Repeat("01", 32), rr.Header().Get("X-Merkle-Root"))
+		rawProof, err := base64.StdEncoding.DecodeString(rr.Header().Get("X-Merkle-Proof"))
+		assert.Nil(err)
+		var sent models.MerkleProof
+		assert.Nil(proto.Unmarshal(rawProof, &sent))
+		assert.True(proto.Equal(proof, &sent), "Sent proof did not match expected proof")
+	}
+
+	// Without asking for a proof, none is sent
+	mockDB.EXPECT().GetRaw(testKeyID).Return(record, nil).Times(1)
+	rr := httptest.NewRecorder()
+	server.mux.ServeHTTP(rr, httptest.NewRequest("GET", "/keys/"+testLegacyKeyID, nil))
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Empty(rr.Header().Get("X-Merkle-Proof"))
+
+	mockDB.EXPECT().MerkleRoot().Return(proof.GetRoot(), nil).Times(1)
+	rr = httptest.NewRecorder()
+	server.mux.ServeHTTP(rr, httptest.NewRequest("GET", "/root", nil))
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal(proof.GetRoot(), rr.Body.Bytes())
+}
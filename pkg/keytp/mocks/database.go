@@ -5,7 +5,9 @@
 package mock_keytp
 
 import (
+	keydb "github.com/cashweb/keyserver/pkg/keydb"
 	models "github.com/cashweb/keyserver/pkg/models"
+	recordio "github.com/cashweb/keyserver/pkg/recordio"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
 )
@@ -33,31 +35,150 @@ func (m *MockDatabase) EXPECT() *MockDatabaseMockRecorder {
 	return m.recorder
 }
 
-// Get mocks base method
-func (m *MockDatabase) Get(arg0 string) (*models.AddressMetadata, error) {
+// GetRaw mocks base method
+func (m *MockDatabase) GetRaw(arg0 string) (*keydb.RawRecord, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Get", arg0)
-	ret0, _ := ret[0].(*models.AddressMetadata)
+	ret := m.ctrl.Call(m, "GetRaw", arg0)
+	ret0, _ := ret[0].(*keydb.RawRecord)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// Get indicates an expected call of Get
-func (mr *MockDatabaseMockRecorder) Get(arg0 interface{}) *gomock.Call {
+// GetRaw indicates an expected call of GetRaw
+func (mr *MockDatabaseMockRecorder) GetRaw(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockDatabase)(nil).Get), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRaw", reflect.TypeOf((*MockDatabase)(nil).GetRaw), arg0)
 }
 
-// Set mocks base method
-func (m *MockDatabase) Set(arg0 string, arg1 *models.AddressMetadata) error {
+// GetRawWithProof mocks base method
+func (m *MockDatabase) GetRawWithProof(arg0 string) (*keydb.RawRecord, *models.MerkleProof, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Set", arg0, arg1)
+	ret := m.ctrl.Call(m, "GetRawWithProof", arg0)
+	ret0, _ := ret[0].(*keydb.RawRecord)
+	ret1, _ := ret[1].(*models.MerkleProof)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetRawWithProof indicates an expected call of GetRawWithProof
+func (mr *MockDatabaseMockRecorder) GetRawWithProof(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRawWithProof", reflect.TypeOf((*MockDatabase)(nil).GetRawWithProof), arg0)
+}
+
+// MerkleRoot mocks base method
+func (m *MockDatabase) MerkleRoot() ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MerkleRoot")
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// MerkleRoot indicates an expected call of MerkleRoot
+func (mr *MockDatabaseMockRecorder) MerkleRoot() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MerkleRoot", reflect.TypeOf((*MockDatabase)(nil).MerkleRoot))
+}
+
+// SetRawIf mocks base method
+func (m *MockDatabase) SetRawIf(arg0 string, arg1 []byte, arg2 keydb.Condition, arg3 *models.Receipt) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetRawIf", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// Set indicates an expected call of Set
-func (mr *MockDatabaseMockRecorder) Set(arg0, arg1 interface{}) *gomock.Call {
+// SetRawIf indicates an expected call of SetRawIf
+func (mr *MockDatabaseMockRecorder) SetRawIf(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetRawIf", reflect.TypeOf((*MockDatabase)(nil).SetRawIf), arg0, arg1, arg2, arg3)
+}
+
+// Delete mocks base method
+func (m *MockDatabase) Delete(arg0 string, arg1 *models.Deletion) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete
+func (mr *MockDatabaseMockRecorder) Delete(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockDatabase)(nil).Delete), arg0, arg1)
+}
+
+// Revoke mocks base method
+func (m *MockDatabase) Revoke(arg0 string, arg1 *models.Revocation) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Revoke", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Revoke indicates an expected call of Revoke
+func (mr *MockDatabaseMockRecorder) Revoke(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Revoke", reflect.TypeOf((*MockDatabase)(nil).Revoke), arg0, arg1)
+}
+
+// GetRevocation mocks base method
+func (m *MockDatabase) GetRevocation(arg0 string) (*models.Revocation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRevocation", arg0)
+	ret0, _ := ret[0].(*models.Revocation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRevocation indicates an expected call of GetRevocation
+func (mr *MockDatabaseMockRecorder) GetRevocation(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRevocation", reflect.TypeOf((*MockDatabase)(nil).GetRevocation), arg0)
+}
+
+// GetHistory mocks base method
+func (m *MockDatabase) GetHistory(arg0 string) ([]*models.AddressMetadata, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetHistory", arg0)
+	ret0, _ := ret[0].([]*models.AddressMetadata)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetHistory indicates an expected call of GetHistory
+func (mr *MockDatabaseMockRecorder) GetHistory(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetHistory", reflect.TypeOf((*MockDatabase)(nil).GetHistory), arg0)
+}
+
+// ListKind mocks base method
+func (m *MockDatabase) ListKind(kind, after string, limit int) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListKind", kind, after, limit)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListKind indicates an expected call of ListKind
+func (mr *MockDatabaseMockRecorder) ListKind(kind, after, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListKind", reflect.TypeOf((*MockDatabase)(nil).ListKind), kind, after, limit)
+}
+
+// List mocks base method
+func (m *MockDatabase) List(after string, limit int) ([]*recordio.Record, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", after, limit)
+	ret0, _ := ret[0].([]*recordio.Record)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List
+func (mr *MockDatabaseMockRecorder) List(after, limit interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Set", reflect.TypeOf((*MockDatabase)(nil).Set), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockDatabase)(nil).List), after, limit)
 }
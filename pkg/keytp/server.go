@@ -1,11 +1,17 @@
 package keytp
 
 import (
+	"context"
+	"net"
 	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/cashweb/keyserver/pkg/keydb"
 	"github.com/cashweb/keyserver/pkg/models"
 	"github.com/cashweb/keyserver/pkg/payforput"
+	"github.com/cashweb/keyserver/pkg/recordio"
+	"github.com/gcash/bchd/chaincfg"
 	"github.com/spf13/viper"
 
 	"github.com/rs/zerolog/hlog"
@@ -15,27 +21,57 @@ import (
 	"github.com/go-chi/chi/middleware"
 )
 
+// defaultMaxBodyBytes is the largest request body accepted when maxbodybytes isn't set
+const defaultMaxBodyBytes = 64 * 1024
+
 type HTTPKeyServer struct {
-	mux *chi.Mux
-	db  Database
+	mux          *chi.Mux
+	db           Database
+	params       *chaincfg.Params
+	maxBodyBytes int64
+	// enumeration allows every record to be listed through GET /keys
+	enumeration bool
+	// peers maps the IP address of each configured peer to its URL, so that the uploads it
+	// relays can be credited to it
+	peers map[string]string
 }
 
 // Data is the expected interface for an HTTPKeyServer's database
 type Database interface {
-	Get(string) (*models.AddressMetadata, error)
-	Set(string, *models.AddressMetadata) error
+	GetRaw(string) (*keydb.RawRecord, error)
+	GetRawWithProof(string) (*keydb.RawRecord, *models.MerkleProof, error)
+	MerkleRoot() ([]byte, error)
+	SetRawIf(string, []byte, keydb.Condition, *models.Receipt) error
+	Delete(string, *models.Deletion) error
+	Revoke(string, *models.Revocation) error
+	GetRevocation(string) (*models.Revocation, error)
+	GetHistory(string) ([]*models.AddressMetadata, error)
+	ListKind(kind, after string, limit int) ([]string, error)
+	List(after string, limit int) ([]*recordio.Record, error)
 }
 
-// New returns a HTTP-based keyserver that implements the REST api to handle keys
-func New(db Database) *HTTPKeyServer {
+// New returns a HTTP-based keyserver that implements the REST api to handle keys.  Keys
+// are addresses on the network described by params, and are paid for on it.
+func New(db Database, params *chaincfg.Params) *HTTPKeyServer {
+	if params == nil {
+		params = &chaincfg.MainNetParams
+	}
 	mux := chi.NewRouter()
 	setupBaseMiddleware(mux)
 	server := &HTTPKeyServer{
-		mux: mux,
-		db:  db,
+		mux:          mux,
+		db:           db,
+		params:       params,
+		maxBodyBytes: viper.GetInt64("maxbodybytes"),
+		enumeration:  viper.GetBool("enumeration"),
+		peers:        resolvePeers(viper.GetStringSlice("peers")),
+	}
+	if server.maxBodyBytes <= 0 {
+		server.maxBodyBytes = defaultMaxBodyBytes
 	}
 
-	enforcer := payforput.New("/payments", viper.GetString("secret"), nil)
+	enforcer := payforput.New("/payments", viper.GetString("secret"), params, nil)
+	enforcer.MaxBodyBytes = server.maxBodyBytes
 	mux.Route("/", func(r chi.Router) {
 		r.Get("/", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 			res.Write([]byte("You have found a keytp server."))
@@ -46,15 +82,88 @@ func New(db Database) *HTTPKeyServer {
 	})
 
 	// Install our normal paths
+	mux.Get("/keys", server.listKeys)
 	mux.Route("/keys/{keyID}", func(r chi.Router) {
 		r.With(enforcer.Middleware).Put("/", server.setKey)
 		r.Get("/", server.getKey)
+		// Deletions are free, so that users can always take their metadata down
+		r.Delete("/", server.deleteKey)
+		r.Post("/revocation", server.revokeKey)
+		r.Get("/history", server.getHistory)
 	})
+	mux.Get("/kinds/{kind}", server.listKind)
+	mux.Get("/root", server.getRoot)
 	return server
 }
 
 func setupBaseMiddleware(mux *chi.Mux) {
 	mux.Use(middleware.Timeout(10 * time.Second))
+	setupLogMiddleware(mux)
+	mux.Use(middleware.Recoverer)
+	mux.Use(middleware.URLFormat)
+}
+
+// socketAddrKey is the context key socketAddr is stored under
+type socketAddrKey struct{}
+
+// recordSocketAddr remembers the address a request's connection came from, before RealIP
+// replaces it with the one the client claims
+func recordSocketAddr(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), socketAddrKey{}, r.RemoteAddr)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// socketAddr returns the address of the connection a request came in on
+func socketAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(socketAddrKey{}).(string); ok {
+		return addr
+	}
+	return r.RemoteAddr
+}
+
+// resolvePeers maps the IP addresses of each peer URL's host to the URL.  Peers which
+// can't be resolved are logged and skipped.
+func resolvePeers(urls []string) map[string]string {
+	peers := make(map[string]string)
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Hostname() == "" {
+			log.Warn().Msgf("skipping invalid peer URL %q", rawURL)
+			continue
+		}
+		addrs, err := net.LookupHost(u.Hostname())
+		if err != nil {
+			log.Warn().Msgf("unable to resolve peer %s: %s", rawURL, err)
+			continue
+		}
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil {
+				peers[ip.String()] = rawURL
+			}
+		}
+	}
+	return peers
+}
+
+// peer returns the URL of the configured peer a request's connection came from, or "" if
+// it didn't come from one
+func (h HTTPKeyServer) peer(r *http.Request) string {
+	host, _, err := net.SplitHostPort(socketAddr(r))
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	return h.peers[ip.String()]
+}
+
+// setupLogMiddleware tags each request with an ID and logs it once it completes
+func setupLogMiddleware(mux *chi.Mux) {
+	mux.Use(recordSocketAddr)
 	mux.Use(middleware.RequestID)
 	mux.Use(middleware.RealIP)
 	mux.Use(hlog.NewHandler(log.Logger))
@@ -68,8 +177,6 @@ func setupBaseMiddleware(mux *chi.Mux) {
 			Int("status", status).
 			Msg("")
 	}))
-	mux.Use(middleware.Recoverer)
-	mux.Use(middleware.URLFormat)
 }
 
 // ListenAndServe listens and serves requests
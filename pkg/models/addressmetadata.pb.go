@@ -46,6 +46,41 @@ func (AddressMetadata_SignatureScheme) EnumDescriptor() ([]byte, []int) {
 	return fileDescriptor_0e2f0794313d73e1, []int{3, 0}
 }
 
+type Change_Type int32
+
+const (
+	// SET is metadata being stored.
+	Change_SET Change_Type = 0
+	// DELETE is metadata being deleted.
+	Change_DELETE Change_Type = 1
+	// EXPIRE is metadata being garbage collected once its TTL has passed.
+	Change_EXPIRE Change_Type = 2
+	// REVOKE is a key being revoked.
+	Change_REVOKE Change_Type = 3
+)
+
+var Change_Type_name = map[int32]string{
+	0: "SET",
+	1: "DELETE",
+	2: "EXPIRE",
+	3: "REVOKE",
+}
+
+var Change_Type_value = map[string]int32{
+	"SET":    0,
+	"DELETE": 1,
+	"EXPIRE": 2,
+	"REVOKE": 3,
+}
+
+func (x Change_Type) String() string {
+	return proto.EnumName(Change_Type_name, int32(x))
+}
+
+func (Change_Type) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_0e2f0794313d73e1, []int{10, 0}
+}
+
 // Basic key/value used to store header data.
 type Header struct {
 	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
@@ -220,7 +255,12 @@ type AddressMetadata struct {
 	Signature []byte                          `protobuf:"bytes,2,opt,name=signature,proto3" json:"signature,omitempty"`
 	Scheme    AddressMetadata_SignatureScheme `protobuf:"varint,3,opt,name=scheme,proto3,enum=models.AddressMetadata_SignatureScheme" json:"scheme,omitempty"`
 	// Payload is the metadata set by the user, and covered by the signature.
-	Payload              *Payload `protobuf:"bytes,4,opt,name=payload,proto3" json:"payload,omitempty"`
+	Payload *Payload `protobuf:"bytes,4,opt,name=payload,proto3" json:"payload,omitempty"`
+	// Redeem script for P2SH addresses.  This must be a standard m-of-n multisig script whose
+	// *hash* corresponds to the `key` in the kv store.  pub_key and signature are unused for P2SH.
+	RedeemScript []byte `protobuf:"bytes,5,opt,name=redeem_script,json=redeemScript,proto3" json:"redeem_script,omitempty"`
+	// Signatures of the payload by at least m of the pubkeys in the redeem script, in any order.
+	Signatures           [][]byte `protobuf:"bytes,6,rep,name=signatures,proto3" json:"signatures,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -279,38 +319,709 @@ func (m *AddressMetadata) GetPayload() *Payload {
 	return nil
 }
 
+func (m *AddressMetadata) GetRedeemScript() []byte {
+	if m != nil {
+		return m.RedeemScript
+	}
+	return nil
+}
+
+func (m *AddressMetadata) GetSignatures() [][]byte {
+	if m != nil {
+		return m.Signatures
+	}
+	return nil
+}
+
+// AddressMetadataHistory is the list of previously accepted versions of an address's metadata,
+// newest first.
+type AddressMetadataHistory struct {
+	Versions             []*AddressMetadata `protobuf:"bytes,1,rep,name=versions,proto3" json:"versions,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}           `json:"-"`
+	XXX_unrecognized     []byte             `json:"-"`
+	XXX_sizecache        int32              `json:"-"`
+}
+
+func (m *AddressMetadataHistory) Reset()         { *m = AddressMetadataHistory{} }
+func (m *AddressMetadataHistory) String() string { return proto.CompactTextString(m) }
+func (*AddressMetadataHistory) ProtoMessage()    {}
+func (*AddressMetadataHistory) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0e2f0794313d73e1, []int{4}
+}
+
+func (m *AddressMetadataHistory) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_AddressMetadataHistory.Unmarshal(m, b)
+}
+func (m *AddressMetadataHistory) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_AddressMetadataHistory.Marshal(b, m, deterministic)
+}
+func (m *AddressMetadataHistory) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_AddressMetadataHistory.Merge(m, src)
+}
+func (m *AddressMetadataHistory) XXX_Size() int {
+	return xxx_messageInfo_AddressMetadataHistory.Size(m)
+}
+func (m *AddressMetadataHistory) XXX_DiscardUnknown() {
+	xxx_messageInfo_AddressMetadataHistory.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_AddressMetadataHistory proto.InternalMessageInfo
+
+func (m *AddressMetadataHistory) GetVersions() []*AddressMetadata {
+	if m != nil {
+		return m.Versions
+	}
+	return nil
+}
+
+// AddressPage is a page of addresses, in key order, returned by listing endpoints such as
+// GET /kinds/{kind}.
+type AddressPage struct {
+	Addresses []string `protobuf:"bytes,1,rep,name=addresses,proto3" json:"addresses,omitempty"`
+	// Next is passed as the `after` parameter to fetch the following page.  It is empty on the
+	// last page.
+	Next                 string   `protobuf:"bytes,2,opt,name=next,proto3" json:"next,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *AddressPage) Reset()         { *m = AddressPage{} }
+func (m *AddressPage) String() string { return proto.CompactTextString(m) }
+func (*AddressPage) ProtoMessage()    {}
+func (*AddressPage) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0e2f0794313d73e1, []int{5}
+}
+
+func (m *AddressPage) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_AddressPage.Unmarshal(m, b)
+}
+func (m *AddressPage) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_AddressPage.Marshal(b, m, deterministic)
+}
+func (m *AddressPage) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_AddressPage.Merge(m, src)
+}
+func (m *AddressPage) XXX_Size() int {
+	return xxx_messageInfo_AddressPage.Size(m)
+}
+func (m *AddressPage) XXX_DiscardUnknown() {
+	xxx_messageInfo_AddressPage.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_AddressPage proto.InternalMessageInfo
+
+func (m *AddressPage) GetAddresses() []string {
+	if m != nil {
+		return m.Addresses
+	}
+	return nil
+}
+
+func (m *AddressPage) GetNext() string {
+	if m != nil {
+		return m.Next
+	}
+	return ""
+}
+
+// Deletion asks the keyserver to remove an address's metadata and history.  It is used in DELETE
+// requests, and is signed by the same key, or keys, as the metadata.  The signature covers
+// SHA256("keyserver-deletion" || 0x00 || key || timestamp), where key is the address type (0 for
+// P2PKH, 1 for P2SH) followed by its hash160, and timestamp is 8 bytes big-endian.
+type Deletion struct {
+	// Serialized pubkey whose *hash* corresponds to the `key` in the kv store.
+	PubKey []byte `protobuf:"bytes,1,opt,name=pub_key,json=pubKey,proto3" json:"pub_key,omitempty"`
+	// Signature of the deletion by pub_key.
+	Signature []byte                          `protobuf:"bytes,2,opt,name=signature,proto3" json:"signature,omitempty"`
+	Scheme    AddressMetadata_SignatureScheme `protobuf:"varint,3,opt,name=scheme,proto3,enum=models.AddressMetadata_SignatureScheme" json:"scheme,omitempty"`
+	// Timestamp must be newer than the stored metadata.  Metadata timestamped at or before it is
+	// never accepted for the address again.
+	Timestamp int64 `protobuf:"varint,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// Redeem script for P2SH addresses, as in AddressMetadata.
+	RedeemScript []byte `protobuf:"bytes,5,opt,name=redeem_script,json=redeemScript,proto3" json:"redeem_script,omitempty"`
+	// Signatures by at least m of the pubkeys in the redeem script, in any order.
+	Signatures           [][]byte `protobuf:"bytes,6,rep,name=signatures,proto3" json:"signatures,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Deletion) Reset()         { *m = Deletion{} }
+func (m *Deletion) String() string { return proto.CompactTextString(m) }
+func (*Deletion) ProtoMessage()    {}
+func (*Deletion) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0e2f0794313d73e1, []int{6}
+}
+
+func (m *Deletion) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Deletion.Unmarshal(m, b)
+}
+func (m *Deletion) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Deletion.Marshal(b, m, deterministic)
+}
+func (m *Deletion) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Deletion.Merge(m, src)
+}
+func (m *Deletion) XXX_Size() int {
+	return xxx_messageInfo_Deletion.Size(m)
+}
+func (m *Deletion) XXX_DiscardUnknown() {
+	xxx_messageInfo_Deletion.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Deletion proto.InternalMessageInfo
+
+func (m *Deletion) GetPubKey() []byte {
+	if m != nil {
+		return m.PubKey
+	}
+	return nil
+}
+
+func (m *Deletion) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+func (m *Deletion) GetScheme() AddressMetadata_SignatureScheme {
+	if m != nil {
+		return m.Scheme
+	}
+	return AddressMetadata_SCHNORR
+}
+
+func (m *Deletion) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *Deletion) GetRedeemScript() []byte {
+	if m != nil {
+		return m.RedeemScript
+	}
+	return nil
+}
+
+func (m *Deletion) GetSignatures() [][]byte {
+	if m != nil {
+		return m.Signatures
+	}
+	return nil
+}
+
+// Revocation permanently marks an address's key as compromised.  Once accepted, the keyserver
+// serves it in place of the address's metadata, and never accepts metadata for the address
+// again.  It is signed like a Deletion, but the signature covers
+// SHA256("keyserver-revocation" || 0x00 || key || timestamp || reason).
+type Revocation struct {
+	// Serialized pubkey whose *hash* corresponds to the `key` in the kv store.
+	PubKey []byte `protobuf:"bytes,1,opt,name=pub_key,json=pubKey,proto3" json:"pub_key,omitempty"`
+	// Signature of the revocation by pub_key.
+	Signature []byte                          `protobuf:"bytes,2,opt,name=signature,proto3" json:"signature,omitempty"`
+	Scheme    AddressMetadata_SignatureScheme `protobuf:"varint,3,opt,name=scheme,proto3,enum=models.AddressMetadata_SignatureScheme" json:"scheme,omitempty"`
+	// Timestamp at which the key was revoked.
+	Timestamp int64 `protobuf:"varint,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// Reason is a human readable explanation for wallets to show their users.
+	Reason string `protobuf:"bytes,5,opt,name=reason,proto3" json:"reason,omitempty"`
+	// Redeem script for P2SH addresses, as in AddressMetadata.
+	RedeemScript []byte `protobuf:"bytes,6,opt,name=redeem_script,json=redeemScript,proto3" json:"redeem_script,omitempty"`
+	// Signatures by at least m of the pubkeys in the redeem script, in any order.
+	Signatures           [][]byte `protobuf:"bytes,7,rep,name=signatures,proto3" json:"signatures,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Revocation) Reset()         { *m = Revocation{} }
+func (m *Revocation) String() string { return proto.CompactTextString(m) }
+func (*Revocation) ProtoMessage()    {}
+func (*Revocation) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0e2f0794313d73e1, []int{7}
+}
+
+func (m *Revocation) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Revocation.Unmarshal(m, b)
+}
+func (m *Revocation) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Revocation.Marshal(b, m, deterministic)
+}
+func (m *Revocation) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Revocation.Merge(m, src)
+}
+func (m *Revocation) XXX_Size() int {
+	return xxx_messageInfo_Revocation.Size(m)
+}
+func (m *Revocation) XXX_DiscardUnknown() {
+	xxx_messageInfo_Revocation.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Revocation proto.InternalMessageInfo
+
+func (m *Revocation) GetPubKey() []byte {
+	if m != nil {
+		return m.PubKey
+	}
+	return nil
+}
+
+func (m *Revocation) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+func (m *Revocation) GetScheme() AddressMetadata_SignatureScheme {
+	if m != nil {
+		return m.Scheme
+	}
+	return AddressMetadata_SCHNORR
+}
+
+func (m *Revocation) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *Revocation) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
+func (m *Revocation) GetRedeemScript() []byte {
+	if m != nil {
+		return m.RedeemScript
+	}
+	return nil
+}
+
+func (m *Revocation) GetSignatures() [][]byte {
+	if m != nil {
+		return m.Signatures
+	}
+	return nil
+}
+
+// Record is a single address's entry in the stream written by `keyserverd export` and read by
+// `keyserverd import`.  Exactly one of metadata and revocation is set.  See docs/export.md.
+type Record struct {
+	// Address is the cashaddr, with its network prefix, that the record is stored under.
+	Address string `protobuf:"bytes,1,opt,name=address,proto3" json:"address,omitempty"`
+	// Metadata is the address's current metadata.
+	Metadata *AddressMetadata `protobuf:"bytes,2,opt,name=metadata,proto3" json:"metadata,omitempty"`
+	// Revocation is set instead of metadata for addresses whose key has been revoked.
+	Revocation           *Revocation `protobuf:"bytes,3,opt,name=revocation,proto3" json:"revocation,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}    `json:"-"`
+	XXX_unrecognized     []byte      `json:"-"`
+	XXX_sizecache        int32       `json:"-"`
+}
+
+func (m *Record) Reset()         { *m = Record{} }
+func (m *Record) String() string { return proto.CompactTextString(m) }
+func (*Record) ProtoMessage()    {}
+func (*Record) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0e2f0794313d73e1, []int{8}
+}
+
+func (m *Record) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Record.Unmarshal(m, b)
+}
+func (m *Record) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Record.Marshal(b, m, deterministic)
+}
+func (m *Record) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Record.Merge(m, src)
+}
+func (m *Record) XXX_Size() int {
+	return xxx_messageInfo_Record.Size(m)
+}
+func (m *Record) XXX_DiscardUnknown() {
+	xxx_messageInfo_Record.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Record proto.InternalMessageInfo
+
+func (m *Record) GetAddress() string {
+	if m != nil {
+		return m.Address
+	}
+	return ""
+}
+
+func (m *Record) GetMetadata() *AddressMetadata {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+func (m *Record) GetRevocation() *Revocation {
+	if m != nil {
+		return m.Revocation
+	}
+	return nil
+}
+
+// RecordPage is a page of records, in key order, returned by GET /keys.
+type RecordPage struct {
+	Records []*Record `protobuf:"bytes,1,rep,name=records,proto3" json:"records,omitempty"`
+	// Next is passed as the `after` parameter to fetch the following page.  It is empty on the
+	// last page.
+	Next                 string   `protobuf:"bytes,2,opt,name=next,proto3" json:"next,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RecordPage) Reset()         { *m = RecordPage{} }
+func (m *RecordPage) String() string { return proto.CompactTextString(m) }
+func (*RecordPage) ProtoMessage()    {}
+func (*RecordPage) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0e2f0794313d73e1, []int{9}
+}
+
+func (m *RecordPage) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RecordPage.Unmarshal(m, b)
+}
+func (m *RecordPage) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RecordPage.Marshal(b, m, deterministic)
+}
+func (m *RecordPage) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RecordPage.Merge(m, src)
+}
+func (m *RecordPage) XXX_Size() int {
+	return xxx_messageInfo_RecordPage.Size(m)
+}
+func (m *RecordPage) XXX_DiscardUnknown() {
+	xxx_messageInfo_RecordPage.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RecordPage proto.InternalMessageInfo
+
+func (m *RecordPage) GetRecords() []*Record {
+	if m != nil {
+		return m.Records
+	}
+	return nil
+}
+
+func (m *RecordPage) GetNext() string {
+	if m != nil {
+		return m.Next
+	}
+	return ""
+}
+
+// Change is an update accepted by a keyserver, as published in its change feed.
+type Change struct {
+	// Sequence numbers changes in the order they were accepted, starting from 1.
+	Sequence uint64      `protobuf:"varint,1,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	Type     Change_Type `protobuf:"varint,2,opt,name=type,proto3,enum=models.Change_Type" json:"type,omitempty"`
+	// Address is the cashaddr, with its network prefix, that was changed.
+	Address string `protobuf:"bytes,3,opt,name=address,proto3" json:"address,omitempty"`
+	// Timestamp is that of the metadata which was set or expired, or of the deletion or
+	// revocation.
+	Timestamp            int64    `protobuf:"varint,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Change) Reset()         { *m = Change{} }
+func (m *Change) String() string { return proto.CompactTextString(m) }
+func (*Change) ProtoMessage()    {}
+func (*Change) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0e2f0794313d73e1, []int{10}
+}
+
+func (m *Change) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Change.Unmarshal(m, b)
+}
+func (m *Change) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Change.Marshal(b, m, deterministic)
+}
+func (m *Change) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Change.Merge(m, src)
+}
+func (m *Change) XXX_Size() int {
+	return xxx_messageInfo_Change.Size(m)
+}
+func (m *Change) XXX_DiscardUnknown() {
+	xxx_messageInfo_Change.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Change proto.InternalMessageInfo
+
+func (m *Change) GetSequence() uint64 {
+	if m != nil {
+		return m.Sequence
+	}
+	return 0
+}
+
+func (m *Change) GetType() Change_Type {
+	if m != nil {
+		return m.Type
+	}
+	return Change_SET
+}
+
+func (m *Change) GetAddress() string {
+	if m != nil {
+		return m.Address
+	}
+	return ""
+}
+
+func (m *Change) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+// MerkleProof proves that an address's metadata is, or isn't, committed to by the root of a
+// keyserver's sparse Merkle tree.  See docs/merkle.md.
+type MerkleProof struct {
+	// Root is the root hash of the tree the proof is against.
+	Root []byte `protobuf:"bytes,1,opt,name=root,proto3" json:"root,omitempty"`
+	// Siblings are the hashes of the sibling subtrees on the path from the root to the
+	// address's position, root first.
+	Siblings [][]byte `protobuf:"bytes,2,rep,name=siblings,proto3" json:"siblings,omitempty"`
+	// LeafPath and LeafValue describe the only leaf beneath the address's position, if there
+	// is one.  Proofs of inclusion give the address's own leaf, while proofs of
+	// non-inclusion give another address's, or none if the position is empty.
+	LeafPath             []byte   `protobuf:"bytes,3,opt,name=leaf_path,json=leafPath,proto3" json:"leaf_path,omitempty"`
+	LeafValue            []byte   `protobuf:"bytes,4,opt,name=leaf_value,json=leafValue,proto3" json:"leaf_value,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *MerkleProof) Reset()         { *m = MerkleProof{} }
+func (m *MerkleProof) String() string { return proto.CompactTextString(m) }
+func (*MerkleProof) ProtoMessage()    {}
+func (*MerkleProof) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0e2f0794313d73e1, []int{11}
+}
+
+func (m *MerkleProof) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_MerkleProof.Unmarshal(m, b)
+}
+func (m *MerkleProof) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_MerkleProof.Marshal(b, m, deterministic)
+}
+func (m *MerkleProof) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MerkleProof.Merge(m, src)
+}
+func (m *MerkleProof) XXX_Size() int {
+	return xxx_messageInfo_MerkleProof.Size(m)
+}
+func (m *MerkleProof) XXX_DiscardUnknown() {
+	xxx_messageInfo_MerkleProof.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MerkleProof proto.InternalMessageInfo
+
+func (m *MerkleProof) GetRoot() []byte {
+	if m != nil {
+		return m.Root
+	}
+	return nil
+}
+
+func (m *MerkleProof) GetSiblings() [][]byte {
+	if m != nil {
+		return m.Siblings
+	}
+	return nil
+}
+
+func (m *MerkleProof) GetLeafPath() []byte {
+	if m != nil {
+		return m.LeafPath
+	}
+	return nil
+}
+
+func (m *MerkleProof) GetLeafValue() []byte {
+	if m != nil {
+		return m.LeafValue
+	}
+	return nil
+}
+
+// Receipt records how a keyserver came by the current version of an address's metadata.  It's
+// kept alongside the record for the server's operators, and is never served publicly.
+type Receipt struct {
+	// ReceivedAt is the Unix time the metadata was accepted.
+	ReceivedAt int64 `protobuf:"varint,1,opt,name=received_at,json=receivedAt,proto3" json:"received_at,omitempty"`
+	// RequestId is the ID the upload was logged under.
+	RequestId string `protobuf:"bytes,2,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	// RemoteAddr is the address of the connection the metadata was uploaded over.
+	RemoteAddr string `protobuf:"bytes,3,opt,name=remote_addr,json=remoteAddr,proto3" json:"remote_addr,omitempty"`
+	// PaymentTokenHash is the SHA-256 of the payment token which authorized the upload.  The
+	// token itself isn't kept, since it could be used to upload again.
+	PaymentTokenHash []byte `protobuf:"bytes,4,opt,name=payment_token_hash,json=paymentTokenHash,proto3" json:"payment_token_hash,omitempty"`
+	// Peer is where the metadata came from, if it wasn't uploaded to this keyserver directly:
+	// the URL of the peer which relayed it, or the source it was imported from.
+	Peer string `protobuf:"bytes,5,opt,name=peer,proto3" json:"peer,omitempty"`
+	// ForwardedFor is the client address claimed by the upload's X-Forwarded-For or X-Real-IP
+	// header.  It's supplied by the client, or a proxy in front of this server, and is unverified.
+	ForwardedFor         string   `protobuf:"bytes,6,opt,name=forwarded_for,json=forwardedFor,proto3" json:"forwarded_for,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Receipt) Reset()         { *m = Receipt{} }
+func (m *Receipt) String() string { return proto.CompactTextString(m) }
+func (*Receipt) ProtoMessage()    {}
+func (*Receipt) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0e2f0794313d73e1, []int{12}
+}
+
+func (m *Receipt) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Receipt.Unmarshal(m, b)
+}
+func (m *Receipt) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Receipt.Marshal(b, m, deterministic)
+}
+func (m *Receipt) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Receipt.Merge(m, src)
+}
+func (m *Receipt) XXX_Size() int {
+	return xxx_messageInfo_Receipt.Size(m)
+}
+func (m *Receipt) XXX_DiscardUnknown() {
+	xxx_messageInfo_Receipt.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Receipt proto.InternalMessageInfo
+
+func (m *Receipt) GetReceivedAt() int64 {
+	if m != nil {
+		return m.ReceivedAt
+	}
+	return 0
+}
+
+func (m *Receipt) GetRequestId() string {
+	if m != nil {
+		return m.RequestId
+	}
+	return ""
+}
+
+func (m *Receipt) GetRemoteAddr() string {
+	if m != nil {
+		return m.RemoteAddr
+	}
+	return ""
+}
+
+func (m *Receipt) GetPaymentTokenHash() []byte {
+	if m != nil {
+		return m.PaymentTokenHash
+	}
+	return nil
+}
+
+func (m *Receipt) GetPeer() string {
+	if m != nil {
+		return m.Peer
+	}
+	return ""
+}
+
+func (m *Receipt) GetForwardedFor() string {
+	if m != nil {
+		return m.ForwardedFor
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterEnum("models.AddressMetadata_SignatureScheme", AddressMetadata_SignatureScheme_name, AddressMetadata_SignatureScheme_value)
+	proto.RegisterEnum("models.Change_Type", Change_Type_name, Change_Type_value)
 	proto.RegisterType((*Header)(nil), "models.Header")
 	proto.RegisterType((*Entry)(nil), "models.Entry")
 	proto.RegisterType((*Payload)(nil), "models.Payload")
 	proto.RegisterType((*AddressMetadata)(nil), "models.AddressMetadata")
+	proto.RegisterType((*AddressMetadataHistory)(nil), "models.AddressMetadataHistory")
+	proto.RegisterType((*AddressPage)(nil), "models.AddressPage")
+	proto.RegisterType((*Deletion)(nil), "models.Deletion")
+	proto.RegisterType((*Revocation)(nil), "models.Revocation")
+	proto.RegisterType((*Record)(nil), "models.Record")
+	proto.RegisterType((*RecordPage)(nil), "models.RecordPage")
+	proto.RegisterType((*Change)(nil), "models.Change")
+	proto.RegisterType((*MerkleProof)(nil), "models.MerkleProof")
+	proto.RegisterType((*Receipt)(nil), "models.Receipt")
 }
 
 func init() { proto.RegisterFile("addressmetadata.proto", fileDescriptor_0e2f0794313d73e1) }
 
 var fileDescriptor_0e2f0794313d73e1 = []byte{
-	// 337 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x5c, 0x51, 0xcb, 0x6a, 0xf2, 0x40,
-	0x14, 0xfe, 0x63, 0x34, 0x21, 0x47, 0x7f, 0x95, 0xa1, 0xa5, 0x59, 0xb4, 0x10, 0xb2, 0x31, 0x6e,
-	0xb2, 0x48, 0x1f, 0xa0, 0x88, 0x0a, 0x42, 0xe9, 0x85, 0xc9, 0x03, 0xc8, 0xa4, 0x73, 0xa8, 0xc1,
-	0xdc, 0xc8, 0x4c, 0x0a, 0x79, 0xda, 0xbe, 0x4a, 0x99, 0x89, 0x83, 0xe0, 0xee, 0xe4, 0x3b, 0xf9,
-	0x2e, 0xe7, 0x1b, 0xb8, 0x67, 0x9c, 0xb7, 0x28, 0x44, 0x89, 0x92, 0x71, 0x26, 0x59, 0xdc, 0xb4,
-	0xb5, 0xac, 0x89, 0x53, 0xd6, 0x1c, 0x0b, 0x11, 0x26, 0xe0, 0x1c, 0x90, 0x71, 0x6c, 0x09, 0x81,
-	0x71, 0xc5, 0x4a, 0xf4, 0xad, 0xc0, 0x8a, 0x3c, 0xaa, 0x67, 0x72, 0x07, 0x93, 0x1f, 0x56, 0x74,
-	0xe8, 0x8f, 0x34, 0x38, 0x7c, 0x84, 0x1c, 0x26, 0xfb, 0x4a, 0xb6, 0xbd, 0xa2, 0x9c, 0xf3, 0x8a,
-	0x1b, 0x8a, 0x9a, 0x49, 0x04, 0xee, 0x49, 0x0b, 0x0a, 0x7f, 0x14, 0xd8, 0xd1, 0x34, 0x99, 0xc7,
-	0x83, 0x55, 0x3c, 0xf8, 0x50, 0xb3, 0x26, 0x4f, 0x00, 0xa8, 0x64, 0x8e, 0x2a, 0x96, 0x6f, 0x07,
-	0x56, 0x34, 0xa3, 0x9e, 0x46, 0x76, 0x4c, 0xb2, 0x30, 0x03, 0xf7, 0x93, 0xf5, 0x45, 0xcd, 0x38,
-	0x79, 0x04, 0x4f, 0xe6, 0x25, 0x0a, 0xc9, 0xca, 0x46, 0x9b, 0xd9, 0xf4, 0x0a, 0x90, 0x25, 0xd8,
-	0x52, 0x16, 0x3a, 0xa2, 0x4d, 0xd5, 0x48, 0x56, 0xe0, 0x2a, 0x9d, 0x1c, 0x85, 0x6f, 0xeb, 0x0c,
-	0xff, 0x4d, 0x06, 0x9d, 0x9b, 0x9a, 0x6d, 0xf8, 0x6b, 0xc1, 0x62, 0x33, 0xf4, 0xf3, 0x76, 0xe9,
-	0x87, 0x3c, 0x80, 0xdb, 0x74, 0xd9, 0xf1, 0x8c, 0xbd, 0xb6, 0x9a, 0x51, 0xa7, 0xe9, 0xb2, 0x57,
-	0xec, 0x55, 0x0a, 0x91, 0x7f, 0x57, 0x4c, 0x76, 0xed, 0x50, 0xc8, 0x8c, 0x5e, 0x01, 0xf2, 0x02,
-	0x8e, 0xf8, 0x3a, 0x61, 0x89, 0xfa, 0x92, 0x79, 0xb2, 0x32, 0x96, 0x37, 0xfa, 0x71, 0x6a, 0x28,
-	0xa9, 0xfe, 0x9d, 0x5e, 0x68, 0x64, 0x0d, 0x6e, 0x33, 0xdc, 0xeb, 0x8f, 0x03, 0x2b, 0x9a, 0x26,
-	0x0b, 0xa3, 0x70, 0xa9, 0x81, 0x9a, 0x7d, 0xb8, 0x86, 0xc5, 0x8d, 0x0a, 0x99, 0x82, 0x9b, 0x6e,
-	0x0f, 0xef, 0x1f, 0x94, 0x2e, 0xff, 0x11, 0x0f, 0x26, 0xfb, 0xed, 0x2e, 0xdd, 0x2c, 0xad, 0xcc,
-	0xd1, 0xcf, 0xfd, 0xfc, 0x17, 0x00, 0x00, 0xff, 0xff, 0x49, 0x55, 0xb9, 0x22, 0x07, 0x02, 0x00,
-	0x00,
+	// 826 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xcc, 0x55, 0x5d, 0x6e, 0xe3, 0x36,
+	0x10, 0x5e, 0x45, 0x8e, 0x14, 0x8d, 0xbd, 0x89, 0xc1, 0xb6, 0xbb, 0x42, 0x7f, 0x0d, 0xf5, 0x21,
+	0x5e, 0xa0, 0xf0, 0x83, 0x73, 0x80, 0x45, 0x90, 0xa8, 0xc8, 0x76, 0x9b, 0xae, 0x41, 0x07, 0x8b,
+	0xbe, 0x09, 0xb4, 0x35, 0x89, 0x85, 0x58, 0xa2, 0x4a, 0xd2, 0x69, 0x75, 0x86, 0x5e, 0xa3, 0xa7,
+	0xe8, 0x2d, 0x7a, 0x88, 0x9e, 0xa3, 0x05, 0xff, 0xec, 0x6c, 0xb6, 0x4d, 0x5f, 0x0a, 0xb4, 0x6f,
+	0xc3, 0x6f, 0x38, 0xc3, 0x99, 0x8f, 0x1f, 0x39, 0xf0, 0x11, 0x2b, 0x4b, 0x81, 0x52, 0xd6, 0xa8,
+	0x58, 0xc9, 0x14, 0x9b, 0xb4, 0x82, 0x2b, 0x4e, 0xa2, 0x9a, 0x97, 0xb8, 0x96, 0xd9, 0x14, 0xa2,
+	0x0b, 0x64, 0x25, 0x0a, 0x42, 0xa0, 0xd7, 0xb0, 0x1a, 0xd3, 0x60, 0x14, 0x8c, 0x13, 0x6a, 0x6c,
+	0xf2, 0x21, 0xec, 0xdf, 0xb1, 0xf5, 0x06, 0xd3, 0x3d, 0x03, 0xda, 0x45, 0x56, 0xc2, 0x7e, 0xde,
+	0x28, 0xd1, 0xe9, 0x90, 0xdb, 0xaa, 0x29, 0x7d, 0x88, 0xb6, 0xc9, 0x18, 0xe2, 0x95, 0x49, 0x28,
+	0xd3, 0xbd, 0x51, 0x38, 0xee, 0x4f, 0x0f, 0x27, 0xf6, 0xa8, 0x89, 0x3d, 0x87, 0x7a, 0x37, 0xf9,
+	0x0c, 0x00, 0x75, 0x9a, 0x42, 0x97, 0x95, 0x86, 0xa3, 0x60, 0x3c, 0xa0, 0x89, 0x41, 0xce, 0x99,
+	0x62, 0xd9, 0x02, 0xe2, 0x19, 0xeb, 0xd6, 0x9c, 0x95, 0xe4, 0x53, 0x48, 0x54, 0x55, 0xa3, 0x54,
+	0xac, 0x6e, 0xcd, 0x61, 0x21, 0xdd, 0x01, 0x64, 0x08, 0xa1, 0x52, 0x6b, 0x53, 0x62, 0x48, 0xb5,
+	0x49, 0x8e, 0x21, 0xd6, 0x79, 0x2a, 0x94, 0x69, 0x68, 0x6a, 0x78, 0xea, 0x6b, 0x30, 0x75, 0x53,
+	0xef, 0xcd, 0x7e, 0xd9, 0x83, 0xa3, 0x53, 0xcb, 0xcf, 0xa5, 0xe3, 0x87, 0x3c, 0x87, 0xb8, 0xdd,
+	0x2c, 0x8a, 0x5b, 0xec, 0xcc, 0x51, 0x03, 0x1a, 0xb5, 0x9b, 0xc5, 0x6b, 0xec, 0x74, 0x15, 0xb2,
+	0xba, 0x69, 0x98, 0xda, 0x08, 0x4b, 0xc8, 0x80, 0xee, 0x00, 0xf2, 0x12, 0x22, 0xb9, 0x5c, 0x61,
+	0x8d, 0xa6, 0x93, 0xc3, 0xe9, 0xb1, 0x3f, 0xf2, 0x41, 0xfe, 0xc9, 0xdc, 0x87, 0xcc, 0xcd, 0x76,
+	0xea, 0xc2, 0xc8, 0x0b, 0x88, 0x5b, 0xdb, 0x6f, 0xda, 0x1b, 0x05, 0xe3, 0xfe, 0xf4, 0xc8, 0x67,
+	0x70, 0x34, 0x50, 0xef, 0x27, 0x5f, 0xc2, 0x53, 0x81, 0x25, 0x62, 0x5d, 0xc8, 0xa5, 0xa8, 0x5a,
+	0x95, 0xee, 0x9b, 0x6a, 0x06, 0x16, 0x9c, 0x1b, 0x8c, 0x7c, 0x0e, 0xb0, 0xad, 0x4e, 0xa6, 0xd1,
+	0x28, 0x1c, 0x0f, 0xe8, 0x3d, 0x24, 0x7b, 0x01, 0x47, 0x0f, 0x4a, 0x21, 0x7d, 0x88, 0xe7, 0x67,
+	0x17, 0xdf, 0xbd, 0xa1, 0x74, 0xf8, 0x84, 0x24, 0xb0, 0x9f, 0x9f, 0x9d, 0xcf, 0x4f, 0x87, 0x41,
+	0x76, 0x09, 0xcf, 0x1e, 0x74, 0x71, 0x51, 0x49, 0xc5, 0x45, 0x47, 0x4e, 0xe0, 0xe0, 0x0e, 0x85,
+	0xac, 0x78, 0x23, 0xd3, 0xc0, 0x50, 0xfd, 0xfc, 0x6f, 0xfa, 0xa6, 0xdb, 0x8d, 0xd9, 0x4b, 0xe8,
+	0x3b, 0xe7, 0x8c, 0xdd, 0xa0, 0xe6, 0xd5, 0x69, 0x14, 0x6d, 0x92, 0x84, 0xee, 0x00, 0x23, 0x4b,
+	0xfc, 0x49, 0x39, 0x05, 0x1a, 0x3b, 0xfb, 0x3d, 0x80, 0x83, 0x73, 0x5c, 0xa3, 0xaa, 0x78, 0xf3,
+	0x9f, 0xdd, 0xd7, 0x3b, 0xa2, 0xec, 0x3d, 0x14, 0xe5, 0xbf, 0x72, 0x45, 0x7f, 0x04, 0x00, 0x14,
+	0xef, 0xf8, 0x92, 0xfd, 0x8f, 0x3b, 0x7d, 0x06, 0x91, 0x40, 0x26, 0x79, 0x63, 0x5a, 0x4c, 0xa8,
+	0x5b, 0xbd, 0xcf, 0x40, 0xf4, 0x8f, 0x0c, 0xc4, 0xef, 0x31, 0xf0, 0x73, 0x00, 0x11, 0xc5, 0x25,
+	0x17, 0x25, 0x49, 0x21, 0x76, 0xaa, 0x70, 0xff, 0x8d, 0x5f, 0x6a, 0x11, 0xfa, 0xdf, 0xcd, 0x74,
+	0xff, 0x98, 0x08, 0xfd, 0x46, 0x32, 0x05, 0x10, 0x5b, 0x6a, 0x0d, 0x33, 0xfd, 0x29, 0xf1, 0x61,
+	0x3b, 0xd2, 0xe9, 0xbd, 0x5d, 0xd9, 0x37, 0x00, 0xb6, 0x18, 0xa3, 0xdb, 0x31, 0xc4, 0xc2, 0xac,
+	0xbc, 0xf4, 0x0f, 0x77, 0xe1, 0x1a, 0xa6, 0xde, 0xfd, 0x97, 0x1a, 0xfe, 0x35, 0x80, 0xe8, 0x6c,
+	0xc5, 0x9a, 0x1b, 0x24, 0x1f, 0xc3, 0x81, 0xc4, 0x1f, 0x36, 0xd8, 0x2c, 0xed, 0xef, 0xdb, 0xa3,
+	0xdb, 0x35, 0x39, 0x86, 0x9e, 0xea, 0x5a, 0x7b, 0xab, 0x87, 0xd3, 0x0f, 0xfc, 0x09, 0x36, 0x72,
+	0x72, 0xd5, 0xb5, 0x48, 0xcd, 0x86, 0xfb, 0xf4, 0x84, 0xef, 0xd2, 0xf3, 0xe8, 0xf5, 0x65, 0x27,
+	0xd0, 0xd3, 0x59, 0x48, 0x0c, 0xe1, 0x3c, 0xbf, 0x1a, 0x3e, 0x21, 0x00, 0xd1, 0x79, 0xfe, 0x6d,
+	0x7e, 0x95, 0x0f, 0x03, 0x6d, 0xe7, 0xdf, 0xcf, 0x5e, 0xd1, 0x7c, 0xb8, 0xa7, 0x6d, 0x9a, 0xbf,
+	0x7d, 0xf3, 0x3a, 0x1f, 0x86, 0x59, 0x07, 0xfd, 0x4b, 0x14, 0xb7, 0x6b, 0x9c, 0x09, 0xce, 0xaf,
+	0x75, 0x7f, 0x82, 0x73, 0xe5, 0x54, 0x69, 0x6c, 0xd3, 0x54, 0xb5, 0x58, 0x57, 0xcd, 0x8d, 0x1d,
+	0x04, 0x03, 0xba, 0x5d, 0x93, 0x4f, 0x20, 0x59, 0x23, 0xbb, 0x2e, 0x5a, 0xa6, 0x56, 0xee, 0xe3,
+	0x3f, 0xd0, 0xc0, 0x8c, 0xa9, 0x95, 0x1e, 0x0b, 0xc6, 0x69, 0x07, 0x4f, 0xcf, 0xaa, 0x59, 0x23,
+	0x6f, 0xcd, 0xf0, 0xf9, 0x2d, 0x80, 0x98, 0xe2, 0x12, 0xb5, 0x7a, 0xbe, 0x80, 0xbe, 0xd0, 0xe6,
+	0x1d, 0x96, 0x05, 0x53, 0x6e, 0x32, 0x80, 0x87, 0x4e, 0x95, 0xce, 0x25, 0x34, 0x93, 0x52, 0x15,
+	0x55, 0xe9, 0xe8, 0x4f, 0x1c, 0xf2, 0xaa, 0xb4, 0xf1, 0x35, 0x57, 0x58, 0x68, 0xae, 0x1c, 0x6f,
+	0x60, 0x21, 0xad, 0x1c, 0xf2, 0x15, 0x90, 0x96, 0x75, 0x35, 0x36, 0xaa, 0x50, 0xfc, 0x16, 0x9b,
+	0x62, 0xc5, 0xe4, 0xca, 0xd5, 0x34, 0x74, 0x9e, 0x2b, 0xed, 0xb8, 0x60, 0x72, 0xa5, 0x69, 0x68,
+	0x11, 0x85, 0x7b, 0x07, 0xc6, 0xd6, 0xaf, 0xe0, 0x9a, 0x8b, 0x1f, 0x99, 0x28, 0xb1, 0x2c, 0xae,
+	0xb9, 0x30, 0xaf, 0x20, 0xa1, 0x83, 0x2d, 0xf8, 0x35, 0x17, 0x8b, 0xc8, 0xcc, 0xe4, 0x93, 0x3f,
+	0x07, 0x00, 0x26, 0x25, 0x9e, 0x69, 0xac, 0x07, 0x00, 0x00,
 }
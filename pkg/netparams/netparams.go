@@ -0,0 +1,62 @@
+// Package netparams maps the network names used to configure keyserverd onto the chain
+// parameters for each Bitcoin Cash network.
+package netparams
+
+import (
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/gcash/bchd/wire"
+	"github.com/pkg/errors"
+)
+
+// testNet4 is the magic for testnet4, which bchd's wire package doesn't know about yet
+const testNet4 wire.BitcoinNet = 0xafdab7e2
+
+// TestNet4Params are the parameters for the version 4 test network.  The version of bchd
+// we build against predates testnet4, so only the fields needed to encode and decode
+// addresses are set.  Addresses use the same prefix and version bytes as testnet3.
+var TestNet4Params = chaincfg.Params{
+	Name:        "testnet4",
+	Net:         testNet4,
+	DefaultPort: "28333",
+
+	CashAddressPrefix:      chaincfg.TestNet3Params.CashAddressPrefix,
+	LegacyPubKeyHashAddrID: chaincfg.TestNet3Params.LegacyPubKeyHashAddrID,
+	LegacyScriptHashAddrID: chaincfg.TestNet3Params.LegacyScriptHashAddrID,
+	PrivateKeyID:           chaincfg.TestNet3Params.PrivateKeyID,
+	HDPrivateKeyID:         chaincfg.TestNet3Params.HDPrivateKeyID,
+	HDPublicKeyID:          chaincfg.TestNet3Params.HDPublicKeyID,
+	HDCoinType:             chaincfg.TestNet3Params.HDCoinType,
+}
+
+// ErrUnknownNetwork is returned when looking up a network which doesn't exist
+var ErrUnknownNetwork = errors.New("unknown network")
+
+// networks are the networks keyserverd can run on, by name
+var networks = map[string]*chaincfg.Params{
+	chaincfg.MainNetParams.Name:       &chaincfg.MainNetParams,
+	chaincfg.TestNet3Params.Name:      &chaincfg.TestNet3Params,
+	TestNet4Params.Name:               &TestNet4Params,
+	chaincfg.RegressionNetParams.Name: &chaincfg.RegressionNetParams,
+}
+
+// Lookup returns the parameters for the network with the given name: mainnet, testnet3,
+// testnet4 or regtest.
+func Lookup(name string) (*chaincfg.Params, error) {
+	params, ok := networks[name]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownNetwork, "network %q", name)
+	}
+	return params, nil
+}
+
+// BIP70Name returns the name of the network as used in the network field of BIP70
+// PaymentDetails.
+func BIP70Name(params *chaincfg.Params) string {
+	switch params.Name {
+	case chaincfg.MainNetParams.Name:
+		return "main"
+	case chaincfg.RegressionNetParams.Name:
+		return "regtest"
+	}
+	return "test"
+}
@@ -0,0 +1,42 @@
+package netparams
+
+import (
+	"testing"
+
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/gcash/bchutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookup(t *testing.T) {
+	assert := assert.New(t)
+
+	for name, bip70 := range map[string]string{
+		"mainnet":  "main",
+		"testnet3": "test",
+		"testnet4": "test",
+		"regtest":  "regtest",
+	} {
+		params, err := Lookup(name)
+		assert.Nil(err)
+		assert.Equal(name, params.Name)
+		assert.Equal(bip70, BIP70Name(params))
+	}
+
+	_, err := Lookup("simnet")
+	assert.NotNil(err)
+}
+
+func TestTestNet4Addresses(t *testing.T) {
+	assert := assert.New(t)
+
+	hash := make([]byte, 20)
+	addr, err := bchutil.NewAddressPubKeyHash(hash, &TestNet4Params)
+	assert.Nil(err)
+	assert.Equal("qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqdpn3jdgd", addr.String())
+
+	decoded, err := bchutil.DecodeAddress("bchtest:"+addr.String(), &TestNet4Params)
+	assert.Nil(err)
+	assert.True(decoded.IsForNet(&TestNet4Params))
+	assert.False(decoded.IsForNet(&chaincfg.MainNetParams))
+}
@@ -7,14 +7,20 @@ import (
 	"time"
 
 	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/cashweb/keyserver/pkg/netparams"
 
+	"github.com/gcash/bchd/chaincfg"
 	"github.com/golang/protobuf/proto"
 	"github.com/rs/zerolog/hlog"
 )
 
+// DefaultMaxBodyBytes is the largest Payment accepted when MaxBodyBytes isn't set
+const DefaultMaxBodyBytes = 64 * 1024
+
 // ValidatorFunc is the type of unction which can indicate if a request has
-// the appropriate headers to have been paid.
-type ValidatorFunc func(r *http.Request, secret string) bool
+// the appropriate headers to have been paid.  The network is the BIP70 name of
+// the network the payment must have been made on.
+type ValidatorFunc func(r *http.Request, secret, network string) bool
 
 // PaymentEnforcer ensures that the request has been paid for properly by
 // checking for a payment authorization. If there is no payment authorization
@@ -29,19 +35,29 @@ type PaymentEnforcer struct {
 	// Secret is the HMAC secret used for generating and validating tokens
 	// NOTE: This may be swapped out at a later date.
 	Secret string
+	// ChainParams is the network payments are requested and verified on
+	ChainParams *chaincfg.Params
+	// MaxBodyBytes is the size of the largest Payment accepted by PaymentHandler
+	MaxBodyBytes int64
 }
 
 // New returns a new payment enforcer that can be used for easy BIP70 integration
 // for the keyserver.
-func New(PaymentURL string, secret string, Validator ValidatorFunc) *PaymentEnforcer {
+// If params is nil, payments are made on mainnet.
+func New(PaymentURL string, secret string, params *chaincfg.Params, Validator ValidatorFunc) *PaymentEnforcer {
 	pe := &PaymentEnforcer{
-		PaymentURL: PaymentURL,
-		Validator:  Validator,
-		Secret:     secret,
+		PaymentURL:   PaymentURL,
+		Validator:    Validator,
+		Secret:       secret,
+		ChainParams:  params,
+		MaxBodyBytes: DefaultMaxBodyBytes,
 	}
 	if pe.Validator == nil {
 		pe.Validator = DefaultValidator
 	}
+	if pe.ChainParams == nil {
+		pe.ChainParams = &chaincfg.MainNetParams
+	}
 	// Generate an ephemeral secret and hold on to it
 	if pe.Secret == "" {
 		pe.Secret = RandString(64)
@@ -50,8 +66,9 @@ func New(PaymentURL string, secret string, Validator ValidatorFunc) *PaymentEnfo
 	return pe
 }
 
-// DefaultValidator is the default request payment validator
-func DefaultValidator(r *http.Request, secret string) bool {
+// Token returns the payment token presented with a request, or an empty string if there
+// isn't one
+func Token(r *http.Request) string {
 	// First attempt to get the code from the querystring
 	token := r.URL.Query().Get("code")
 
@@ -60,12 +77,30 @@ func DefaultValidator(r *http.Request, secret string) bool {
 	if headerToken != "" && len(headerToken) >= 4 && headerToken[0:4] == "POP " {
 		token = headerToken[4:]
 	}
+	return token
+}
+
+// DefaultValidator is the default request payment validator
+func DefaultValidator(r *http.Request, secret, network string) bool {
+	token := Token(r)
 
 	// Remove the code query param, as it wasn't part of the HMAC hash
 	url := *r.URL
 	url.RawQuery = ""
 	// Validate that the HMAC is valid for this URL.
-	return ValidateHMACToken(url.String(), token, secret)
+	return ValidateHMACToken(tokenMessage(network, url.String()), token, secret)
+}
+
+// tokenMessage returns the message covered by the payment token for a URL.  Tokens are
+// bound to a network, so that one paid for on a test network can't be used on mainnet
+// even when both servers share a secret.
+func tokenMessage(network, url string) string {
+	return network + ":" + url
+}
+
+// network returns the BIP70 name of the network payments are made on
+func (e *PaymentEnforcer) network() string {
+	return netparams.BIP70Name(e.ChainParams)
 }
 
 // PaymentHandler is an http handler that implements a check for payment,
@@ -87,8 +122,13 @@ func (e *PaymentEnforcer) PaymentHandler(w http.ResponseWriter,
 		return
 	}
 
-	// Read the Payment information
-	body, err := ioutil.ReadAll(r.Body)
+	// Read the Payment information.  The reader only fails after reading MaxBodyBytes if
+	// the body is larger than that.
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, e.MaxBodyBytes))
+	if err != nil && int64(len(body)) == e.MaxBodyBytes {
+		http.Error(w, "payment too large", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		log.Error().Msgf("unable to read request body: %s", err.Error())
 		http.Error(w, "internal server error", http.StatusInternalServerError)
@@ -121,7 +161,7 @@ func (e *PaymentEnforcer) PaymentHandler(w http.ResponseWriter,
 	}
 	// Provide a payment token
 	// TODO: Maybe generate something with some metadata
-	token := GenerateHMACToken(string(payment.GetMerchantData()), e.Secret)
+	token := GenerateHMACToken(tokenMessage(e.network(), string(payment.GetMerchantData())), e.Secret)
 	loc, err := url.Parse(string(payment.GetMerchantData()))
 	if err != nil {
 		log.Error().Msgf("unable to parse merchent data: %s", err)
@@ -148,7 +188,7 @@ func (e *PaymentEnforcer) Middleware(prevHandler http.Handler) http.Handler {
 		log := hlog.FromRequest(r)
 
 		// If we have a valid payment, carry on
-		if e.Validator == nil || e.Validator(r, e.Secret) {
+		if e.Validator == nil || e.Validator(r, e.Secret, e.network()) {
 			prevHandler.ServeHTTP(w, r)
 			return
 		}
@@ -163,7 +203,7 @@ func (e *PaymentEnforcer) Middleware(prevHandler http.Handler) http.Handler {
 		// payment properly is sufficient.
 
 		// Create the payment details
-		network := "main"
+		network := e.network()
 		curTime := uint64(time.Now().Unix())
 		expireTime := uint64(time.Now().Add(10 * time.Second).Unix())
 		// Strip querystring since encoding and decoding might disrupt HMAC
@@ -205,8 +245,8 @@ func (e *PaymentEnforcer) Middleware(prevHandler http.Handler) http.Handler {
 		}
 
 		// Send the payment request
-                w.Header().Set("Content-Type", "application/bitcoincash-paymentrequest")
-                w.Header().Set("Content-Transfer-Encoding", "binary")
+		w.Header().Set("Content-Type", "application/bitcoincash-paymentrequest")
+		w.Header().Set("Content-Transfer-Encoding", "binary")
 		w.WriteHeader(http.StatusPaymentRequired)
 		w.Write(resp)
 	})
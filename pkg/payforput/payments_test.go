@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/gcash/bchd/chaincfg"
 	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/assert"
 )
@@ -20,7 +21,7 @@ func TestEnforcer(t *testing.T) {
 	keyPath := "/keys/foo"
 
 	// Create our enforcer middleware, and its endpoint
-	enforcer := New("/payments", "notasecret", DefaultValidator)
+	enforcer := New("/payments", "notasecret", nil, DefaultValidator)
 	assert.NotNil(enforcer)
 
 	///////
@@ -69,6 +70,15 @@ func TestEnforcer(t *testing.T) {
 	enforcer.PaymentHandler(response, request)
 	assert.Equal(http.StatusUnsupportedMediaType, response.Code, "StatusUnsupportedMediaType response is expected")
 	///////
+	// Check that oversized payments are refused
+	request, err = http.NewRequest("POST", payDetails.GetPaymentUrl(), bytes.NewReader(make([]byte, enforcer.MaxBodyBytes+1)))
+	assert.Nil(err)
+	request.Header.Add("Content-Type", "application/bitcoincash-payment")
+	request.Header.Add("Accept", "application/bitcoincash-paymentack")
+	response = httptest.NewRecorder()
+	enforcer.PaymentHandler(response, request)
+	assert.Equal(http.StatusRequestEntityTooLarge, response.Code, "StatusRequestEntityTooLarge response is expected")
+	///////
 	// Check that payment url gives us back a payment ack, and a token
 	request, err = http.NewRequest("POST", payDetails.GetPaymentUrl(), payBody)
 	assert.Nil(err)
@@ -95,7 +105,7 @@ func TestEnforcer(t *testing.T) {
 	response = httptest.NewRecorder()
 	request, err = http.NewRequest("PUT", loc, br)
 	assert.Nil(err)
-	assert.True(DefaultValidator(request, enforcer.Secret), "Token is not valid")
+	assert.True(DefaultValidator(request, enforcer.Secret, "main"), "Token is not valid")
 	enforcer.Middleware(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			r.Body.Close()
@@ -110,7 +120,7 @@ func TestEnforcer(t *testing.T) {
 	request, err = http.NewRequest("PUT", "http://localhost:8080"+keyPath, br)
 	assert.Nil(err)
 	request.Header.Add("Authorization", auth)
-	assert.True(DefaultValidator(request, enforcer.Secret), "Token is not valid")
+	assert.True(DefaultValidator(request, enforcer.Secret, "main"), "Token is not valid")
 	enforcer.Middleware(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			r.Body.Close()
@@ -119,3 +129,44 @@ func TestEnforcer(t *testing.T) {
 	).ServeHTTP(response, request)
 	assert.Equal(http.StatusOK, response.Code, "StatusOK response is expected")
 }
+
+func TestEnforcerNetwork(t *testing.T) {
+	assert := assert.New(t)
+
+	keyPath := "http://localhost:8080/keys/foo"
+	enforcer := New("/payments", "notasecret", &chaincfg.RegressionNetParams, DefaultValidator)
+
+	// The payment request is for the enforcer's network
+	response := httptest.NewRecorder()
+	request, err := http.NewRequest("PUT", keyPath, bytes.NewBuffer([]byte("")))
+	assert.Nil(err)
+	enforcer.Middleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	).ServeHTTP(response, request)
+	assert.Equal(http.StatusPaymentRequired, response.Code, "StatusPaymentRequired response is expected")
+	payRequest := &models.PaymentRequest{}
+	assert.Nil(proto.Unmarshal(response.Body.Bytes(), payRequest))
+	payDetails := &models.PaymentDetails{}
+	assert.Nil(proto.Unmarshal(payRequest.GetSerializedPaymentDetails(), payDetails))
+	assert.Equal("regtest", payDetails.GetNetwork())
+
+	// Tokens are only valid on the network they were paid on
+	payment := &models.Payment{
+		MerchantData: payDetails.GetMerchantData(),
+	}
+	paymentBytes, err := proto.Marshal(payment)
+	assert.Nil(err)
+	request, err = http.NewRequest("POST", payDetails.GetPaymentUrl(), bytes.NewBuffer(paymentBytes))
+	assert.Nil(err)
+	request.Header.Add("Content-Type", "application/bitcoincash-payment")
+	request.Header.Add("Accept", "application/bitcoincash-paymentack")
+	response = httptest.NewRecorder()
+	enforcer.PaymentHandler(response, request)
+	assert.Equal(http.StatusFound, response.Code, "StatusFound response is expected")
+
+	request, err = http.NewRequest("PUT", keyPath, bytes.NewBuffer([]byte("")))
+	assert.Nil(err)
+	request.Header.Add("Authorization", response.Header().Get("Authorization"))
+	assert.True(DefaultValidator(request, enforcer.Secret, "regtest"), "Token is not valid")
+	assert.False(DefaultValidator(request, enforcer.Secret, "main"), "Token is valid on the wrong network")
+}
@@ -0,0 +1,304 @@
+// Package recordio reads and writes streams of records in the formats used by
+// `keyserverd export` and `keyserverd import`.  The formats are described in
+// docs/export.md.
+package recordio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/cashweb/keyserver/pkg/models"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+const (
+	// FormatProto is a stream of protobuf encoded records, each preceded by its length as
+	// an unsigned varint
+	FormatProto = "proto"
+	// FormatJSONL is a stream of JSON encoded records, one per line
+	FormatJSONL = "jsonl"
+)
+
+// MaxRecordSize is the largest record a Reader accepts
+const MaxRecordSize = 16 * 1024 * 1024
+
+var (
+	// ErrUnknownFormat is returned for a format which isn't FormatProto or FormatJSONL
+	ErrUnknownFormat = errors.New("unknown record format")
+	// ErrRecordTooLarge is returned when reading a record larger than MaxRecordSize
+	ErrRecordTooLarge = errors.New("record too large")
+)
+
+// Record is a single address's entry in a stream, as encoded by the Record message in
+// proto/addressmetadata.proto.  Exactly one of Metadata and Revocation is set.  Metadata is
+// kept serialized, so that the proto format carries it byte for byte as it was signed.
+type Record struct {
+	// Address is the cashaddr, with its network prefix, that the record is stored under
+	Address string
+	// Metadata is the address's current metadata, as a serialized models.AddressMetadata
+	Metadata []byte
+	// Revocation is set instead of Metadata for addresses whose key has been revoked
+	Revocation *models.Revocation
+}
+
+// The numbers of the Record message's fields
+const (
+	addressField    = 1
+	metadataField   = 2
+	revocationField = 3
+)
+
+// Writer writes records to a stream
+type Writer interface {
+	Write(record *Record) error
+	// Flush writes any buffered records to the underlying stream
+	Flush() error
+}
+
+// Reader reads records from a stream.  Read returns io.EOF once the stream ends cleanly.
+type Reader interface {
+	Read() (*Record, error)
+}
+
+// NewWriter returns a Writer of records in format to w
+func NewWriter(w io.Writer, format string) (Writer, error) {
+	buf := bufio.NewWriter(w)
+	switch format {
+	case FormatProto:
+		return &protoWriter{w: buf}, nil
+	case FormatJSONL:
+		return &jsonlWriter{w: buf}, nil
+	}
+	return nil, errors.Wrapf(ErrUnknownFormat, "format %q", format)
+}
+
+// NewReader returns a Reader of records in format from r
+func NewReader(r io.Reader, format string) (Reader, error) {
+	buf := bufio.NewReader(r)
+	switch format {
+	case FormatProto:
+		return &protoReader{r: buf}, nil
+	case FormatJSONL:
+		return &jsonlReader{r: buf}, nil
+	}
+	return nil, errors.Wrapf(ErrUnknownFormat, "format %q", format)
+}
+
+type protoWriter struct {
+	w *bufio.Writer
+}
+
+func (p *protoWriter) Write(record *Record) error {
+	raw, err := Marshal(record)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, uint64(len(raw)))
+	if _, err := p.w.Write(prefix[:n]); err != nil {
+		return err
+	}
+	_, err = p.w.Write(raw)
+	return err
+}
+
+func (p *protoWriter) Flush() error {
+	return p.w.Flush()
+}
+
+type protoReader struct {
+	r *bufio.Reader
+}
+
+func (p *protoReader) Read() (*Record, error) {
+	size, err := binary.ReadUvarint(p.r)
+	if err != nil {
+		// A stream which ends within the length is truncated, rather than finished
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.Wrap(err, "truncated record length")
+		}
+		return nil, err
+	}
+	if size > MaxRecordSize {
+		return nil, errors.Wrapf(ErrRecordTooLarge, "%d bytes", size)
+	}
+	raw := make([]byte, size)
+	if _, err := io.ReadFull(p.r, raw); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(err, "truncated record")
+	}
+	return unmarshalRecord(raw)
+}
+
+type jsonlWriter struct {
+	w *bufio.Writer
+}
+
+func (j *jsonlWriter) Write(record *Record) error {
+	message, err := record.message()
+	if err != nil {
+		return err
+	}
+	if err := (&jsonpb.Marshaler{}).Marshal(j.w, message); err != nil {
+		return err
+	}
+	return j.w.WriteByte('\n')
+}
+
+func (j *jsonlWriter) Flush() error {
+	return j.w.Flush()
+}
+
+type jsonlReader struct {
+	r *bufio.Reader
+}
+
+func (j *jsonlReader) Read() (*Record, error) {
+	for {
+		line, err := j.readLine()
+		if err != nil {
+			return nil, err
+		}
+		// Blank lines, such as a trailing newline, are skipped
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		message := &models.Record{}
+		if err := jsonpb.Unmarshal(bytes.NewReader(line), message); err != nil {
+			return nil, errors.Wrap(err, "malformed record")
+		}
+		return fromMessage(message)
+	}
+}
+
+// readLine returns the next line, without reading more than MaxRecordSize bytes of it
+func (j *jsonlReader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := j.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > MaxRecordSize {
+			return nil, errors.Wrapf(ErrRecordTooLarge, "line of more than %d bytes", MaxRecordSize)
+		}
+		switch err {
+		case nil:
+			return line, nil
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			if len(line) > 0 {
+				return line, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// Marshal encodes record as a Record message.  The metadata is copied into the message as
+// it is, rather than re-encoded.
+func Marshal(record *Record) ([]byte, error) {
+	buf := proto.NewBuffer(nil)
+	if record.Address != "" {
+		buf.EncodeVarint(addressField<<3 | proto.WireBytes)
+		buf.EncodeStringBytes(record.Address)
+	}
+	if record.Metadata != nil {
+		buf.EncodeVarint(metadataField<<3 | proto.WireBytes)
+		buf.EncodeRawBytes(record.Metadata)
+	}
+	if record.Revocation != nil {
+		buf.EncodeVarint(revocationField<<3 | proto.WireBytes)
+		if err := buf.EncodeMessage(record.Revocation); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalRecord decodes a Record message, keeping the metadata as it was encoded
+func unmarshalRecord(raw []byte) (*Record, error) {
+	message := &models.Record{}
+	if err := proto.Unmarshal(raw, message); err != nil {
+		return nil, errors.Wrap(err, "malformed record")
+	}
+	record := &Record{
+		Address:    message.GetAddress(),
+		Revocation: message.GetRevocation(),
+	}
+	if message.GetMetadata() != nil {
+		metadata, ok := rawField(raw, metadataField)
+		if !ok {
+			return nil, errors.New("malformed record: unsupported wire type")
+		}
+		record.Metadata = append([]byte{}, metadata...)
+	}
+	return record, nil
+}
+
+// rawField returns the contents of the last occurrence of the length-delimited field
+// number within raw, which must already have been checked to be a well-formed message.
+// Groups aren't used by any of our messages, so aren't supported.
+func rawField(raw []byte, number uint64) ([]byte, bool) {
+	var field []byte
+	for len(raw) > 0 {
+		tag, n := proto.DecodeVarint(raw)
+		raw = raw[n:]
+		switch tag & 7 {
+		case proto.WireVarint:
+			_, n = proto.DecodeVarint(raw)
+		case proto.WireFixed64:
+			n = 8
+		case proto.WireFixed32:
+			n = 4
+		case proto.WireBytes:
+			size, m := proto.DecodeVarint(raw)
+			n = m + int(size)
+			if tag>>3 == number {
+				field = raw[m:n]
+			}
+		default:
+			return nil, false
+		}
+		raw = raw[n:]
+	}
+	return field, true
+}
+
+// message returns record as a Record message, with its metadata decoded
+func (record *Record) message() (*models.Record, error) {
+	message := &models.Record{
+		Address:    record.Address,
+		Revocation: record.Revocation,
+	}
+	if record.Metadata != nil {
+		message.Metadata = &models.AddressMetadata{}
+		if err := proto.Unmarshal(record.Metadata, message.Metadata); err != nil {
+			return nil, errors.Wrap(err, "malformed metadata")
+		}
+	}
+	return message, nil
+}
+
+// fromMessage returns the record held by a Record message, with its metadata encoded
+func fromMessage(message *models.Record) (*Record, error) {
+	record := &Record{
+		Address:    message.GetAddress(),
+		Revocation: message.GetRevocation(),
+	}
+	if message.GetMetadata() != nil {
+		metadata, err := proto.Marshal(message.GetMetadata())
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed record")
+		}
+		record.Metadata = metadata
+	}
+	return record, nil
+}
@@ -0,0 +1,149 @@
+package recordio
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// mustMarshal returns the encoding of metadata
+func mustMarshal(metadata *models.AddressMetadata) []byte {
+	raw, err := proto.Marshal(metadata)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+var testRecords = []*Record{
+	&Record{
+		Address: "bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a",
+		Metadata: mustMarshal(&models.AddressMetadata{
+			PubKey:    []byte{0x02, 0x01},
+			Signature: []byte("signature"),
+			Payload: &models.Payload{
+				Timestamp: 1560000000,
+				Ttl:       3600,
+				Entries: []*models.Entry{
+					&models.Entry{
+						Kind:      "EgoBoost",
+						Headers:   []*models.Header{&models.Header{Name: "Junk", Value: "Data\nwith a newline"}},
+						EntryData: []byte{0, '\n', 0xff},
+					},
+				},
+			},
+		}),
+	},
+	&Record{
+		Address: "bitcoincash:pqkh9ahfj069qv8l6eysyufazpe4fdjq3u4hna323j",
+		Revocation: &models.Revocation{
+			Timestamp:  1560000001,
+			Reason:     "key compromised",
+			Signatures: [][]byte{[]byte("a"), []byte("b")},
+		},
+	},
+}
+
+func TestRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, format := range []string{FormatProto, FormatJSONL} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, format)
+		assert.Nil(err)
+		for _, record := range testRecords {
+			assert.Nil(w.Write(record))
+		}
+		assert.Nil(w.Flush())
+
+		r, err := NewReader(&buf, format)
+		assert.Nil(err)
+		for _, expected := range testRecords {
+			record, err := r.Read()
+			assert.Nil(err)
+			assert.Equal(expected.Address, record.Address)
+			assert.Equal(expected.Metadata, record.Metadata, "%s record did not round trip", format)
+			assert.True(proto.Equal(expected.Revocation, record.Revocation), "%s record did not round trip", format)
+		}
+		_, err = r.Read()
+		assert.Equal(io.EOF, err)
+
+		// Records are encoded as Record messages
+		message, err := testRecords[1].message()
+		assert.Nil(err)
+		raw, err := Marshal(testRecords[1])
+		assert.Nil(err)
+		expected, err := proto.Marshal(message)
+		assert.Nil(err)
+		assert.Equal(expected, raw)
+	}
+}
+
+func TestRawMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	// The scheme, encoded as a non-minimal zero, which re-encoding would drop
+	metadata := append(mustMarshal(&models.AddressMetadata{Signature: []byte("signature")}), 0x18, 0x80, 0x00)
+	record := &Record{Address: "bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a", Metadata: metadata}
+
+	// The proto format keeps the metadata byte for byte
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, FormatProto)
+	assert.Nil(err)
+	assert.Nil(w.Write(record))
+	assert.Nil(w.Flush())
+	r, err := NewReader(&buf, FormatProto)
+	assert.Nil(err)
+	read, err := r.Read()
+	assert.Nil(err)
+	assert.Equal(record, read)
+
+	// Whereas JSON can only carry the metadata it decodes to
+	w, err = NewWriter(&buf, FormatJSONL)
+	assert.Nil(err)
+	assert.Nil(w.Write(record))
+	assert.Nil(w.Flush())
+	r, err = NewReader(&buf, FormatJSONL)
+	assert.Nil(err)
+	read, err = r.Read()
+	assert.Nil(err)
+	assert.Equal(metadata[:len(metadata)-3], read.Metadata)
+}
+
+func TestMalformedStreams(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, FormatProto)
+	assert.Nil(err)
+	assert.Nil(w.Write(testRecords[0]))
+	assert.Nil(w.Flush())
+
+	// A truncated stream is an error, rather than a clean end
+	r, err := NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), FormatProto)
+	assert.Nil(err)
+	_, err = r.Read()
+	assert.Equal(io.ErrUnexpectedEOF, errors.Cause(err))
+
+	// Lengths beyond the limit are rejected before anything is allocated
+	r, err = NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0x0f}), FormatProto)
+	assert.Nil(err)
+	_, err = r.Read()
+	assert.Equal(ErrRecordTooLarge, errors.Cause(err))
+
+	r, err = NewReader(bytes.NewReader([]byte("{\"address\": \"x\"}\n\nnot json\n")), FormatJSONL)
+	assert.Nil(err)
+	record, err := r.Read()
+	assert.Nil(err)
+	assert.Equal("x", record.Address)
+	_, err = r.Read()
+	assert.NotNil(err)
+
+	_, err = NewReader(&buf, "xml")
+	assert.Equal(ErrUnknownFormat, errors.Cause(err))
+}
@@ -0,0 +1,102 @@
+// Package sigverify verifies signatures of address metadata under the signature schemes
+// registered with it.  Verification never panics, whatever bytes it is given.
+package sigverify
+
+import (
+	"github.com/cashweb/keyserver/pkg/models"
+
+	"github.com/gcash/bchd/bchec"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrUnknownScheme indicates a signature scheme which isn't registered
+	ErrUnknownScheme = errors.New("unknown signature scheme")
+	// ErrMalformedSignature indicates a signature which can't be parsed under its scheme
+	ErrMalformedSignature = errors.New("malformed signature")
+	// ErrMalformedPubKey indicates a pubkey which can't be parsed
+	ErrMalformedPubKey = errors.New("malformed pubkey")
+)
+
+// Scheme is the signature scheme of a piece of metadata
+type Scheme = models.AddressMetadata_SignatureScheme
+
+// ParseFunc parses a signature encoded under a scheme
+type ParseFunc func(rawSig []byte) (*bchec.Signature, error)
+
+// Registry is a set of signature schemes.  It is not safe to register schemes while
+// signatures are being verified.
+type Registry struct {
+	schemes map[Scheme]ParseFunc
+}
+
+// NewRegistry returns a registry without any schemes
+func NewRegistry() *Registry {
+	return &Registry{
+		schemes: map[Scheme]ParseFunc{},
+	}
+}
+
+// Default is the registry of the schemes keyservers accept: Schnorr and DER-encoded ECDSA
+var Default = NewRegistry()
+
+func init() {
+	Default.Register(models.AddressMetadata_SCHNORR, bchec.ParseSchnorrSignature)
+	Default.Register(models.AddressMetadata_ECDSA, func(rawSig []byte) (*bchec.Signature, error) {
+		return bchec.ParseDERSignature(rawSig, bchec.S256())
+	})
+}
+
+// Register adds scheme to the registry, replacing any existing parser for it
+func (r *Registry) Register(scheme Scheme, parse ParseFunc) {
+	r.schemes[scheme] = parse
+}
+
+// Verify reports whether rawSig, encoded according to scheme, is a valid signature of
+// msgHash by rawPubKey.  An error is returned if the scheme isn't registered or either the
+// signature or pubkey can't be parsed.
+func (r *Registry) Verify(scheme Scheme, rawSig, msgHash, rawPubKey []byte) (bool, error) {
+	pubKey, err := ParsePubKey(rawPubKey)
+	if err != nil {
+		return false, err
+	}
+	return r.VerifyPubKey(scheme, rawSig, msgHash, pubKey)
+}
+
+// VerifyPubKey is Verify for a pubkey which has already been parsed
+func (r *Registry) VerifyPubKey(scheme Scheme, rawSig, msgHash []byte, pubKey *bchec.PublicKey) (valid bool, err error) {
+	parse, ok := r.schemes[scheme]
+	if !ok {
+		return false, errors.Wrapf(ErrUnknownScheme, "scheme %d", scheme)
+	}
+	if pubKey == nil {
+		return false, ErrMalformedPubKey
+	}
+
+	// Parsers are handed arbitrary bytes from the network, so make sure a bug in one
+	// can't take the server down with it.
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			valid = false
+			err = errors.Wrapf(ErrMalformedSignature, "%v", recovered)
+		}
+	}()
+	sig, err := parse(rawSig)
+	if err != nil {
+		return false, errors.Wrap(ErrMalformedSignature, err.Error())
+	}
+	if sig == nil {
+		return false, ErrMalformedSignature
+	}
+	// Verify the signature against the SHA256 of the message
+	return sig.Verify(msgHash, pubKey), nil
+}
+
+// ParsePubKey parses a serialized secp256k1 pubkey
+func ParsePubKey(rawPubKey []byte) (*bchec.PublicKey, error) {
+	pubKey, err := bchec.ParsePubKey(rawPubKey, bchec.S256())
+	if err != nil {
+		return nil, errors.Wrap(ErrMalformedPubKey, err.Error())
+	}
+	return pubKey, nil
+}
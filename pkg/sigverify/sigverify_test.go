@@ -0,0 +1,123 @@
+package sigverify
+
+import (
+	"crypto/sha256"
+	"testing"
+	"testing/quick"
+
+	"github.com/cashweb/keyserver/pkg/models"
+	"github.com/gcash/bchd/bchec"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	rawPubKey := privKey.PubKey().SerializeCompressed()
+
+	// Signatures under either scheme verify, and nothing else does
+	signed := func(msg []byte) bool {
+		msgHash := sha256.Sum256(msg)
+		schnorr, err := privKey.SignSchnorr(msgHash[:])
+		assert.Nil(err)
+		ecdsa, err := privKey.SignECDSA(msgHash[:])
+		assert.Nil(err)
+
+		valid, err := Default.Verify(models.AddressMetadata_SCHNORR, schnorr.Serialize(), msgHash[:], rawPubKey)
+		if !valid || err != nil {
+			return false
+		}
+		valid, err = Default.Verify(models.AddressMetadata_ECDSA, ecdsa.Serialize(), msgHash[:], rawPubKey)
+		if !valid || err != nil {
+			return false
+		}
+
+		// The wrong scheme, or a different message, doesn't verify
+		valid, _ = Default.Verify(models.AddressMetadata_ECDSA, schnorr.Serialize(), msgHash[:], rawPubKey)
+		if valid {
+			return false
+		}
+		otherHash := sha256.Sum256(append(msg, 0))
+		valid, _ = Default.Verify(models.AddressMetadata_SCHNORR, schnorr.Serialize(), otherHash[:], rawPubKey)
+		return !valid
+	}
+	assert.Nil(quick.Check(signed, nil))
+}
+
+func TestVerifyRandomInput(t *testing.T) {
+	assert := assert.New(t)
+
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	rawPubKey := privKey.PubKey().SerializeCompressed()
+
+	// Random bytes never verify, never panic, and are never both valid and an error
+	random := func(scheme int32, rawSig, msgHash, randomPubKey []byte) bool {
+		s := Scheme(scheme % 4)
+		_, registered := Default.schemes[s]
+		for _, pubKey := range [][]byte{rawPubKey, randomPubKey} {
+			valid, err := Default.Verify(s, rawSig, msgHash, pubKey)
+			if valid {
+				return false
+			}
+			cause := errors.Cause(err)
+			if !registered && cause != ErrUnknownScheme && cause != ErrMalformedPubKey {
+				return false
+			}
+		}
+		return true
+	}
+	assert.Nil(quick.Check(random, nil))
+
+	// Garbage in the shape of real signatures is malformed rather than a panic
+	shaped := func(scheme bool, body [63]byte) bool {
+		rawSig := append([]byte{0x30, 0x44, 0x02, 0x20}, body[:]...)
+		s := models.AddressMetadata_ECDSA
+		if scheme {
+			rawSig = append(body[:], 0)
+			s = models.AddressMetadata_SCHNORR
+		}
+		valid, _ := Default.Verify(s, rawSig, make([]byte, 32), rawPubKey)
+		return !valid
+	}
+	assert.Nil(quick.Check(shaped, nil))
+}
+
+func TestRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	privKey, err := bchec.NewPrivateKey(bchec.S256())
+	assert.Nil(err)
+	rawPubKey := privKey.PubKey().SerializeCompressed()
+	msgHash := sha256.Sum256([]byte("registry"))
+	sig, err := privKey.SignSchnorr(msgHash[:])
+	assert.Nil(err)
+
+	// Only registered schemes are accepted
+	registry := NewRegistry()
+	_, err = registry.Verify(models.AddressMetadata_SCHNORR, sig.Serialize(), msgHash[:], rawPubKey)
+	assert.Equal(ErrUnknownScheme, errors.Cause(err))
+
+	registry.Register(models.AddressMetadata_SCHNORR, bchec.ParseSchnorrSignature)
+	valid, err := registry.Verify(models.AddressMetadata_SCHNORR, sig.Serialize(), msgHash[:], rawPubKey)
+	assert.Nil(err)
+	assert.True(valid)
+
+	// A parser which returns nothing, or panics, is treated as a malformed signature
+	registry.Register(models.AddressMetadata_ECDSA, func(rawSig []byte) (*bchec.Signature, error) {
+		return nil, nil
+	})
+	_, err = registry.Verify(models.AddressMetadata_ECDSA, sig.Serialize(), msgHash[:], rawPubKey)
+	assert.Equal(ErrMalformedSignature, errors.Cause(err))
+	registry.Register(models.AddressMetadata_ECDSA, func(rawSig []byte) (*bchec.Signature, error) {
+		panic("parser bug")
+	})
+	_, err = registry.Verify(models.AddressMetadata_ECDSA, sig.Serialize(), msgHash[:], rawPubKey)
+	assert.Equal(ErrMalformedSignature, errors.Cause(err))
+
+	_, err = registry.Verify(models.AddressMetadata_SCHNORR, sig.Serialize(), msgHash[:], []byte{0x02})
+	assert.Equal(ErrMalformedPubKey, errors.Cause(err))
+}